@@ -0,0 +1,75 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/NikWaltz/metrics-collector/internal/dump"
+)
+
+// Export formats, see /export.
+const (
+	FormatNDJSON = dump.FormatNDJSON
+	FormatCSV    = dump.FormatCSV
+)
+
+// Import modes, see /import.
+const (
+	ImportReplace = "replace"
+	ImportAdd     = "add"
+)
+
+// Export streams all metrics of the server in the format into w.
+func (c *Client) Export(ctx context.Context, format string, w io.Writer) error {
+	u := c.base.ResolveReference(&url.URL{Path: "/export", RawQuery: url.Values{"format": {format}}.Encode()})
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("X-Request-ID", newRequestID())
+	response, err := c.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(response.Body)
+		return errorFromResponse(response.StatusCode, body)
+	}
+	_, err = io.Copy(w, response.Body)
+	return err
+}
+
+// Import writes an export in the format into the server and returns the
+// number of imported metrics. The server rejects the whole import when any
+// metric is invalid.
+func (c *Client) Import(ctx context.Context, format string, body []byte, mode string) (int, error) {
+	u := c.base.ResolveReference(&url.URL{Path: "/import", RawQuery: url.Values{"mode": {mode}}.Encode()})
+	request, _, err := c.newPush(ctx, u.String(), dump.ContentType(format), body)
+	if err != nil {
+		return 0, err
+	}
+	response, err := c.http.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	respBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return 0, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return 0, errorFromResponse(response.StatusCode, respBody)
+	}
+	var result struct {
+		Imported int `json:"imported"`
+	}
+	if errDecode := json.Unmarshal(respBody, &result); errDecode != nil {
+		return 0, fmt.Errorf("unable to decode response: %w", errDecode)
+	}
+	return result.Imported, nil
+}
@@ -0,0 +1,291 @@
+// Package client pushes metrics to the collector over its HTTP API.
+//
+// Metrics are buffered by name and sent in batches to /updates/: the last
+// value of a gauge wins, counter deltas add up and histograms are merged.
+// A batch is sent by Flush, when the buffer reaches Config.BatchSize, every
+// Config.FlushInterval and on Close.
+package client
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+// DefaultRetries are the pauses between attempts to send a batch.
+var DefaultRetries = []time.Duration{time.Second, 3 * time.Second, 5 * time.Second}
+
+var ErrClosed = errors.New("client is closed")
+
+type Config struct {
+	// URL of the server, e.g. http://127.0.0.1:8080.
+	URL string
+	// Key signs every metric and the whole body. KeyID names the key in
+	// the server keyring.
+	Key   string
+	KeyID string
+	// PublicKey of the server encrypts the bodies when set.
+	PublicKey *rsa.PublicKey
+	// Gzip compresses the bodies.
+	Gzip bool
+	// HTTPClient defaults to a client with a 10 second timeout.
+	HTTPClient *http.Client
+	// BatchSize flushes the buffer in the background once it holds that
+	// many metrics and splits larger flushes into batches of that size.
+	// Zero sends everything in one batch.
+	BatchSize int
+	// FlushInterval flushes the buffer in the background. Zero leaves
+	// flushing to Flush and Close.
+	FlushInterval time.Duration
+	// Retries are the pauses between attempts, DefaultRetries when nil.
+	// Requests are retried on network errors, 429 and 5xx responses.
+	Retries []time.Duration
+	// Logger receives retries, rejected metrics and failed background
+	// flushes, and successful sends at debug level. Nothing is logged when
+	// it is nil.
+	Logger logrus.FieldLogger
+}
+
+type Client struct {
+	cfg      Config
+	log      logrus.FieldLogger
+	base     *url.URL
+	endpoint string
+	http     *http.Client
+
+	mu         sync.Mutex
+	gauges     map[string]float64
+	counters   map[string]int64
+	histograms map[string]model.Histogram
+	closed     bool
+
+	sendMu sync.Mutex
+	flush  chan struct{}
+	done   chan struct{}
+	wg     sync.WaitGroup
+}
+
+func New(cfg Config) (*Client, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, fmt.Errorf("invalid url %q: want http(s)://host:port", cfg.URL)
+	}
+	if cfg.KeyID != "" && cfg.Key == "" {
+		return nil, errors.New("key id needs a key")
+	}
+	if cfg.Retries == nil {
+		cfg.Retries = DefaultRetries
+	}
+	httpClient := cfg.HTTPClient
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	logger := cfg.Logger
+	if logger == nil {
+		discard := logrus.New()
+		discard.SetOutput(io.Discard)
+		logger = discard
+	}
+	c := &Client{
+		cfg:        cfg,
+		log:        logger,
+		base:       u,
+		endpoint:   u.ResolveReference(&url.URL{Path: "/updates/"}).String(),
+		http:       httpClient,
+		gauges:     make(map[string]float64),
+		counters:   make(map[string]int64),
+		histograms: make(map[string]model.Histogram),
+		flush:      make(chan struct{}, 1),
+		done:       make(chan struct{}),
+	}
+	c.wg.Add(1)
+	go c.run()
+	return c, nil
+}
+
+// Gauge sets the gauge, replacing a value that has not been sent yet.
+func (c *Client) Gauge(name string, value float64) {
+	c.mu.Lock()
+	c.gauges[name] = value
+	c.mu.Unlock()
+	c.checkBatch()
+}
+
+// Counter adds delta to the counter.
+func (c *Client) Counter(name string, delta int64) {
+	c.mu.Lock()
+	c.counters[name] += delta
+	c.mu.Unlock()
+	c.checkBatch()
+}
+
+// Histogram merges the observations into the histogram. Observations with
+// other bounds than the buffered ones replace them.
+func (c *Client) Histogram(name string, value model.Histogram) {
+	c.mu.Lock()
+	c.mergeHistogram(name, value)
+	c.mu.Unlock()
+	c.checkBatch()
+}
+
+func (c *Client) mergeHistogram(name string, value model.Histogram) {
+	buffered, ok := c.histograms[name]
+	if ok {
+		if err := buffered.Merge(value); err == nil {
+			c.histograms[name] = buffered
+			return
+		}
+		c.log.WithField("metric", name).Warn("histogram bounds changed, dropping buffered observations")
+	}
+	c.histograms[name] = value.Copy()
+}
+
+func (c *Client) checkBatch() {
+	if c.cfg.BatchSize <= 0 || c.buffered() < c.cfg.BatchSize {
+		return
+	}
+	select {
+	case c.flush <- struct{}{}:
+	default:
+	}
+}
+
+func (c *Client) buffered() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.gauges) + len(c.counters) + len(c.histograms)
+}
+
+func (c *Client) run() {
+	defer c.wg.Done()
+	var tick <-chan time.Time
+	if c.cfg.FlushInterval > 0 {
+		ticker := time.NewTicker(c.cfg.FlushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-tick:
+		case <-c.flush:
+		case <-c.done:
+			return
+		}
+		if err := c.Flush(context.Background()); err != nil {
+			c.log.WithError(err).Error("unable to flush metrics")
+		}
+	}
+}
+
+// Flush sends the buffered metrics. Batches that could not be delivered
+// after all retries are put back into the buffer. Metrics the server
+// rejected are dropped and reported in a *BatchError.
+func (c *Client) Flush(ctx context.Context) error {
+	c.sendMu.Lock()
+	defer c.sendMu.Unlock()
+	metrics := c.take()
+	size := c.cfg.BatchSize
+	if size <= 0 {
+		size = len(metrics)
+	}
+	var rejected *BatchError
+	for start := 0; start < len(metrics); start += size {
+		end := start + size
+		if end > len(metrics) {
+			end = len(metrics)
+		}
+		err := c.send(ctx, metrics[start:end])
+		var batchErr *BatchError
+		switch {
+		case err == nil:
+		case errors.As(err, &batchErr):
+			rejected = rejected.add(batchErr)
+		case temporary(err):
+			c.putBack(metrics[start:])
+			return err
+		default:
+			c.putBack(metrics[end:])
+			return err
+		}
+	}
+	if rejected != nil {
+		return rejected
+	}
+	return nil
+}
+
+// Close flushes the buffer and stops the background flushes.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.closed = true
+	c.mu.Unlock()
+	close(c.done)
+	c.wg.Wait()
+	return c.Flush(context.Background())
+}
+
+// take empties the buffer into a batch sorted by type and name.
+func (c *Client) take() []model.Metrics {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	metrics := make([]model.Metrics, 0, len(c.gauges)+len(c.counters)+len(c.histograms))
+	for name, value := range c.gauges {
+		value := value
+		metrics = append(metrics, model.Metrics{ID: name, MType: model.GaugeType, Value: &value})
+	}
+	for name, delta := range c.counters {
+		delta := delta
+		metrics = append(metrics, model.Metrics{ID: name, MType: model.CounterType, Delta: &delta})
+	}
+	for name, histogram := range c.histograms {
+		histogram := histogram
+		metrics = append(metrics, model.Metrics{ID: name, MType: model.HistogramType, Histogram: &histogram})
+	}
+	c.gauges = make(map[string]float64)
+	c.counters = make(map[string]int64)
+	c.histograms = make(map[string]model.Histogram)
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].MType != metrics[j].MType {
+			return metrics[i].MType < metrics[j].MType
+		}
+		return metrics[i].ID < metrics[j].ID
+	})
+	return metrics
+}
+
+// putBack returns unsent metrics to the buffer without overwriting gauges
+// that were set in the meantime.
+func (c *Client) putBack(metrics []model.Metrics) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, metric := range metrics {
+		switch metric.MType {
+		case model.GaugeType:
+			if _, ok := c.gauges[metric.ID]; !ok {
+				c.gauges[metric.ID] = *metric.Value
+			}
+		case model.CounterType:
+			c.counters[metric.ID] += *metric.Delta
+		case model.HistogramType:
+			c.mergeHistogram(metric.ID, *metric.Histogram)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+package client
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NikWaltz/metrics-collector/internal/replay"
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+// recorder is a fake server that answers with the given statuses in turn
+// and keeps the batches it received.
+type recorder struct {
+	mu       sync.Mutex
+	statuses []int
+	bodies   [][]byte
+	batches  [][]model.Metrics
+	requests []*http.Request
+}
+
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var reader io.Reader = req.Body
+	if req.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reader = gz
+	}
+	body, _ := io.ReadAll(reader)
+	var batch []model.Metrics
+	_ = json.Unmarshal(body, &batch)
+	r.bodies = append(r.bodies, body)
+	r.batches = append(r.batches, batch)
+	r.requests = append(r.requests, req)
+	status := http.StatusOK
+	if len(r.statuses) > 0 {
+		status, r.statuses = r.statuses[0], r.statuses[1:]
+	}
+	if status == http.StatusMultiStatus {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`{"accepted":0,"rejected":1,"results":[{"id":"Alloc","type":"gauge","status":400,` +
+			`"error":{"code":"invalid_metric","message":"bad","id":"Alloc"}}]}`))
+		return
+	}
+	if status != http.StatusOK {
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(`{"code":"internal","message":"boom"}`))
+	}
+}
+
+func newTestClient(t *testing.T, rec *recorder, cfg Config) *Client {
+	server := httptest.NewServer(rec)
+	t.Cleanup(server.Close)
+	cfg.URL = server.URL
+	if cfg.Retries == nil {
+		cfg.Retries = []time.Duration{time.Millisecond}
+	}
+	c, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestClient_Flush(t *testing.T) {
+	rec := &recorder{}
+	c := newTestClient(t, rec, Config{})
+	c.Gauge("Alloc", 1)
+	c.Gauge("Alloc", 2.5)
+	c.Counter("PollCount", 2)
+	c.Counter("PollCount", 3)
+	histogram := model.NewHistogram([]float64{1})
+	histogram.Observe(0.5)
+	c.Histogram("GCPause", histogram)
+	c.Histogram("GCPause", histogram)
+
+	assert.NoError(t, c.Flush(context.Background()))
+	assert.Len(t, rec.batches, 1)
+	batch := rec.batches[0]
+	assert.Len(t, batch, 3)
+	assert.Equal(t, "counter", batch[0].MType)
+	assert.Equal(t, int64(5), *batch[0].Delta)
+	assert.Equal(t, 2.5, *batch[1].Value)
+	assert.Equal(t, int64(2), batch[2].Histogram.Count)
+	assert.Equal(t, "/updates/", rec.requests[0].URL.Path)
+	assert.NotEmpty(t, rec.requests[0].Header.Get("X-Request-ID"))
+
+	assert.NoError(t, c.Flush(context.Background()))
+	assert.Len(t, rec.batches, 1, "an empty buffer is not sent")
+}
+
+func TestClient_Logger(t *testing.T) {
+	logger, hook := logtest.NewNullLogger()
+	logger.SetLevel(logrus.DebugLevel)
+	rec := &recorder{}
+	c := newTestClient(t, rec, Config{Logger: logger})
+	c.Gauge("Alloc", 1)
+	assert.NoError(t, c.Flush(context.Background()))
+	if assert.NotNil(t, hook.LastEntry()) {
+		assert.Equal(t, logrus.DebugLevel, hook.LastEntry().Level)
+		assert.Equal(t, "metrics sent", hook.LastEntry().Message)
+	}
+}
+
+func TestClient_signedGzip(t *testing.T) {
+	rec := &recorder{}
+	c := newTestClient(t, rec, Config{Key: "secret", KeyID: "agent-1", Gzip: true})
+	c.Gauge("Alloc", 1)
+	assert.NoError(t, c.Flush(context.Background()))
+
+	req := rec.requests[0]
+	assert.Equal(t, "agent-1", req.Header.Get("X-Key-ID"))
+	assert.True(t, replay.Verify("secret", req.Header.Get(replay.TimestampHeader), req.Header.Get(replay.NonceHeader),
+		req.URL.Path, rec.bodies[0], req.Header.Get(replay.HashHeader)))
+	assert.NotEmpty(t, rec.batches[0][0].Hash)
+	assert.Equal(t, "agent-1", rec.batches[0][0].KeyID)
+}
+
+func TestClient_retries(t *testing.T) {
+	tests := []struct {
+		name         string
+		statuses     []int
+		wantErr      bool
+		wantRequests int
+		wantBuffered int
+	}{
+		{name: "Retry server errors", statuses: []int{500}, wantRequests: 2},
+		{name: "Keep metrics when retries run out", statuses: []int{503, 503}, wantErr: true, wantRequests: 2, wantBuffered: 2},
+		{name: "Drop a rejected batch", statuses: []int{403}, wantErr: true, wantRequests: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := &recorder{statuses: tt.statuses}
+			c := newTestClient(t, rec, Config{})
+			c.Gauge("Alloc", 1)
+			c.Counter("PollCount", 1)
+			err := c.Flush(context.Background())
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Len(t, rec.requests, tt.wantRequests)
+			assert.Equal(t, tt.wantBuffered, c.buffered())
+		})
+	}
+}
+
+func TestClient_partialRejection(t *testing.T) {
+	rec := &recorder{statuses: []int{http.StatusMultiStatus}}
+	c := newTestClient(t, rec, Config{})
+	c.Gauge("Alloc", 1)
+	err := c.Flush(context.Background())
+
+	var batchErr *BatchError
+	if assert.True(t, errors.As(err, &batchErr)) {
+		assert.Equal(t, 1, batchErr.Rejected)
+		assert.Equal(t, "invalid_metric", batchErr.Results[0].Error.Code)
+	}
+	assert.Equal(t, 0, c.buffered())
+}
+
+func TestClient_batchSize(t *testing.T) {
+	rec := &recorder{}
+	c := newTestClient(t, rec, Config{BatchSize: 2})
+	c.Gauge("a", 1)
+	c.Gauge("b", 1)
+	assert.Eventually(t, func() bool {
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+		return len(rec.batches) == 1
+	}, time.Second, time.Millisecond, "a full buffer is flushed in the background")
+
+	c.Gauge("c", 1)
+	c.Gauge("d", 1)
+	c.Gauge("e", 1)
+	assert.NoError(t, c.Close())
+	total := 0
+	for _, batch := range rec.batches {
+		assert.LessOrEqual(t, len(batch), 2)
+		total += len(batch)
+	}
+	assert.Equal(t, 5, total, "close flushes the rest")
+	assert.ErrorIs(t, c.Close(), ErrClosed)
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     Config
+		wantErr bool
+	}{
+		{name: "Valid", cfg: Config{URL: "http://127.0.0.1:8080"}},
+		{name: "Missing scheme", cfg: Config{URL: "127.0.0.1:8080"}, wantErr: true},
+		{name: "Key id without key", cfg: Config{URL: "http://127.0.0.1:8080", KeyID: "a"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := New(tt.cfg)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.NoError(t, c.Close())
+		})
+	}
+}
+
+func Test_outboundIP(t *testing.T) {
+	assert.Equal(t, "127.0.0.1", outboundIP(&url.URL{Scheme: "http", Host: "127.0.0.1:8080"}))
+	assert.Equal(t, "", outboundIP(&url.URL{Scheme: "http", Host: "not an address"}))
+}
+
+func TestClient_List(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/export" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte("{\"id\":\"Alloc\",\"type\":\"gauge\",\"value\":12.5}\n{\"id\":\"PollCount\",\"type\":\"counter\",\"delta\":5}\n"))
+	}))
+	defer server.Close()
+
+	c, err := New(Config{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	got, err := c.List(context.Background())
+	assert.NoError(t, err)
+	value, delta := 12.5, int64(5)
+	assert.Equal(t, []model.Metrics{
+		{ID: "Alloc", MType: model.GaugeType, Value: &value},
+		{ID: "PollCount", MType: model.CounterType, Delta: &delta},
+	}, got)
+}
+
+func TestClient_Get(t *testing.T) {
+	value := 12.5
+	answer := model.Metrics{ID: "Alloc", MType: model.GaugeType, Value: &value}
+	hash(&answer, "secret")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request model.Metrics
+		_ = json.NewDecoder(r.Body).Decode(&request)
+		if request.ID != answer.ID {
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"code":"not_found","message":"metric not exist"}`))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(answer)
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name    string
+		key     string
+		id      string
+		wantErr error
+	}{
+		{name: "Read gauge", key: "secret", id: "Alloc"},
+		{name: "Read without key", id: "Alloc"},
+		{name: "Wrong key", key: "other", id: "Alloc", wantErr: ErrHashMismatch},
+		{name: "Missing metric", id: "Nope", wantErr: &Error{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := New(Config{URL: server.URL, Key: tt.key})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := c.Get(context.Background(), "Gauge", tt.id)
+			switch want := tt.wantErr.(type) {
+			case nil:
+				assert.NoError(t, err)
+				assert.Equal(t, 12.5, *got.Value)
+			case *Error:
+				assert.True(t, errors.As(err, &want))
+				assert.Equal(t, http.StatusNotFound, want.Status)
+			default:
+				assert.ErrorIs(t, err, want)
+			}
+		})
+	}
+}
+
+func TestClient_Describe(t *testing.T) {
+	rec := &recorder{statuses: []int{http.StatusOK, http.StatusConflict}}
+	c := newTestClient(t, rec, Config{Key: "secret", Gzip: true})
+	metadata := []model.Metadata{{ID: "Alloc", Type: model.GaugeType, Unit: "bytes"}}
+
+	assert.NoError(t, c.Describe(context.Background(), metadata))
+	var e *Error
+	assert.True(t, errors.As(c.Describe(context.Background(), metadata), &e))
+	assert.Equal(t, http.StatusConflict, e.Status)
+
+	assert.Len(t, rec.requests, 2)
+	assert.Equal(t, "/metadata/", rec.requests[0].URL.Path)
+	assert.NotEmpty(t, rec.requests[0].Header.Get(replay.HashHeader))
+	var got []model.Metadata
+	assert.NoError(t, json.Unmarshal(rec.bodies[0], &got))
+	assert.Equal(t, metadata, got)
+}
@@ -0,0 +1,53 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+// Describe registers the units, descriptions, types and owners of metrics.
+// Empty fields keep the registered values. A metric with a registered type
+// is rejected by the server when it is sent as another type.
+func (c *Client) Describe(ctx context.Context, metadata []model.Metadata) error {
+	body, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	u := c.base.ResolveReference(&url.URL{Path: "/metadata/"})
+	request, _, err := c.newPush(ctx, u.String(), "application/json", body)
+	if err != nil {
+		return err
+	}
+	response, err := c.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	respBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return errorFromResponse(response.StatusCode, respBody)
+	}
+	return nil
+}
+
+// Metadata reads the metadata of all metrics.
+func (c *Client) Metadata(ctx context.Context) ([]model.Metadata, error) {
+	body, err := c.do(ctx, http.MethodGet, "/metadata/", nil)
+	if err != nil {
+		return nil, err
+	}
+	var list []model.Metadata
+	if errDecode := json.Unmarshal(body, &list); errDecode != nil {
+		return nil, fmt.Errorf("unable to decode response: %w", errDecode)
+	}
+	return list, nil
+}
@@ -0,0 +1,116 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+var ErrHashMismatch = errors.New("hash of the response does not match")
+
+// Send pushes the metrics right away, bypassing the buffer. Types are
+// matched case-insensitively.
+func (c *Client) Send(ctx context.Context, metrics []model.Metrics) error {
+	batch := make([]model.Metrics, len(metrics))
+	for i, metric := range metrics {
+		metric.MType = strings.ToLower(metric.MType)
+		batch[i] = metric
+	}
+	return c.send(ctx, batch)
+}
+
+// Get reads a metric from /value/. The hash of the answer is checked when
+// the client has a key.
+func (c *Client) Get(ctx context.Context, metricType string, name string) (model.Metrics, error) {
+	request := model.Metrics{ID: name, MType: strings.ToLower(metricType), KeyID: c.cfg.KeyID}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return model.Metrics{}, err
+	}
+	respBody, err := c.do(ctx, http.MethodPost, "/value/", body)
+	if err != nil {
+		return model.Metrics{}, err
+	}
+	var metric model.Metrics
+	if errDecode := json.Unmarshal(respBody, &metric); errDecode != nil {
+		return model.Metrics{}, fmt.Errorf("unable to decode response: %w", errDecode)
+	}
+	if c.cfg.Key != "" {
+		got := metric.Hash
+		hash(&metric, c.cfg.Key)
+		if !hmac.Equal([]byte(got), []byte(metric.Hash)) {
+			return model.Metrics{}, ErrHashMismatch
+		}
+	}
+	return metric, nil
+}
+
+// List reads all metrics from /export in one request. The export carries
+// no hashes, so unlike Get the values are not checked against the key.
+func (c *Client) List(ctx context.Context) ([]model.Metrics, error) {
+	body, err := c.do(ctx, http.MethodGet, "/export", nil)
+	if err != nil {
+		return nil, err
+	}
+	var metrics []model.Metrics
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	for {
+		var metric model.Metrics
+		errDecode := decoder.Decode(&metric)
+		if errors.Is(errDecode, io.EOF) {
+			return metrics, nil
+		}
+		if errDecode != nil {
+			return nil, fmt.Errorf("unable to decode export: %w", errDecode)
+		}
+		metrics = append(metrics, metric)
+	}
+}
+
+// do sends a request that is not a batch and returns the body of a 200
+// answer. Other answers are returned as *Error.
+func (c *Client) do(ctx context.Context, method string, path string, body []byte) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	request, err := http.NewRequestWithContext(ctx, method, c.base.ResolveReference(&url.URL{Path: path}).String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("X-Request-ID", newRequestID())
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	response, err := c.http.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	respBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, errorFromResponse(response.StatusCode, respBody)
+	}
+	return respBody, nil
+}
+
+func errorFromResponse(status int, body []byte) *Error {
+	e := &Error{}
+	if err := json.Unmarshal(body, e); err != nil || e.Code == "" {
+		e = &Error{Message: http.StatusText(status)}
+	}
+	e.Status = status
+	return e
+}
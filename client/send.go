@@ -0,0 +1,260 @@
+package client
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/NikWaltz/metrics-collector/internal/encryption"
+	"github.com/NikWaltz/metrics-collector/internal/replay"
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+// Error is the error envelope of the server.
+type Error struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	ID      string `json:"id,omitempty"`
+}
+
+func (e *Error) Error() string {
+	if e.ID != "" {
+		return fmt.Sprintf("%d %s: %s: %s", e.Status, e.Code, e.ID, e.Message)
+	}
+	return fmt.Sprintf("%d %s: %s", e.Status, e.Code, e.Message)
+}
+
+// Result is the outcome of one metric of a batch.
+type Result struct {
+	ID     string `json:"id"`
+	Type   string `json:"type"`
+	Status int    `json:"status"`
+	Error  *Error `json:"error,omitempty"`
+}
+
+// BatchError reports the metrics the server rejected. The others were
+// saved.
+type BatchError struct {
+	Accepted int      `json:"accepted"`
+	Rejected int      `json:"rejected"`
+	Results  []Result `json:"results"`
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d of %d metrics rejected", e.Rejected, e.Accepted+e.Rejected)
+}
+
+func (e *BatchError) add(other *BatchError) *BatchError {
+	if e == nil {
+		return other
+	}
+	e.Accepted += other.Accepted
+	e.Rejected += other.Rejected
+	e.Results = append(e.Results, other.Results...)
+	return e
+}
+
+// temporary tells whether sending again may succeed.
+func temporary(err error) bool {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Status == http.StatusTooManyRequests || e.Status >= http.StatusInternalServerError
+	}
+	var batchErr *BatchError
+	if errors.As(err, &batchErr) {
+		return false
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
+
+// send posts the batch, retrying temporary failures with a fresh request id,
+// timestamp and nonce on every attempt.
+func (c *Client) send(ctx context.Context, metrics []model.Metrics) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	if c.cfg.Key != "" {
+		for i := range metrics {
+			hash(&metrics[i], c.cfg.Key)
+			metrics[i].KeyID = c.cfg.KeyID
+		}
+	}
+	body, err := json.Marshal(metrics)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		err = c.post(ctx, body, len(metrics))
+		if err == nil || !temporary(err) || attempt >= len(c.cfg.Retries) {
+			return err
+		}
+		c.log.WithError(err).WithField("attempt", attempt+1).Warn("retrying metrics")
+		select {
+		case <-time.After(c.cfg.Retries[attempt]):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (c *Client) post(ctx context.Context, body []byte, count int) error {
+	request, requestID, err := c.newPush(ctx, c.endpoint, "application/json", body)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	response, err := c.http.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	respBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	entry := c.log.WithFields(logrus.Fields{
+		"request_id":  requestID,
+		"endpoint":    c.endpoint,
+		"metrics":     count,
+		"status":      response.StatusCode,
+		"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+	})
+	switch response.StatusCode {
+	case http.StatusOK:
+		entry.Debug("metrics sent")
+		return nil
+	case http.StatusMultiStatus:
+		entry.Warn("metrics rejected")
+		batchErr := &BatchError{}
+		if errDecode := json.Unmarshal(respBody, batchErr); errDecode != nil {
+			return fmt.Errorf("unable to decode response: %w", errDecode)
+		}
+		return batchErr
+	}
+	entry.Warn("metrics rejected")
+	return errorFromResponse(response.StatusCode, respBody)
+}
+
+// newPush builds a POST of the body compressed, encrypted and signed as
+// configured.
+func (c *Client) newPush(ctx context.Context, endpoint string, contentType string, body []byte) (*http.Request, string, error) {
+	payload := body
+	if c.cfg.Gzip {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(body); err != nil {
+			return nil, "", err
+		}
+		if err := gz.Close(); err != nil {
+			return nil, "", err
+		}
+		payload = buf.Bytes()
+	}
+	scheme := ""
+	if c.cfg.PublicKey != nil {
+		var err error
+		scheme, payload, err = encryption.Encrypt(c.cfg.PublicKey, payload)
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to encrypt metrics: %w", err)
+		}
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, "", err
+	}
+	requestID := newRequestID()
+	request.Header.Set("Content-Type", contentType)
+	request.Header.Set("X-Request-ID", requestID)
+	if ip := outboundIP(request.URL); ip != "" {
+		request.Header.Set("X-Real-IP", ip)
+	}
+	if c.cfg.Gzip {
+		request.Header.Set("Content-Encoding", "gzip")
+	}
+	if scheme != "" {
+		request.Header.Set(encryption.Header, scheme)
+	}
+	if c.cfg.Key != "" {
+		if errSign := c.sign(request, body); errSign != nil {
+			return nil, "", errSign
+		}
+	}
+	return request, requestID, nil
+}
+
+// sign adds the whole-body signature with a fresh timestamp and nonce so that
+// the server can reject replayed requests.
+func (c *Client) sign(request *http.Request, body []byte) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("unable to generate nonce: %w", err)
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	nonceHex := hex.EncodeToString(nonce)
+	request.Header.Set(replay.TimestampHeader, timestamp)
+	request.Header.Set(replay.NonceHeader, nonceHex)
+	request.Header.Set(replay.HashHeader, replay.Sign(c.cfg.Key, timestamp, nonceHex, request.URL.Path, body))
+	if c.cfg.KeyID != "" {
+		request.Header.Set("X-Key-ID", c.cfg.KeyID)
+	}
+	return nil
+}
+
+// newRequestID returns a random id that the server logs along with the request.
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(id)
+}
+
+// outboundIP returns the local address of the interface used to reach the
+// server. Dialing UDP only selects a route and sends no packets.
+func outboundIP(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return ""
+	}
+	defer conn.Close()
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return ""
+	}
+	return addr.IP.String()
+}
+
+// hash signs the metric the same way the server checks it.
+func hash(metric *model.Metrics, key string) {
+	data := metric.HashData()
+	if data == nil {
+		return
+	}
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(data)
+	metric.Hash = hex.EncodeToString(h.Sum(nil))
+}
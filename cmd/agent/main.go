@@ -1,177 +1,224 @@
 package main
 
 import (
-	"bytes"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
-	"io"
-	"log"
 	"math/rand"
 	"net/http"
+	"os"
+	"os/signal"
 	"reflect"
 	"runtime"
-	"strings"
+	"syscall"
 	"time"
 
+	"github.com/NikWaltz/metrics-collector/client"
+	"github.com/NikWaltz/metrics-collector/internal/config"
+	"github.com/NikWaltz/metrics-collector/internal/encryption"
+	"github.com/NikWaltz/metrics-collector/internal/logger"
+	"github.com/NikWaltz/metrics-collector/internal/tlsconfig"
 	"github.com/NikWaltz/metrics-collector/model"
 	"github.com/shirou/gopsutil/v3/cpu"
 	"github.com/shirou/gopsutil/v3/mem"
-
-	"github.com/caarlos0/env/v6"
 )
 
-type Config struct {
-	Address        string        `env:"ADDRESS"`
-	PollInterval   time.Duration `env:"POLL_INTERVAL"`
-	ReportInterval time.Duration `env:"REPORT_INTERVAL"`
-	Key            string        `env:"KEY"`
-}
-
-var cfg Config
-
-func init() {
-	const defaultPollInterval = time.Second * 2
-	const defaultReportInterval = time.Second * 10
-	flag.StringVar(&cfg.Address, "a", "127.0.0.1:8080", "Server address for sending metrics")
-	flag.DurationVar(&cfg.PollInterval, "p", defaultPollInterval, "Poll metrics interval")
-	flag.DurationVar(&cfg.ReportInterval, "r", defaultReportInterval, "Sending report interval")
-	flag.StringVar(&cfg.Key, "k", "", "Key for hash")
-}
+var log = logger.For("agent")
 
 func main() {
-	flag.Parse()
-	err := env.Parse(&cfg)
+	loaded, err := config.LoadAgent(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg := *loaded
+	if errLog := logger.Configure(cfg.LogFormat, cfg.LogLevel); errLog != nil {
+		log.Fatal(errLog)
+	}
+
+	clientCfg := client.Config{
+		URL:        fmt.Sprintf("%s://%s", cfg.Scheme(), cfg.Address),
+		Key:        cfg.Key,
+		KeyID:      cfg.KeyID,
+		Gzip:       true,
+		HTTPClient: &http.Client{Timeout: cfg.ReportInterval},
+		Logger:     logger.For("client"),
+	}
+	if cfg.CryptoKey != "" {
+		clientCfg.PublicKey, err = encryption.LoadPublicKey(cfg.CryptoKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if cfg.UseTLS() {
+		tlsConfig, errTLS := tlsconfig.Client(cfg.TLSCA, cfg.TLSCert, cfg.TLSKey)
+		if errTLS != nil {
+			log.Fatal(errTLS)
+		}
+		clientCfg.HTTPClient.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	c, err := client.New(clientCfg)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	log.Println("agent started")
+	log.WithField("address", cfg.Address).Info("agent started")
 	metricsCh := make(chan model.MetricsList)
 	extraMetricsCh := make(chan model.ExtraMetricsList)
 	go scrapingTask(&cfg, metricsCh)
 	go extraScrapingTask(&cfg, extraMetricsCh)
-	go sendMetricsTask(&cfg, metricsCh, extraMetricsCh)
-	select {}
+	go sendMetricsTask(&cfg, c, metricsCh, extraMetricsCh)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	log.Info("agent stopping, flushing metrics")
+	if errClose := c.Close(); errClose != nil {
+		log.WithError(errClose).Error("unable to flush metrics")
+	}
 }
 
-func scrapingTask(cfg *Config, ch chan model.MetricsList) {
+func scrapingTask(cfg *config.Agent, ch chan model.MetricsList) {
 	var metrics model.MetricsList
 	ticker := time.NewTicker(cfg.PollInterval)
 	for range ticker.C {
-		log.Println("scraping metrics")
+		log.Debug("scraping metrics")
 		ch <- scrape(&metrics)
 	}
 }
-func extraScrapingTask(cfg *Config, ch chan model.ExtraMetricsList) {
+func extraScrapingTask(cfg *config.Agent, ch chan model.ExtraMetricsList) {
 	var metrics model.ExtraMetricsList
 	ticker := time.NewTicker(cfg.PollInterval)
 	for range ticker.C {
-		log.Println("scraping metrics")
+		log.Debug("scraping metrics")
 		ch <- extraScrape(&metrics)
 	}
 }
 
-func sendMetricsTask(cfg *Config, ch chan model.MetricsList, ech chan model.ExtraMetricsList) {
-	var endpoint string
+// gcPauseBuckets are GC pause duration bounds in nanoseconds.
+var gcPauseBuckets = []float64{1e4, 5e4, 1e5, 2.5e5, 5e5, 1e6, 2.5e6, 5e6, 1e7, 5e7}
+
+func sendMetricsTask(cfg *config.Agent, c *client.Client, ch chan model.MetricsList, ech chan model.ExtraMetricsList) {
 	ticker := time.NewTicker(cfg.ReportInterval)
 	metrics := <-ch
 	extraMetrics := <-ech
+	// GC pauses are scraped as deltas, so keep everything observed since the last report.
+	gcPause := model.NewHistogram(gcPauseBuckets)
+	mergeGCPause(&gcPause, metrics.GCPause)
+	registered := false
 	for {
 		select {
 		case metrics = <-ch:
-			log.Println("metrics updated")
+			mergeGCPause(&gcPause, metrics.GCPause)
+			log.Debug("metrics updated")
 		case extraMetrics = <-ech:
-			log.Println("metrics updated")
+			log.Debug("metrics updated")
 		case <-ticker.C:
-			var metricsArray []*model.Metrics
-			reflectMetrics := reflect.ValueOf(metrics)
-			metricsArray = prepareMetricsArray(metricsArray, reflectMetrics, cfg.Key)
-			reflectExtraMetrics := reflect.ValueOf(extraMetrics)
-			metricsArray = prepareMetricsArray(metricsArray, reflectExtraMetrics, cfg.Key)
-			endpoint = fmt.Sprintf("http://%s/updates/", cfg.Address)
-			sendMetrics(endpoint, metricsArray)
+			if !registered {
+				registered = register(c)
+			}
+			metrics.GCPause = gcPause
+			gcPause = model.NewHistogram(gcPauseBuckets)
+			record(c, reflect.ValueOf(metrics))
+			record(c, reflect.ValueOf(extraMetrics))
+			go flush(c)
 		}
 	}
 }
 
-func prepareMetricsArray(metricsArray []*model.Metrics, v reflect.Value, hashKey string) []*model.Metrics {
+// record buffers every field of the metrics list in the client under the
+// field name.
+func record(c *client.Client, v reflect.Value) {
 	for i := 0; i < v.NumField(); i++ {
-		var metric model.Metrics
+		name := v.Type().Field(i).Name
 		switch v.Field(i).Kind() {
 		case reflect.Float64:
-			value := v.Field(i).Float()
-			metric = model.Metrics{
-				ID:    v.Type().Field(i).Name,
-				MType: v.Field(i).Type().Name(),
-				Delta: nil,
-				Value: &value,
-			}
+			c.Gauge(name, v.Field(i).Float())
 		case reflect.Int64:
-			value := v.Field(i).Int()
-			metric = model.Metrics{
-				ID:    v.Type().Field(i).Name,
-				MType: v.Field(i).Type().Name(),
-				Delta: &value,
-				Value: nil,
+			c.Counter(name, v.Field(i).Int())
+		case reflect.Struct:
+			value, ok := v.Field(i).Interface().(model.Histogram)
+			if !ok {
+				log.WithField("field", name).Warn("undefined metric type")
+				continue
 			}
+			c.Histogram(name, value)
 		default:
-			log.Println("undefined metric type")
-			continue
+			log.WithField("field", name).Warn("undefined metric type")
 		}
+	}
+}
 
-		if hashKey != "" {
-			hash(&metric, cfg.Key)
+// describe returns the metadata of the fields of a metrics list from their
+// unit and help tags.
+func describe(t reflect.Type) []model.Metadata {
+	var metadata []model.Metadata
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		entry := model.Metadata{ID: field.Name, Unit: field.Tag.Get("unit"), Description: field.Tag.Get("help")}
+		switch {
+		case field.Type.Kind() == reflect.Float64:
+			entry.Type = model.GaugeType
+		case field.Type.Kind() == reflect.Int64:
+			entry.Type = model.CounterType
+		case field.Type == reflect.TypeOf(model.Histogram{}):
+			entry.Type = model.HistogramType
+		default:
+			continue
 		}
-		metricsArray = append(metricsArray, &metric)
+		metadata = append(metadata, entry)
 	}
-	return metricsArray
+	return metadata
 }
 
-func sendMetric(endpoint string, metrics *model.Metrics) *http.Response {
-	body := new(bytes.Buffer)
-	err := json.NewEncoder(body).Encode(metrics)
-	if err != nil {
-		log.Println(err)
-		return nil
+// register describes the metrics of the agent to the server and reports
+// whether it is done. Failures the server may recover from are tried again
+// with the next report; a rejection, like the 404 of an older server, is not.
+func register(c *client.Client) bool {
+	metadata := append(describe(reflect.TypeOf(model.MetricsList{})), describe(reflect.TypeOf(model.ExtraMetricsList{}))...)
+	err := c.Describe(context.Background(), metadata)
+	if err == nil {
+		return true
 	}
-	log.Println(body)
-	response, err := http.Post(endpoint, "application/json", body)
-	if err != nil {
-		log.Println(err)
-	}
-	return response
+	log.WithError(err).Warn("unable to register the metadata of the metrics")
+	var e *client.Error
+	return errors.As(err, &e) && e.Status < http.StatusInternalServerError
 }
 
-func sendMetrics(endpoint string, metrics []*model.Metrics) {
-	body := new(bytes.Buffer)
-	err := json.NewEncoder(body).Encode(metrics)
-	if err != nil {
-		log.Println(err)
-		return
+func flush(c *client.Client) {
+	if err := c.Flush(context.Background()); err != nil {
+		log.WithError(err).Error("unable to send metrics")
 	}
-	log.Println(body)
-	response, err := http.Post(endpoint, "application/json", body)
+}
+
+func mergeGCPause(total *model.Histogram, delta model.Histogram) {
+	err := total.Merge(delta)
 	if err != nil {
-		log.Println(err)
+		log.WithError(err).Warn("unable to merge GC pauses")
 	}
-	if response == nil {
-		log.Println("Response is nil")
-		return
+}
+
+// gcPauses returns a histogram of the pauses that happened after the
+// previous scrape. PauseNs is a circular buffer of the most recent 256 pauses.
+func gcPauses(stats *runtime.MemStats, prevNumGC uint32) model.Histogram {
+	histogram := model.NewHistogram(gcPauseBuckets)
+	first := prevNumGC
+	if stats.NumGC-first > uint32(len(stats.PauseNs)) {
+		first = stats.NumGC - uint32(len(stats.PauseNs))
 	}
-	defer response.Body.Close()
-	_, errDiscard := io.Copy(io.Discard, response.Body)
-	if errDiscard != nil {
-		log.Println(err)
+	for i := first; i < stats.NumGC; i++ {
+		histogram.Observe(float64(stats.PauseNs[i%uint32(len(stats.PauseNs))]))
 	}
+	return histogram
 }
 
 func scrape(metrics *model.MetricsList) model.MetricsList {
 	var stats runtime.MemStats
 	runtime.ReadMemStats(&stats)
+	metrics.GCPause = gcPauses(&stats, uint32(metrics.NumGC))
 	metrics.Alloc = model.Gauge(stats.Alloc)
 	metrics.BuckHashSys = model.Gauge(stats.BuckHashSys)
 	metrics.Frees = model.Gauge(stats.Frees)
@@ -212,18 +259,3 @@ func extraScrape(metrics *model.ExtraMetricsList) model.ExtraMetricsList {
 	metrics.CPUutilization1 = model.Gauge(s[0])
 	return *metrics
 }
-
-func hash(metric *model.Metrics, key string) {
-	var data []byte
-	switch strings.ToLower(metric.MType) {
-	case model.GaugeType:
-		data = []byte(fmt.Sprintf("%s:gauge:%f", metric.ID, *metric.Value))
-	case model.CounterType:
-		data = []byte(fmt.Sprintf("%s:counter:%d", metric.ID, *metric.Delta))
-	default:
-		return
-	}
-	h := hmac.New(sha256.New, []byte(key))
-	h.Write(data)
-	metric.Hash = hex.EncodeToString(h.Sum(nil))
-}
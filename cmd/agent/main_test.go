@@ -1,68 +1,83 @@
 package main
 
 import (
-	"github.com/NikWaltz/metrics-collector/model"
-	"io"
-	"log"
+	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"reflect"
+	"runtime"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/NikWaltz/metrics-collector/client"
+	"github.com/NikWaltz/metrics-collector/model"
 )
 
-func Test_sendMetric(t *testing.T) {
-	value := 54.23
-	type args struct {
-		endpoint   string
-		metrics    model.Metrics
-		wantStatus int
+func Test_gcPauses(t *testing.T) {
+	var stats runtime.MemStats
+	stats.NumGC = 300
+	for i := range stats.PauseNs {
+		stats.PauseNs[i] = 2e4
 	}
+	stats.PauseNs[299%256] = 3e6
+
 	tests := []struct {
-		name string
-		args args
+		name      string
+		prevNumGC uint32
+		wantCount int64
+		wantSum   float64
 	}{
-		{
-			name: "Send gauge metric",
-			args: args{
-				endpoint: "/update/",
-				metrics: model.Metrics{
-					ID:    "Alloc",
-					MType: "Gauge",
-					Delta: nil,
-					Value: &value,
-				},
-				wantStatus: 200,
-			},
-		},
-		{
-			name: "Send bad counter metric",
-			args: args{
-				endpoint: "/update/",
-				metrics: model.Metrics{
-					ID:    "Alloc",
-					MType: "Counter",
-					Delta: nil,
-					Value: &value,
-				},
-				wantStatus: 400,
-			},
-		},
+		{name: "No new pauses", prevNumGC: 300, wantCount: 0, wantSum: 0},
+		{name: "Two new pauses", prevNumGC: 298, wantCount: 2, wantSum: 3.02e6},
+		{name: "Buffer overrun", prevNumGC: 0, wantCount: 256, wantSum: 255*2e4 + 3e6},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
-				assert.Equal(t, req.URL.String(), tt.args.endpoint)
-				rw.WriteHeader(tt.args.wantStatus)
-			}))
-			defer server.Close()
-			response := sendMetric(server.URL+tt.args.endpoint, &tt.args.metrics)
-			defer response.Body.Close()
-			_, err := io.Copy(io.Discard, response.Body)
-			if err != nil {
-				log.Println(err)
-			}
-			assert.Equal(t, response.StatusCode, tt.args.wantStatus)
+			got := gcPauses(&stats, tt.prevNumGC)
+			assert.Equal(t, tt.wantCount, got.Count)
+			assert.Equal(t, tt.wantSum, got.Sum)
+			assert.NoError(t, got.Validate())
 		})
 	}
 }
+
+func Test_record(t *testing.T) {
+	var got []model.Metrics
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		assert.NoError(t, json.NewDecoder(req.Body).Decode(&got))
+	}))
+	defer server.Close()
+	c, err := client.New(client.Config{URL: server.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := model.MetricsList{PollCount: 3, Alloc: 1.5, GCPause: model.NewHistogram(gcPauseBuckets)}
+	metrics.GCPause.Observe(2e4)
+	record(c, reflect.ValueOf(metrics))
+	assert.NoError(t, c.Close())
+
+	byID := make(map[string]model.Metrics)
+	for _, metric := range got {
+		byID[metric.ID] = metric
+	}
+	assert.Equal(t, 1.5, *byID["Alloc"].Value)
+	assert.Equal(t, int64(3), *byID["PollCount"].Delta)
+	assert.Equal(t, model.HistogramType, byID["GCPause"].MType)
+	assert.Equal(t, int64(1), byID["GCPause"].Histogram.Count)
+}
+
+func Test_describe(t *testing.T) {
+	metadata := describe(reflect.TypeOf(model.MetricsList{}))
+	assert.Len(t, metadata, reflect.TypeOf(model.MetricsList{}).NumField())
+	byID := make(map[string]model.Metadata)
+	for _, entry := range metadata {
+		byID[entry.ID] = entry
+	}
+	assert.Equal(t, model.Metadata{ID: "HeapAlloc", Type: model.GaugeType, Unit: "bytes",
+		Description: "Bytes of allocated heap objects."}, byID["HeapAlloc"])
+	assert.Equal(t, model.CounterType, byID["PollCount"].Type)
+	assert.Equal(t, model.HistogramType, byID["GCPause"].Type)
+	assert.Equal(t, "percent", describe(reflect.TypeOf(model.ExtraMetricsList{}))[2].Unit)
+}
@@ -0,0 +1,330 @@
+// Command metricsctl reads and pushes metrics over the HTTP API of the
+// server.
+//
+//	metricsctl [flags] get <type> <name>
+//	metricsctl [flags] set <name> <value>
+//	metricsctl [flags] inc <name> [delta]
+//	metricsctl [flags] list [-type type]
+//	metricsctl [flags] watch [-i interval] [name ...]
+//	metricsctl [flags] export
+//	metricsctl [flags] import [-f file] [-format ndjson|csv|json] [-mode replace|add]
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/NikWaltz/metrics-collector/client"
+	"github.com/NikWaltz/metrics-collector/internal/dump"
+	"github.com/NikWaltz/metrics-collector/internal/logger"
+	"github.com/NikWaltz/metrics-collector/internal/tlsconfig"
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+const usage = `usage: metricsctl [flags] <command> [args]
+
+commands:
+  get <type> <name>            print a metric
+  set <name> <value>           set a gauge
+  inc <name> [delta]           add to a counter, 1 by default
+  list [-type type]            print all metrics
+  watch [-i interval] [name]   print metrics every interval
+  export                       print the whole store as NDJSON or CSV (-o csv)
+  import [-f file] [-format] [-mode replace|add]
+                               load an export into the store
+
+flags:
+`
+
+type options struct {
+	address string
+	key     string
+	keyID   string
+	gzip    bool
+	tls     bool
+	tlsCA   string
+	output  string
+	timeout time.Duration
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	var opts options
+	fs := flag.NewFlagSet("metricsctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	fs.StringVar(&opts.address, "a", envOr("ADDRESS", "127.0.0.1:8080"), "Server address")
+	fs.StringVar(&opts.key, "k", os.Getenv("KEY"), "Key for hash")
+	fs.StringVar(&opts.keyID, "kid", os.Getenv("KEY_ID"), "Key id in the server keyring")
+	fs.BoolVar(&opts.gzip, "gzip", true, "Compress pushed metrics")
+	fs.BoolVar(&opts.tls, "tls", false, "Use HTTPS")
+	fs.StringVar(&opts.tlsCA, "tls-ca", "", "CA bundle for verifying the server certificate")
+	fs.StringVar(&opts.output, "o", "", "Output format: table, json or csv; ndjson or csv for export")
+	fs.DurationVar(&opts.timeout, "timeout", 10*time.Second, "Request timeout")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+	// Logs of the client would mix with the output.
+	if err := logger.Configure(logger.FormatText, "error"); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	c, err := newClient(opts)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	cmd, cmdArgs := fs.Arg(0), fs.Args()[1:]
+	switch cmd {
+	case "get":
+		err = get(ctx, c, opts, cmdArgs, stdout)
+	case "set":
+		err = set(ctx, c, cmdArgs)
+	case "inc":
+		err = inc(ctx, c, cmdArgs)
+	case "list":
+		err = list(ctx, c, opts, cmdArgs, stdout)
+	case "watch":
+		err = watch(ctx, c, opts, cmdArgs, stdout)
+	case "export":
+		err = export(ctx, c, opts, stdout)
+	case "import":
+		err = importMetrics(ctx, c, cmdArgs, stdin, stdout)
+	default:
+		fmt.Fprintf(stderr, "unknown command %q\n", cmd)
+		fs.Usage()
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func envOr(name string, fallback string) string {
+	if value, ok := os.LookupEnv(name); ok {
+		return value
+	}
+	return fallback
+}
+
+func newClient(opts options) (*client.Client, error) {
+	scheme := "http"
+	httpClient := &http.Client{Timeout: opts.timeout}
+	if opts.tls || opts.tlsCA != "" {
+		scheme = "https"
+		tlsConfig, err := tlsconfig.Client(opts.tlsCA, "", "")
+		if err != nil {
+			return nil, err
+		}
+		httpClient.Transport = &http.Transport{TLSClientConfig: tlsConfig}
+	}
+	return client.New(client.Config{
+		URL:        fmt.Sprintf("%s://%s", scheme, opts.address),
+		Key:        opts.key,
+		KeyID:      opts.keyID,
+		Gzip:       opts.gzip,
+		HTTPClient: httpClient,
+		Retries:    []time.Duration{},
+	})
+}
+
+func get(ctx context.Context, c *client.Client, opts options, args []string, out io.Writer) error {
+	if len(args) != 2 {
+		return errors.New("usage: get <type> <name>")
+	}
+	metric, err := c.Get(ctx, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	return writeMetrics(out, opts.output, []model.Metrics{metric})
+}
+
+func set(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: set <name> <value>")
+	}
+	value, err := strconv.ParseFloat(args[1], 64)
+	if err != nil {
+		return fmt.Errorf("invalid value: %w", err)
+	}
+	return c.Send(ctx, []model.Metrics{{ID: args[0], MType: model.GaugeType, Value: &value}})
+}
+
+func inc(ctx context.Context, c *client.Client, args []string) error {
+	if len(args) != 1 && len(args) != 2 {
+		return errors.New("usage: inc <name> [delta]")
+	}
+	delta := int64(1)
+	if len(args) == 2 {
+		var err error
+		delta, err = strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid delta: %w", err)
+		}
+	}
+	return c.Send(ctx, []model.Metrics{{ID: args[0], MType: model.CounterType, Delta: &delta}})
+}
+
+func list(ctx context.Context, c *client.Client, opts options, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	metricType := fs.String("type", "", "Only metrics of this type")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	metrics, err := c.List(ctx)
+	if err != nil {
+		return err
+	}
+	if *metricType != "" {
+		metrics = filter(metrics, func(metric model.Metrics) bool {
+			return strings.EqualFold(metric.MType, *metricType)
+		})
+	}
+	return writeMetrics(out, opts.output, metrics)
+}
+
+// watch prints the metrics every interval until it is interrupted.
+func watch(ctx context.Context, c *client.Client, opts options, args []string, out io.Writer) error {
+	fs := flag.NewFlagSet("watch", flag.ContinueOnError)
+	interval := fs.Duration("i", 2*time.Second, "Refresh interval")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for _, name := range fs.Args() {
+		names[name] = true
+	}
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		metrics, err := c.List(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(names) > 0 {
+			metrics = filter(metrics, func(metric model.Metrics) bool { return names[metric.ID] })
+		}
+		if opts.output == "" || opts.output == formatTable {
+			fmt.Fprintf(out, "%s\n", time.Now().Format(time.RFC3339))
+		}
+		if errWrite := writeMetrics(out, opts.output, metrics); errWrite != nil {
+			return errWrite
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func export(ctx context.Context, c *client.Client, opts options, out io.Writer) error {
+	format := opts.output
+	if format == "" {
+		format = dump.FormatNDJSON
+	}
+	return c.Export(ctx, format, out)
+}
+
+// importMetrics loads an export into the store. JSON arrays, like the
+// output of list -o json, are converted to NDJSON first.
+func importMetrics(ctx context.Context, c *client.Client, args []string, in io.Reader, out io.Writer) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fileName := fs.String("f", "-", "File to import, - for stdin")
+	format := fs.String("format", "", "Input format: ndjson, csv or json, by the file extension or ndjson by default")
+	mode := fs.String("mode", client.ImportReplace, "Counters and histograms replace the stored ones or add to them: replace or add")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *fileName != "-" {
+		file, err := os.Open(*fileName)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+		if *format == "" {
+			*format = formatOfFile(*fileName)
+		}
+	}
+	if *format == "" {
+		*format = dump.FormatNDJSON
+	}
+	body, err := io.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	if *format == formatJSON {
+		metrics, errRead := readMetrics(bytes.NewReader(body), formatJSON)
+		if errRead != nil {
+			return errRead
+		}
+		var buf bytes.Buffer
+		if errWrite := dump.Write(&buf, dump.FormatNDJSON, metrics); errWrite != nil {
+			return errWrite
+		}
+		body, *format = buf.Bytes(), dump.FormatNDJSON
+	}
+	if *format != dump.FormatNDJSON && *format != dump.FormatCSV {
+		return fmt.Errorf("unknown input format %q", *format)
+	}
+	imported, err := c.Import(ctx, *format, body, *mode)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "imported %d metrics (%s)\n", imported, *mode)
+	return nil
+}
+
+func formatOfFile(fileName string) string {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".csv":
+		return dump.FormatCSV
+	case ".json":
+		return formatJSON
+	}
+	return dump.FormatNDJSON
+}
+
+func filter(metrics []model.Metrics, keep func(model.Metrics) bool) []model.Metrics {
+	var kept []model.Metrics
+	for _, metric := range metrics {
+		if keep(metric) {
+			kept = append(kept, metric)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+func testMetrics() []model.Metrics {
+	value := 12.5
+	delta := int64(5)
+	histogram := model.Histogram{Bounds: []float64{1}, Counts: []int64{1, 1}, Count: 2, Sum: 3.5}
+	return []model.Metrics{
+		{ID: "Alloc", MType: model.GaugeType, Value: &value},
+		{ID: "Requests", MType: model.CounterType, Delta: &delta},
+		{ID: "Latency", MType: model.HistogramType, Histogram: &histogram},
+	}
+}
+
+func Test_writeMetrics(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		want   string
+	}{
+		{
+			name:   "Table",
+			format: formatTable,
+			want: "ID        TYPE       VALUE\n" +
+				"Alloc     gauge      12.5\n" +
+				"Requests  counter    5\n" +
+				"Latency   histogram  count=2 sum=3.5\n",
+		},
+		{
+			name:   "CSV",
+			format: formatCSV,
+			want: "id,type,value\n" +
+				"Alloc,gauge,12.5\n" +
+				"Requests,counter,5\n" +
+				"Latency,histogram,\"{\"\"bounds\"\":[1],\"\"counts\"\":[1,1],\"\"count\"\":2,\"\"sum\"\":3.5}\"\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			assert.NoError(t, writeMetrics(&out, tt.format, testMetrics()))
+			assert.Equal(t, tt.want, out.String())
+		})
+	}
+}
+
+func Test_readMetrics(t *testing.T) {
+	for _, format := range []string{formatJSON, formatCSV} {
+		t.Run(format, func(t *testing.T) {
+			var out bytes.Buffer
+			assert.NoError(t, writeMetrics(&out, format, testMetrics()))
+			got, err := readMetrics(&out, format)
+			assert.NoError(t, err)
+			assert.Equal(t, testMetrics(), got)
+		})
+	}
+
+	_, err := readMetrics(strings.NewReader("Alloc,summary,1\n"), formatCSV)
+	assert.Error(t, err)
+}
+
+func Test_run(t *testing.T) {
+	var pushed []model.Metrics
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/export":
+			for _, m := range testMetrics() {
+				_ = json.NewEncoder(w).Encode(m)
+			}
+		case "/value/":
+			var metric model.Metrics
+			_ = json.NewDecoder(r.Body).Decode(&metric)
+			for _, m := range testMetrics() {
+				if m.ID == metric.ID {
+					_ = json.NewEncoder(w).Encode(m)
+					return
+				}
+			}
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"code":"not_found","message":"metric not exist","id":"` + metric.ID + `"}`))
+		case "/updates/":
+			_ = json.NewDecoder(r.Body).Decode(&pushed)
+		}
+	}))
+	defer server.Close()
+	address := strings.TrimPrefix(server.URL, "http://")
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		wantOut    string
+		wantErr    string
+		wantPushed []model.Metrics
+	}{
+		{
+			name:    "Get",
+			args:    []string{"get", "gauge", "Alloc"},
+			wantOut: "ID     TYPE   VALUE\nAlloc  gauge  12.5\n",
+		},
+		{
+			name:     "Get missing metric",
+			args:     []string{"get", "gauge", "Nope"},
+			wantCode: 1,
+			wantErr:  "404 not_found: Nope: metric not exist\n",
+		},
+		{
+			name:    "List counters as CSV",
+			args:    []string{"-o", "csv", "list", "-type", "counter"},
+			wantOut: "id,type,value\nRequests,counter,5\n",
+		},
+		{
+			name:       "Inc",
+			args:       []string{"-gzip=false", "inc", "Requests"},
+			wantPushed: []model.Metrics{{ID: "Requests", MType: model.CounterType, Delta: new(int64)}},
+		},
+		{
+			name:     "Unknown command",
+			args:     []string{"remove"},
+			wantCode: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pushed = nil
+			var stdout, stderr bytes.Buffer
+			code := run(context.Background(), append([]string{"-a", address}, tt.args...), strings.NewReader(""), &stdout, &stderr)
+			assert.Equal(t, tt.wantCode, code)
+			if tt.wantOut != "" {
+				assert.Equal(t, tt.wantOut, stdout.String())
+			}
+			if tt.wantErr != "" {
+				assert.Equal(t, tt.wantErr, stderr.String())
+			}
+			if tt.wantPushed != nil {
+				*tt.wantPushed[0].Delta = 1
+				assert.Equal(t, tt.wantPushed, pushed)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/NikWaltz/metrics-collector/internal/dump"
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+	formatCSV   = "csv"
+)
+
+// writeMetrics prints the metrics as a table, a JSON array or CSV in the
+// format of the bulk export.
+func writeMetrics(w io.Writer, format string, metrics []model.Metrics) error {
+	for i := range metrics {
+		metrics[i].Hash, metrics[i].KeyID = "", ""
+	}
+	switch format {
+	case "", formatTable:
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tTYPE\tVALUE")
+		for _, metric := range metrics {
+			fmt.Fprintf(tw, "%s\t%s\t%s\n", metric.ID, metric.MType, tableValue(metric))
+		}
+		return tw.Flush()
+	case formatJSON:
+		if metrics == nil {
+			metrics = []model.Metrics{}
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(metrics)
+	case formatCSV:
+		return dump.Write(w, dump.FormatCSV, metrics)
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+func tableValue(metric model.Metrics) string {
+	switch {
+	case metric.Value != nil:
+		return strconv.FormatFloat(*metric.Value, 'g', -1, 64)
+	case metric.Delta != nil:
+		return strconv.FormatInt(*metric.Delta, 10)
+	case metric.Histogram != nil:
+		return fmt.Sprintf("count=%d sum=%s", metric.Histogram.Count, strconv.FormatFloat(metric.Histogram.Sum, 'g', -1, 64))
+	}
+	return ""
+}
+
+// readMetrics parses a JSON array as written by writeMetrics or an export
+// in NDJSON or CSV.
+func readMetrics(r io.Reader, format string) ([]model.Metrics, error) {
+	switch format {
+	case "", formatJSON:
+		var metrics []model.Metrics
+		if err := json.NewDecoder(r).Decode(&metrics); err != nil {
+			return nil, fmt.Errorf("invalid json: %w", err)
+		}
+		return metrics, nil
+	case dump.FormatNDJSON, dump.FormatCSV:
+		return dump.Read(r, format)
+	default:
+		return nil, fmt.Errorf("unknown input format %q", format)
+	}
+}
@@ -1,61 +1,281 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
-	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/caarlos0/env/v6"
-
+	"github.com/NikWaltz/metrics-collector/internal/alert"
 	"github.com/NikWaltz/metrics-collector/internal/api"
+	"github.com/NikWaltz/metrics-collector/internal/config"
+	"github.com/NikWaltz/metrics-collector/internal/encryption"
+	"github.com/NikWaltz/metrics-collector/internal/health"
+	"github.com/NikWaltz/metrics-collector/internal/keyring"
+	"github.com/NikWaltz/metrics-collector/internal/logger"
+	"github.com/NikWaltz/metrics-collector/internal/replay"
+	"github.com/NikWaltz/metrics-collector/internal/selfmetrics"
 	"github.com/NikWaltz/metrics-collector/internal/service"
+	"github.com/NikWaltz/metrics-collector/internal/statsd"
+	"github.com/NikWaltz/metrics-collector/internal/tlsconfig"
 	"github.com/NikWaltz/metrics-collector/model"
 )
 
-type Config struct {
-	Address       string        `env:"ADDRESS"`
-	StoreInterval time.Duration `env:"STORE_INTERVAL"`
-	StoreFile     string        `env:"STORE_FILE"`
-	Restore       bool          `env:"RESTORE"`
-	DatabaseDsn   string        `env:"DATABASE_DSN"`
-	Key           string        `env:"KEY"`
-}
+// shutdownTimeout bounds the wait for running requests on a stop.
+const shutdownTimeout = 10 * time.Second
 
-var cfg Config
+var (
+	cfg *config.Server
+	log = logger.For("server")
+)
 
 func init() {
-	const defaultDuration = time.Second * 300
-	flag.StringVar(&cfg.Address, "a", "127.0.0.1:8080", "Server address")
-	flag.DurationVar(&cfg.StoreInterval, "i", defaultDuration, "Store to file interval")
-	flag.StringVar(&cfg.StoreFile, "f", "/tmp/devops-metrics-db.json", "Store file path")
-	flag.BoolVar(&cfg.Restore, "r", true, "Restore storage from file")
-	flag.StringVar(&cfg.DatabaseDsn, "d", "", "Data source name")
-	flag.StringVar(&cfg.Key, "k", "", "Key for hash")
-	flag.Parse()
-	err := env.Parse(&cfg)
+	var err error
+	cfg, err = config.LoadServer(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
+	if errLog := logger.Configure(cfg.LogFormat, cfg.LogLevel); errLog != nil {
+		log.Fatal(errLog)
+	}
 }
 
 func main() {
-	log.Println("server started")
+	if cfg.Migrate != "" {
+		version, dirty, err := service.Migrate(cfg.DatabaseDsn, cfg.Migrate)
+		if err != nil {
+			log.WithError(err).Fatal("migration failed")
+		}
+		log.WithField("version", version).WithField("dirty", dirty).Info("database schema")
+		return
+	}
+
+	log.WithField("address", cfg.Address).Info("server started")
+
+	if len(cfg.Buckets) > 0 {
+		model.DefaultBuckets = cfg.Buckets
+	}
 
 	myRepo := model.NewStorage()
 	var myService api.Collector
+	setStoreInterval := func(time.Duration) {}
+	var listen func(context.Context, func(service.Change)) error
+
+	readinessChecks := make(map[string]health.CheckFunc)
+	conflicts, errConflicts := service.ParseConflictPolicy(cfg.TypeConflicts)
+	if errConflicts != nil {
+		log.Fatal(errConflicts)
+	}
 
 	if cfg.DatabaseDsn != "" {
-		myService = service.NewDBService(myRepo, cfg.DatabaseDsn)
+		myDBService := service.NewDBService(cfg.DatabaseDsn)
+		myDBService.SetNotify(cfg.DBNotify)
+		myDBService.SetConflictPolicy(conflicts)
+		if cfg.DBNotify {
+			listen = myDBService.Listen
+		}
+		if cfg.SeedFile != "" {
+			seeded, errSeed := myDBService.Seed(context.Background(), cfg.SeedFile)
+			if errSeed != nil {
+				log.WithError(errSeed).WithField("file", cfg.SeedFile).Fatal("unable to seed database")
+			}
+			if !seeded {
+				log.WithField("file", cfg.SeedFile).Info("database is already seeded, skipping the seed file")
+			}
+		}
+		readinessChecks["migrations"] = myDBService.MigrationCheck
+		readinessChecks["replication"] = myDBService.ReplicationCheck
+		myService = myDBService
+		if cfg.WriteBehind > 0 {
+			writeBehind := api.WriteBehind(myDBService, cfg.WriteBehind, cfg.WriteBatch, cfg.WriteBuffer)
+			writeBehind.SetConflictPolicy(conflicts)
+			myService = writeBehind
+		}
 	} else {
-		myService = service.NewService(myRepo)
-		myFileService := service.NewFileService(myRepo, cfg.StoreFile, cfg.StoreInterval, cfg.Restore)
+		myMemService := service.NewService(myRepo)
+		myMemService.SetConflictPolicy(conflicts)
+		myService = myMemService
+		myFileService := service.NewFileService(myMemService, cfg.StoreFile, cfg.StoreInterval, cfg.Restore)
 		go myFileService.Run()
+		setStoreInterval = myFileService.SetStoreInterval
+		readinessChecks["snapshot"] = myFileService.SnapshotCheck
 	}
 	defer myService.Close()
 
+	myService = api.Instrument(myService)
+	if cfg.CacheTTL > 0 {
+		myCache := api.Cache(myService, cfg.CacheTTL, cfg.CacheSize)
+		if listen != nil {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			go func() {
+				err := listen(ctx, func(change service.Change) {
+					myCache.Invalidate(change.Type, change.ID)
+				})
+				if err != nil {
+					log.WithError(err).Error("unable to listen for changes of other servers")
+				}
+			}()
+		}
+		myService = myCache
+	}
+	if cfg.AlertRules != "" {
+		myEngine, errRules := alert.Load(cfg.AlertRules)
+		if errRules != nil {
+			log.Fatal(errRules)
+		}
+		done := make(chan struct{})
+		defer close(done)
+		go myEngine.Run(cfg.AlertInterval, done)
+		myService = api.Alerting(myService, myEngine)
+	}
+
+	if cfg.SelfMetrics > 0 {
+		// Through all the decorators, so that the self metrics reach the
+		// cache and the alert rules like any other update.
+		done := make(chan struct{})
+		defer close(done)
+		go selfmetrics.Run(myService, cfg.SelfMetrics, done)
+	}
+
+	if cfg.StatsdAddress != "" {
+		myStatsd := statsd.NewListener(myService, cfg.StatsdAddress, cfg.StatsdFlush)
+		defer myStatsd.Close()
+		go func() {
+			err := myStatsd.Run()
+			if err != nil {
+				log.WithError(err).Error("statsd listener stopped")
+			}
+		}()
+	}
+
+	var myGuard *replay.Guard
+	if cfg.ReplayWindow > 0 {
+		myGuard = replay.NewGuard(cfg.ReplayWindow)
+	}
+	mySettings, errSettings := buildSettings(cfg, myGuard)
+	if errSettings != nil {
+		log.Fatal(errSettings)
+	}
 	myAPI := api.New(myService, cfg.Key)
+	myAPI.Reload(mySettings)
+	for name, check := range readinessChecks {
+		myAPI.AddReadinessCheck(name, check)
+	}
+	if cfg.CryptoKey != "" {
+		myPrivateKey, errKey := encryption.LoadPrivateKey(cfg.CryptoKey)
+		if errKey != nil {
+			log.Fatal(errKey)
+		}
+		myAPI.SetPrivateKey(myPrivateKey)
+	}
+	if cfg.TLSCert != "" || cfg.TLSKey != "" {
+		myTLSConfig, errTLS := tlsconfig.Server(cfg.TLSCert, cfg.TLSKey, cfg.TLSClientCA)
+		if errTLS != nil {
+			log.Fatal(errTLS)
+		}
+		myAPI.SetTLSConfig(myTLSConfig)
+	}
+
+	// Stopping returns from main, so that the deferred closes flush what
+	// the storage buffers.
+	stops := make(chan os.Signal, 1)
+	signal.Notify(stops, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-stops
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if errShutdown := myAPI.Shutdown(ctx); errShutdown != nil {
+			log.WithError(errShutdown).Error("unable to finish the running requests")
+		}
+	}()
+
+	reloads := make(chan struct{}, 1)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			reloads <- struct{}{}
+		}
+	}()
+	if cfg.ConfigWatch > 0 && cfg.ConfigFile != "" {
+		done := make(chan struct{})
+		defer close(done)
+		go config.WatchFile(cfg.ConfigFile, cfg.ConfigWatch, done, func() {
+			reloads <- struct{}{}
+		})
+	}
+	go func() {
+		started := *cfg
+		for range reloads {
+			next, errReload := reload(&started, myAPI.Reload, myGuard)
+			if errReload != nil {
+				log.WithError(errReload).Error("config reload failed, keeping the current config")
+				continue
+			}
+			setStoreInterval(next.StoreInterval)
+			log.Info("config reloaded")
+		}
+	}()
+
 	err := myAPI.Run(cfg.Address)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Fatal(err)
+	}
+	log.Info("server stopped")
+}
+
+// buildSettings loads the settings of the api that can be changed without a
+// restart.
+func buildSettings(cfg *config.Server, guard *replay.Guard) (api.Settings, error) {
+	settings := api.Settings{
+		Key:               cfg.Key,
+		ReplayGuard:       guard,
+		RequireSignedBody: cfg.RequireSigned,
+	}
+	if cfg.KeyringFile != "" {
+		myKeyring, err := keyring.Load(cfg.KeyringFile)
+		if err != nil {
+			return api.Settings{}, err
+		}
+		settings.Keyring = myKeyring
+	}
+	subnets, err := config.ParseSubnets(cfg.TrustedSubnet)
+	if err != nil {
+		return api.Settings{}, err
+	}
+	settings.TrustedSubnets = subnets
+	return settings, nil
+}
+
+// reload reads the config again and applies the settings that can change
+// while the server is running. Changes of other settings since the start are
+// logged and wait for a restart.
+func reload(started *config.Server, apply func(api.Settings), guard *replay.Guard) (*config.Server, error) {
+	next, err := config.LoadServer(os.Args[1:])
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
+	}
+	settings, err := buildSettings(next, guard)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range started.RestartRequired(next) {
+		log.WithField("setting", name).Warn("setting changed, restart the server to apply it")
+	}
+	if err := logger.Configure(next.LogFormat, next.LogLevel); err != nil {
+		return nil, err
+	}
+	if guard != nil && next.ReplayWindow > 0 {
+		guard.SetWindow(next.ReplayWindow)
 	}
+	apply(settings)
+	return next, nil
 }
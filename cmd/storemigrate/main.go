@@ -0,0 +1,96 @@
+// Command storemigrate moves metrics between a store file of the server and
+// a Postgres database.
+//
+//	storemigrate [flags] seed   import the store file into the database once
+//	storemigrate [flags] dump   write the database as a store file
+//
+// A database is seeded at most once, like with the -seed flag of the server,
+// so running seed again does not add the counters twice.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/NikWaltz/metrics-collector/internal/logger"
+	"github.com/NikWaltz/metrics-collector/internal/service"
+)
+
+const usage = `usage: storemigrate [flags] <seed|dump>
+
+commands:
+  seed   import the store file into the database, once per database
+  dump   write all metrics of the database as a store file
+
+flags:
+`
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stdout, os.Stderr))
+}
+
+func run(ctx context.Context, args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("storemigrate", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprint(stderr, usage)
+		fs.PrintDefaults()
+	}
+	dsn := fs.String("d", os.Getenv("DATABASE_DSN"), "Data source name")
+	fileName := fs.String("f", os.Getenv("STORE_FILE"), "Store file path")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if fs.NArg() != 1 || *dsn == "" || *fileName == "" {
+		fs.Usage()
+		return 2
+	}
+	cmd := fs.Arg(0)
+	if cmd != "seed" && cmd != "dump" {
+		fmt.Fprintf(stderr, "unknown command %q\n", cmd)
+		fs.Usage()
+		return 2
+	}
+	if err := logger.Configure(logger.FormatText, "error"); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+
+	db := service.NewDBService(*dsn)
+	defer db.Close()
+	if err := db.Ping(ctx); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	switch cmd {
+	case "seed":
+		seeded, err := db.Seed(ctx, *fileName)
+		if err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		if !seeded {
+			fmt.Fprintln(stdout, "database is already seeded, nothing to do")
+			return 0
+		}
+		fmt.Fprintf(stdout, "seeded the database from %s\n", *fileName)
+	case "dump":
+		if err := db.Dump(ctx, *fileName); err != nil {
+			fmt.Fprintln(stderr, err)
+			return 1
+		}
+		fmt.Fprintf(stdout, "dumped the database to %s\n", *fileName)
+	}
+	return 0
+}
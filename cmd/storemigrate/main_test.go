@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_run_usage(t *testing.T) {
+	tests := []struct {
+		name       string
+		args       []string
+		wantCode   int
+		wantStderr string
+	}{
+		{name: "No command", args: []string{"-d", "postgres://localhost/metrics", "-f", "metrics.json"}, wantCode: 2, wantStderr: "usage:"},
+		{name: "No database", args: []string{"-d", "", "-f", "metrics.json", "seed"}, wantCode: 2, wantStderr: "usage:"},
+		{name: "No file", args: []string{"-d", "postgres://localhost/metrics", "-f", "", "dump"}, wantCode: 2, wantStderr: "usage:"},
+		{name: "Unknown command", args: []string{"-d", "postgres://localhost/metrics", "-f", "metrics.json", "copy"}, wantCode: 2, wantStderr: `unknown command "copy"`},
+		{name: "Help", args: []string{"-h"}, wantCode: 0, wantStderr: "usage:"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := run(context.Background(), tt.args, &stdout, &stderr)
+			assert.Equal(t, tt.wantCode, code)
+			assert.Contains(t, stderr.String(), tt.wantStderr)
+		})
+	}
+}
@@ -0,0 +1,350 @@
+// Package alert evaluates alerting rules against the incoming metric
+// updates and sends the alerts that start and stop firing to sinks.
+//
+// A rule watches one gauge or counter. A threshold rule fires when the value
+// is above or below its threshold; with a for-duration the condition first
+// has to hold for that long, during which the alert is pending. An absence
+// rule fires when the metric got no update for its duration. A firing alert
+// is resolved once its condition no longer holds.
+//
+// Every server evaluates the updates it receives itself, so with several
+// servers behind a load balancer each should get the rules of the metrics it
+// is sent.
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/NikWaltz/metrics-collector/internal/logger"
+	"github.com/NikWaltz/metrics-collector/internal/selfmetrics"
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+var log = logger.For("alert")
+
+// queueSize is the number of alerts waiting for the sinks; further alerts
+// are dropped.
+const queueSize = 100
+
+type State string
+
+const (
+	StateInactive State = "inactive"
+	StatePending  State = "pending"
+	StateFiring   State = "firing"
+	StateResolved State = "resolved"
+)
+
+// Rule is an alerting rule on a gauge or counter; histograms are not
+// evaluated. Exactly one of Above, Below and Absent has to be set.
+type Rule struct {
+	Name   string `yaml:"name"`
+	Metric string `yaml:"metric"`
+	// Type restricts the rule to one type of the metric.
+	Type        string        `yaml:"type"`
+	Above       *float64      `yaml:"above"`
+	Below       *float64      `yaml:"below"`
+	For         time.Duration `yaml:"for"`
+	Absent      time.Duration `yaml:"absent"`
+	Description string        `yaml:"description"`
+}
+
+func (r Rule) validate() error {
+	if r.Name == "" {
+		return fmt.Errorf("rule of %q has no name", r.Metric)
+	}
+	if r.Metric == "" {
+		return fmt.Errorf("rule %q has no metric", r.Name)
+	}
+	switch r.Type {
+	case "", model.GaugeType, model.CounterType:
+	default:
+		return fmt.Errorf("rule %q: type must be gauge or counter", r.Name)
+	}
+	conditions := 0
+	for _, set := range []bool{r.Above != nil, r.Below != nil, r.Absent != 0} {
+		if set {
+			conditions++
+		}
+	}
+	if conditions != 1 {
+		return fmt.Errorf("rule %q needs exactly one of above, below and absent", r.Name)
+	}
+	if r.For < 0 || r.Absent < 0 {
+		return fmt.Errorf("rule %q: durations must not be negative", r.Name)
+	}
+	if r.For != 0 && r.Absent != 0 {
+		return fmt.Errorf("rule %q: for applies to thresholds only", r.Name)
+	}
+	return nil
+}
+
+// matches reports whether the value meets the threshold of the rule.
+func (r Rule) matches(value float64) bool {
+	if r.Above != nil {
+		return value > *r.Above
+	}
+	return value < *r.Below
+}
+
+// Alert is a change of the state of a rule as sent to the sinks.
+type Alert struct {
+	Rule        string `json:"rule"`
+	Metric      string `json:"metric"`
+	State       State  `json:"state"`
+	Description string `json:"description,omitempty"`
+	// Value is the last value of the metric, if it had any.
+	Value *float64 `json:"value,omitempty"`
+	// Since is when the condition started to hold; for absence rules, when
+	// the metric was last updated.
+	Since time.Time `json:"since"`
+	At    time.Time `json:"at"`
+}
+
+// status is the state of a rule between evaluations.
+type status struct {
+	state State
+	since time.Time
+	// seen is when the metric was last updated, or when the rules were first
+	// evaluated.
+	seen  time.Time
+	value *float64
+}
+
+type Engine struct {
+	rules []Rule
+	sinks []Sink
+	now   func() time.Time
+
+	mu       sync.Mutex
+	statuses []status
+	queue    chan Alert
+}
+
+// New checks the rules and starts them all inactive.
+func New(rules []Rule, sinks []Sink) (*Engine, error) {
+	names := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return nil, fmt.Errorf("alert: %w", err)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("alert: duplicate rule name %q", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+	e := &Engine{
+		rules:    rules,
+		sinks:    sinks,
+		now:      time.Now,
+		statuses: make([]status, len(rules)),
+		queue:    make(chan Alert, queueSize),
+	}
+	for i := range e.statuses {
+		e.statuses[i].state = StateInactive
+	}
+	return e, nil
+}
+
+// Load reads a JSON or YAML rules file of the form
+// {"rules": [...], "sinks": [{"type": "log"}, ...]}.
+func Load(fileName string) (*Engine, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("alert: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".json":
+		var syntax interface{}
+		if errJSON := json.Unmarshal(data, &syntax); errJSON != nil {
+			return nil, fmt.Errorf("alert: %s is not valid JSON: %w", fileName, errJSON)
+		}
+	case ".yaml", ".yml":
+	default:
+		return nil, fmt.Errorf("alert: unsupported rules file extension %q, use .json, .yaml or .yml", filepath.Ext(fileName))
+	}
+	var content struct {
+		Rules []Rule       `yaml:"rules"`
+		Sinks []SinkConfig `yaml:"sinks"`
+	}
+	// JSON is decoded by the YAML decoder too, so durations are written as
+	// strings like "1m" in both formats.
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if errDecode := decoder.Decode(&content); errDecode != nil {
+		return nil, fmt.Errorf("alert: %s: %w", fileName, errDecode)
+	}
+	sinks := make([]Sink, 0, len(content.Sinks))
+	for _, config := range content.Sinks {
+		sink, errSink := NewSink(config)
+		if errSink != nil {
+			return nil, fmt.Errorf("alert: %w", errSink)
+		}
+		sinks = append(sinks, sink)
+	}
+	return New(content.Rules, sinks)
+}
+
+// Watches reports whether a rule evaluates the metric, so that callers only
+// look up the values that are needed.
+func (e *Engine) Watches(name string) bool {
+	for _, rule := range e.rules {
+		if rule.Metric == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Observe evaluates the rules of the metric against its new value. For
+// counters, value is the total after the update.
+func (e *Engine) Observe(metricType string, name string, value float64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := e.now()
+	for i, rule := range e.rules {
+		if rule.Metric != name || (rule.Type != "" && rule.Type != metricType) {
+			continue
+		}
+		s := &e.statuses[i]
+		s.seen = now
+		s.value = &value
+		if rule.Absent != 0 {
+			e.set(i, false, now)
+			continue
+		}
+		e.set(i, rule.matches(value), now)
+	}
+}
+
+// Evaluate moves the pending alerts that held for long enough to firing and
+// checks the absence rules.
+func (e *Engine) Evaluate() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	now := e.now()
+	for i, rule := range e.rules {
+		s := &e.statuses[i]
+		if s.seen.IsZero() {
+			s.seen = now
+		}
+		switch {
+		case rule.Absent != 0:
+			e.set(i, now.Sub(s.seen) >= rule.Absent, now)
+		case s.state == StatePending:
+			e.set(i, true, now)
+		}
+	}
+}
+
+// set moves rule i to the state for its condition holding or not and
+// queues the alerts of firing and resolving.
+func (e *Engine) set(i int, holds bool, now time.Time) {
+	rule, s := e.rules[i], &e.statuses[i]
+	switch {
+	case holds && (s.state == StateInactive || s.state == StateResolved):
+		s.since = now
+		if rule.Absent != 0 {
+			s.since = s.seen
+		}
+		s.state = StatePending
+		if now.Sub(s.since) < rule.For {
+			log.WithField("rule", rule.Name).Debug("alert pending")
+			return
+		}
+		s.state = StateFiring
+	case holds && s.state == StatePending && now.Sub(s.since) >= rule.For:
+		s.state = StateFiring
+	case !holds && s.state == StatePending:
+		s.state = StateInactive
+		return
+	case !holds && s.state == StateFiring:
+		s.state = StateResolved
+	default:
+		return
+	}
+	e.enqueue(Alert{
+		Rule:        rule.Name,
+		Metric:      rule.Metric,
+		State:       s.state,
+		Description: rule.Description,
+		Value:       s.value,
+		Since:       s.since,
+		At:          now,
+	})
+}
+
+func (e *Engine) enqueue(alert Alert) {
+	select {
+	case e.queue <- alert:
+	default:
+		selfmetrics.Add("alerts.dropped", 1)
+		log.WithField("rule", alert.Rule).Warn("alert queue is full, dropping the alert")
+	}
+}
+
+// send delivers an alert to every sink. A failing sink does not stop the
+// others.
+func (e *Engine) send(ctx context.Context, alert Alert) {
+	for _, sink := range e.sinks {
+		if err := sink.Notify(ctx, alert); err != nil {
+			selfmetrics.Add("alerts.failed", 1)
+			log.WithError(err).WithField("rule", alert.Rule).Error("unable to send alert")
+			continue
+		}
+		selfmetrics.Add("alerts.sent", 1)
+	}
+}
+
+// Run evaluates the rules every interval until done is closed. The alerts
+// are sent from another goroutine, so that a slow sink does not hold up the
+// evaluation. The alerts still queued at done are sent before Run returns.
+func (e *Engine) Run(interval time.Duration, done <-chan struct{}) {
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		e.notify(done)
+	}()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			e.Evaluate()
+		case <-done:
+			<-sent
+			return
+		}
+	}
+}
+
+// notify sends the queued alerts until done is closed, and then the ones
+// still queued.
+func (e *Engine) notify(done <-chan struct{}) {
+	ctx := context.Background()
+	for {
+		select {
+		case alert := <-e.queue:
+			e.send(ctx, alert)
+		case <-done:
+			for {
+				select {
+				case alert := <-e.queue:
+					e.send(ctx, alert)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
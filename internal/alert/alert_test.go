@@ -0,0 +1,257 @@
+package alert
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func float(value float64) *float64 {
+	return &value
+}
+
+// newTestEngine starts an engine on a clock that only moves when the test
+// moves it.
+func newTestEngine(t *testing.T, rules ...Rule) (*Engine, *time.Time) {
+	e, err := New(rules, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	e.now = func() time.Time { return now }
+	return e, &now
+}
+
+// alerts takes the queued alerts.
+func alerts(e *Engine) []Alert {
+	var queued []Alert
+	for {
+		select {
+		case alert := <-e.queue:
+			queued = append(queued, alert)
+		default:
+			return queued
+		}
+	}
+}
+
+// states returns the states of the alerts.
+func states(alerts []Alert) []State {
+	var got []State
+	for _, alert := range alerts {
+		got = append(got, alert.State)
+	}
+	return got
+}
+
+func TestEngine(t *testing.T) {
+	// step is an update of the metric, or an evaluation when value is nil,
+	// after advance.
+	type step struct {
+		advance time.Duration
+		value   *float64
+		want    []State
+	}
+	tests := []struct {
+		name  string
+		rule  Rule
+		steps []step
+	}{
+		{
+			name: "Threshold fires and resolves at once",
+			rule: Rule{Name: "LowMemory", Metric: "FreeMemory", Below: float(100)},
+			steps: []step{
+				{value: float(500)},
+				{value: float(50), want: []State{StateFiring}},
+				{value: float(40)},
+				{value: float(200), want: []State{StateResolved}},
+				{value: float(10), want: []State{StateFiring}},
+			},
+		},
+		{
+			name: "For-duration",
+			rule: Rule{Name: "HighCPU", Metric: "CPUutilization1", Above: float(90), For: time.Minute},
+			steps: []step{
+				{value: float(95)},
+				{advance: 30 * time.Second},
+				{advance: 20 * time.Second, value: float(99)},
+				{advance: 10 * time.Second, want: []State{StateFiring}},
+				{advance: time.Minute},
+				{advance: time.Second, value: float(10), want: []State{StateResolved}},
+			},
+		},
+		{
+			name: "Pending alert that does not hold long enough",
+			rule: Rule{Name: "HighCPU", Metric: "CPUutilization1", Above: float(90), For: time.Minute},
+			steps: []step{
+				{value: float(95)},
+				{advance: 30 * time.Second, value: float(50)},
+				{advance: time.Minute},
+				{value: float(95)},
+				{advance: 59 * time.Second},
+				{advance: time.Second, want: []State{StateFiring}},
+			},
+		},
+		{
+			name: "Absence",
+			rule: Rule{Name: "AgentDown", Metric: "PollCount", Absent: time.Minute},
+			steps: []step{
+				{},
+				{advance: 59 * time.Second},
+				{advance: time.Second, want: []State{StateFiring}},
+				{advance: time.Minute},
+				{value: float(3), want: []State{StateResolved}},
+				{advance: 30 * time.Second},
+				{advance: 30 * time.Second, want: []State{StateFiring}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, now := newTestEngine(t, tt.rule)
+			for i, step := range tt.steps {
+				*now = now.Add(step.advance)
+				if step.value != nil {
+					e.Observe("gauge", tt.rule.Metric, *step.value)
+				} else {
+					e.Evaluate()
+				}
+				assert.Equal(t, step.want, states(alerts(e)), "step %d", i)
+			}
+		})
+	}
+}
+
+func TestEngine_alert(t *testing.T) {
+	e, now := newTestEngine(t,
+		Rule{Name: "HighCPU", Metric: "CPUutilization1", Above: float(90), For: time.Minute, Description: "CPU is busy"},
+		Rule{Name: "ManyPolls", Metric: "CPUutilization1", Type: "counter", Above: float(0)},
+	)
+	assert.True(t, e.Watches("CPUutilization1"))
+	assert.False(t, e.Watches("FreeMemory"))
+
+	started := *now
+	e.Observe("gauge", "CPUutilization1", 95)
+	*now = now.Add(time.Minute)
+	e.Evaluate()
+	assert.Equal(t, []Alert{{
+		Rule:        "HighCPU",
+		Metric:      "CPUutilization1",
+		State:       StateFiring,
+		Description: "CPU is busy",
+		Value:       float(95),
+		Since:       started,
+		At:          *now,
+	}}, alerts(e), "the counter rule skips gauges")
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   []Rule
+		wantErr string
+	}{
+		{name: "No condition", rules: []Rule{{Name: "A", Metric: "Alloc"}}, wantErr: "exactly one of"},
+		{name: "Two conditions", rules: []Rule{{Name: "A", Metric: "Alloc", Above: float(1), Below: float(0)}}, wantErr: "exactly one of"},
+		{name: "No metric", rules: []Rule{{Name: "A", Above: float(1)}}, wantErr: "has no metric"},
+		{name: "Histogram", rules: []Rule{{Name: "A", Metric: "Latency", Type: "histogram", Above: float(1)}}, wantErr: "gauge or counter"},
+		{name: "For on absence", rules: []Rule{{Name: "A", Metric: "Alloc", Absent: time.Minute, For: time.Minute}}, wantErr: "thresholds only"},
+		{
+			name:    "Duplicate name",
+			rules:   []Rule{{Name: "A", Metric: "Alloc", Above: float(1)}, {Name: "A", Metric: "Sys", Above: float(1)}},
+			wantErr: "duplicate rule name",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.rules, nil)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name      string
+		fileName  string
+		content   string
+		wantRules []Rule
+		wantSinks int
+		wantErr   string
+	}{
+		{
+			name:     "YAML",
+			fileName: "alerts.yaml",
+			content: `
+rules:
+  - name: LowMemory
+    metric: FreeMemory
+    below: 100000000
+    description: Less than 100 MB free
+  - name: HighCPU
+    metric: CPUutilization1
+    above: 90
+    for: 5m
+sinks:
+  - type: log
+  - type: file
+    path: /var/log/alerts.jsonl
+`,
+			wantRules: []Rule{
+				{Name: "LowMemory", Metric: "FreeMemory", Below: float(1e8), Description: "Less than 100 MB free"},
+				{Name: "HighCPU", Metric: "CPUutilization1", Above: float(90), For: 5 * time.Minute},
+			},
+			wantSinks: 2,
+		},
+		{
+			name:      "JSON",
+			fileName:  "alerts.json",
+			content:   `{"rules": [{"name": "AgentDown", "metric": "PollCount", "absent": "1m"}], "sinks": [{"type": "webhook", "url": "http://localhost:9093/"}]}`,
+			wantRules: []Rule{{Name: "AgentDown", Metric: "PollCount", Absent: time.Minute}},
+			wantSinks: 1,
+		},
+		{
+			name:     "Unknown field",
+			fileName: "alerts.yaml",
+			content:  "rules:\n  - name: A\n    metric: Alloc\n    over: 1\n",
+			wantErr:  "field over not found",
+		},
+		{
+			name:     "Webhook without URL",
+			fileName: "alerts.yaml",
+			content:  "sinks:\n  - type: webhook\n",
+			wantErr:  "webhook sink needs a url",
+		},
+		{
+			name:     "Unknown extension",
+			fileName: "alerts.toml",
+			wantErr:  "unsupported rules file extension",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileName := filepath.Join(dir, tt.fileName)
+			if err := os.WriteFile(fileName, []byte(tt.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			e, err := Load(fileName)
+			if tt.wantErr != "" {
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), tt.wantErr)
+				}
+				return
+			}
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, tt.wantRules, e.rules)
+			assert.Len(t, e.sinks, tt.wantSinks)
+		})
+	}
+}
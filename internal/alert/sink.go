@@ -0,0 +1,117 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// webhookTimeout bounds a webhook call, so that a slow receiver cannot hold
+// back the alerts behind it for long.
+const webhookTimeout = 10 * time.Second
+
+// Sink delivers alerts.
+type Sink interface {
+	Notify(ctx context.Context, alert Alert) error
+}
+
+// SinkConfig is a sink in the rules file: {"type": "log"},
+// {"type": "file", "path": "..."} or {"type": "webhook", "url": "..."}.
+type SinkConfig struct {
+	Type string `yaml:"type"`
+	Path string `yaml:"path"`
+	URL  string `yaml:"url"`
+}
+
+func NewSink(config SinkConfig) (Sink, error) {
+	switch config.Type {
+	case "log":
+		return logSink{}, nil
+	case "file":
+		if config.Path == "" {
+			return nil, fmt.Errorf("file sink needs a path")
+		}
+		return &fileSink{path: config.Path}, nil
+	case "webhook":
+		if config.URL == "" {
+			return nil, fmt.Errorf("webhook sink needs a url")
+		}
+		return &webhookSink{url: config.URL, client: &http.Client{Timeout: webhookTimeout}}, nil
+	}
+	return nil, fmt.Errorf("unknown sink type %q, use log, file or webhook", config.Type)
+}
+
+// logSink writes alerts to the server log.
+type logSink struct{}
+
+func (logSink) Notify(ctx context.Context, alert Alert) error {
+	entry := log.WithField("rule", alert.Rule).WithField("metric", alert.Metric).WithField("since", alert.Since)
+	if alert.Value != nil {
+		entry = entry.WithField("value", *alert.Value)
+	}
+	if alert.Description != "" {
+		entry = entry.WithField("description", alert.Description)
+	}
+	if alert.State == StateFiring {
+		entry.Warn("alert firing")
+	} else {
+		entry.Info("alert resolved")
+	}
+	return nil
+}
+
+// fileSink appends alerts to a file as JSON lines.
+type fileSink struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (s *fileSink) Notify(ctx context.Context, alert Alert) error {
+	line, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, errWrite := file.Write(append(line, '\n')); errWrite != nil {
+		file.Close()
+		return errWrite
+	}
+	return file.Close()
+}
+
+// webhookSink posts alerts as JSON to a URL.
+type webhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *webhookSink) Notify(ctx context.Context, alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("webhook %s answered %s", s.url, response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,159 @@
+package alert
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// receiver is a local webhook endpoint that keeps the alerts it gets.
+func receiver(t *testing.T, status int) (*httptest.Server, chan Alert) {
+	received := make(chan Alert, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var alert Alert
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&alert))
+		received <- alert
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, received
+}
+
+func TestWebhookSink(t *testing.T) {
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	alert := Alert{Rule: "LowMemory", Metric: "FreeMemory", State: StateFiring, Value: float(50), Since: at, At: at}
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{name: "Accepted", status: http.StatusOK},
+		{name: "No content", status: http.StatusNoContent},
+		{name: "Receiver failure", status: http.StatusBadGateway, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, received := receiver(t, tt.status)
+			sink, err := NewSink(SinkConfig{Type: "webhook", URL: srv.URL})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = sink.Notify(context.Background(), alert)
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, alert, <-received)
+		})
+	}
+}
+
+func TestFileSink(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "alerts.jsonl")
+	sink, err := NewSink(SinkConfig{Type: "file", Path: fileName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	assert.NoError(t, sink.Notify(context.Background(), Alert{Rule: "AgentDown", Metric: "PollCount", State: StateFiring, Since: at, At: at}))
+	assert.NoError(t, sink.Notify(context.Background(), Alert{Rule: "AgentDown", Metric: "PollCount", State: StateResolved, Value: float(3), Since: at, At: at}))
+
+	data, err := os.ReadFile(fileName)
+	assert.NoError(t, err)
+	assert.Equal(t,
+		`{"rule":"AgentDown","metric":"PollCount","state":"firing","since":"2024-01-01T00:00:00Z","at":"2024-01-01T00:00:00Z"}
+{"rule":"AgentDown","metric":"PollCount","state":"resolved","value":3,"since":"2024-01-01T00:00:00Z","at":"2024-01-01T00:00:00Z"}
+`, string(data))
+}
+
+func TestNewSink_unknownType(t *testing.T) {
+	_, err := NewSink(SinkConfig{Type: "email"})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "unknown sink type")
+	}
+}
+
+func TestEngine_Run(t *testing.T) {
+	failing, _ := receiver(t, http.StatusInternalServerError)
+	srv, received := receiver(t, http.StatusOK)
+	e, err := New([]Rule{{Name: "LowMemory", Metric: "FreeMemory", Below: float(100)}}, []Sink{
+		&webhookSink{url: failing.URL, client: http.DefaultClient},
+		&webhookSink{url: srv.URL, client: http.DefaultClient},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		e.Run(time.Hour, done)
+		close(stopped)
+	}()
+
+	e.Observe("gauge", "FreeMemory", 50)
+	select {
+	case alert := <-received:
+		assert.Equal(t, StateFiring, alert.State, "a failing sink does not stop the others")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no alert received")
+	}
+
+	// Alerts queued when the engine stops are still sent.
+	e.Observe("gauge", "FreeMemory", 500)
+	close(done)
+	<-stopped
+	select {
+	case alert := <-received:
+		assert.Equal(t, StateResolved, alert.State)
+	default:
+		t.Error("the queued alert was not sent")
+	}
+}
+
+// blockingSink holds every alert until it is released.
+type blockingSink struct {
+	release chan struct{}
+}
+
+func (s blockingSink) Notify(ctx context.Context, alert Alert) error {
+	<-s.release
+	return nil
+}
+
+func TestEngine_Run_slowSink(t *testing.T) {
+	sink := blockingSink{release: make(chan struct{})}
+	e, err := New([]Rule{
+		{Name: "LowMemory", Metric: "FreeMemory", Below: float(100)},
+		{Name: "NoHeartbeat", Metric: "Heartbeat", Absent: 20 * time.Millisecond},
+	}, []Sink{sink})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		e.Run(5*time.Millisecond, done)
+		close(stopped)
+	}()
+
+	// The sink holds the first alert, and the rules are still evaluated.
+	e.Observe("gauge", "FreeMemory", 50)
+	assert.Eventually(t, func() bool {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		return e.statuses[1].state == StateFiring
+	}, 5*time.Second, 5*time.Millisecond)
+
+	close(sink.release)
+	close(done)
+	<-stopped
+}
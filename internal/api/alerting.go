@@ -0,0 +1,71 @@
+package api
+
+import (
+	"context"
+	"strings"
+
+	"github.com/NikWaltz/metrics-collector/internal/alert"
+	"github.com/NikWaltz/metrics-collector/internal/service"
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+type alertingCollector struct {
+	Collector
+	engine *alert.Engine
+}
+
+// Alerting evaluates the rules of the engine against the accepted gauge and
+// counter updates. The metrics the rules watch are read back after a write,
+// as counter rules are on the totals.
+func Alerting(collector Collector, engine *alert.Engine) Collector {
+	return alertingCollector{Collector: collector, engine: engine}
+}
+
+func (c alertingCollector) Update(ctx context.Context, metricType string, name string, value string) error {
+	err := c.Collector.Update(ctx, metricType, name, value)
+	if err == nil {
+		c.observe(ctx, strings.ToLower(metricType), name)
+	}
+	return err
+}
+
+func (c alertingCollector) AddGauge(ctx context.Context, name string, delta model.Gauge) error {
+	err := c.Collector.AddGauge(ctx, name, delta)
+	if err == nil {
+		c.observe(ctx, model.GaugeType, name)
+	}
+	return err
+}
+
+func (c alertingCollector) Import(ctx context.Context, storage model.Storage, mode service.ImportMode) error {
+	err := c.Collector.Import(ctx, storage, mode)
+	if err != nil {
+		return err
+	}
+	for name := range storage.Gauges {
+		c.observe(ctx, model.GaugeType, name)
+	}
+	for name := range storage.Counters {
+		c.observe(ctx, model.CounterType, name)
+	}
+	return nil
+}
+
+// observe passes the current value of a watched metric to the engine.
+func (c alertingCollector) observe(ctx context.Context, metricType string, name string) {
+	if !c.engine.Watches(name) {
+		return
+	}
+	switch metricType {
+	case model.GaugeType:
+		value, err := c.Collector.GetGauge(ctx, name)
+		if err == nil {
+			c.engine.Observe(metricType, name, float64(value))
+		}
+	case model.CounterType:
+		value, err := c.Collector.GetCounter(ctx, name)
+		if err == nil {
+			c.engine.Observe(metricType, name, float64(value))
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NikWaltz/metrics-collector/internal/alert"
+	"github.com/NikWaltz/metrics-collector/internal/service"
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+func TestAlerting(t *testing.T) {
+	dir := t.TempDir()
+	alertsFile := filepath.Join(dir, "alerts.jsonl")
+	rulesFile := filepath.Join(dir, "rules.yaml")
+	rules := `
+rules:
+  - name: LowMemory
+    metric: FreeMemory
+    below: 100
+  - name: ManyPolls
+    metric: PollCount
+    above: 5
+sinks:
+  - type: file
+    path: ` + alertsFile + "\n"
+	if err := os.WriteFile(rulesFile, []byte(rules), 0600); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := alert.Load(rulesFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		engine.Run(time.Hour, done)
+		close(stopped)
+	}()
+
+	ctx := context.Background()
+	c := Alerting(service.NewService(model.NewStorage()), engine)
+	assert.NoError(t, c.Update(ctx, "Gauge", "FreeMemory", "50"))
+	assert.Error(t, c.Update(ctx, "gauge", "FreeMemory", "x"))
+	// Counter rules are on the totals.
+	assert.NoError(t, c.Update(ctx, "counter", "PollCount", "4"))
+	assert.NoError(t, c.Import(ctx, model.Storage{
+		Gauges:   map[string]model.Gauge{"FreeMemory": 500},
+		Counters: map[string]model.Counter{"PollCount": 2},
+	}, service.ImportAdd))
+	close(done)
+	<-stopped
+
+	data, err := os.ReadFile(alertsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var a alert.Alert
+		assert.NoError(t, json.Unmarshal([]byte(line), &a))
+		got = append(got, a.Rule+" "+string(a.State))
+	}
+	assert.ElementsMatch(t, []string{"LowMemory firing", "LowMemory resolved", "ManyPolls firing"}, got)
+}
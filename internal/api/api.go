@@ -1,24 +1,33 @@
 package api
 
 import (
+	"bytes"
 	"compress/gzip"
 	"context"
 	"crypto/hmac"
+	"crypto/rsa"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
 	"io"
-	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/golang/gddo/httputil/header"
 
+	"github.com/NikWaltz/metrics-collector/internal/encryption"
+	"github.com/NikWaltz/metrics-collector/internal/health"
+	"github.com/NikWaltz/metrics-collector/internal/replay"
+	"github.com/NikWaltz/metrics-collector/internal/selfmetrics"
 	"github.com/NikWaltz/metrics-collector/internal/service"
 	"github.com/NikWaltz/metrics-collector/model"
 )
@@ -27,7 +36,15 @@ type Collector interface {
 	Update(context.Context, string, string, string) error
 	GetGauge(context.Context, string) (model.Gauge, error)
 	GetCounter(context.Context, string) (model.Counter, error)
+	GetHistogram(context.Context, string) (model.Histogram, error)
+	UpdateHistogram(context.Context, string, model.Histogram) error
+	AddGauge(context.Context, string, model.Gauge) error
 	GetStorage(context.Context) model.Storage
+	Export(context.Context) (model.Storage, error)
+	Import(context.Context, model.Storage, service.ImportMode) error
+	SetMetadata(context.Context, model.Metadata) error
+	GetMetadata(context.Context, string) (model.Metadata, error)
+	ListMetadata(context.Context) ([]model.Metadata, error)
 	Ping(ctx context.Context) error
 	Close()
 }
@@ -42,243 +59,344 @@ func (w gzipWriter) Write(b []byte) (int, error) {
 }
 
 type api struct {
-	r       chi.Router
-	service Collector
-	key     string
+	r        chi.Router
+	service  Collector
+	settings atomic.Value
+
+	privateKey *rsa.PrivateKey
+	tlsConfig  *tls.Config
+	server     atomic.Value
+
+	liveness  *health.Registry
+	readiness *health.Registry
 }
 
+type contextKey string
+
+const (
+	bodyVerifiedKey contextKey = "bodyVerified"
+	// keyIDKey holds the key id of a body signed with a key of the keyring.
+	keyIDKey contextKey = "keyID"
+)
+
+var errKeyRequired = errors.New("key id is required")
+
 func New(service Collector, key string) *api {
 	r := chi.NewRouter()
-	return &api{service: service, r: r, key: key}
+	a := &api{
+		service:   service,
+		r:         r,
+		liveness:  health.NewRegistry(),
+		readiness: health.NewRegistry(),
+	}
+	a.Reload(Settings{Key: key})
+	a.liveness.Add("process", processCheck(time.Now()))
+	a.readiness.Add("storage", func(ctx context.Context) health.Result {
+		return health.FromError(service.Ping(ctx))
+	})
+	return a
+}
+
+// SetPrivateKey enables decryption of request bodies encrypted with the
+// matching public key.
+func (a *api) SetPrivateKey(key *rsa.PrivateKey) {
+	a.privateKey = key
+}
+
+// SetTLSConfig makes Run serve HTTPS with the given certificates.
+func (a *api) SetTLSConfig(config *tls.Config) {
+	a.tlsConfig = config
 }
 
 func (a *api) updateHandle(w http.ResponseWriter, r *http.Request) {
 	metricType := chi.URLParam(r, "type")
 	metricName := chi.URLParam(r, "name")
 	metricValue := chi.URLParam(r, "value")
+	if err := validateID(metricName); err != nil {
+		writeErr(w, r, err, metricName)
+		return
+	}
 	err := a.service.Update(r.Context(), metricType, metricName, metricValue)
 	if err != nil {
-		var typeError *service.TypeError
-		if errors.As(err, &typeError) {
-			w.WriteHeader(http.StatusNotImplemented)
-		} else {
-			w.WriteHeader(http.StatusBadRequest)
-		}
-		_, err := w.Write([]byte(err.Error()))
-		if err != nil {
-			log.Println(err)
-		}
-	} else {
-		w.WriteHeader(http.StatusOK)
+		writeErr(w, r, err, metricName)
+		return
 	}
+	w.WriteHeader(http.StatusOK)
 }
 
 func (a *api) getValueHandle(w http.ResponseWriter, r *http.Request) {
-	metricType := chi.URLParam(r, "type")
-	metricName := chi.URLParam(r, "name")
-	switch strings.ToLower(metricType) {
+	metric := model.Metrics{
+		ID:    chi.URLParam(r, "name"),
+		MType: chi.URLParam(r, "type"),
+	}
+	if err := validateID(metric.ID); err != nil {
+		writeErr(w, r, err, metric.ID)
+		return
+	}
+	if err := a.loadValue(r.Context(), &metric); err != nil {
+		writeReadErr(w, r, err, metric.ID)
+		return
+	}
+	var body []byte
+	switch {
+	case metric.Value != nil:
+		body = []byte(fmt.Sprintf("%v", *metric.Value))
+	case metric.Delta != nil:
+		body = []byte(fmt.Sprintf("%d", *metric.Delta))
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		if errEncode := json.NewEncoder(w).Encode(metric.Histogram); errEncode != nil {
+			requestLog(r).Error(errEncode)
+		}
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	if _, errWr := w.Write(body); errWr != nil {
+		requestLog(r).Error(errWr)
+	}
+}
+
+// loadValue fills the value of the metric with the stored one.
+func (a *api) loadValue(ctx context.Context, metric *model.Metrics) error {
+	switch strings.ToLower(metric.MType) {
 	case model.GaugeType:
-		if value, err := a.service.GetGauge(r.Context(), metricName); err == nil {
-			w.WriteHeader(http.StatusOK)
-			_, errWr := w.Write([]byte(fmt.Sprintf("%v", value)))
-			if errWr != nil {
-				log.Println(errWr)
-			}
-		} else {
-			w.WriteHeader(http.StatusNotFound)
+		value, err := a.service.GetGauge(ctx, metric.ID)
+		if err != nil {
+			return err
 		}
+		metric.Value = (*float64)(&value)
 	case model.CounterType:
-		if value, err := a.service.GetCounter(r.Context(), metricName); err == nil {
-			w.WriteHeader(http.StatusOK)
-			_, errWr := w.Write([]byte(fmt.Sprintf("%d", value)))
-			if errWr != nil {
-				log.Println(errWr)
-			}
-		} else {
-			w.WriteHeader(http.StatusNotFound)
+		value, err := a.service.GetCounter(ctx, metric.ID)
+		if err != nil {
+			return err
+		}
+		metric.Delta = (*int64)(&value)
+	case model.HistogramType:
+		value, err := a.service.GetHistogram(ctx, metric.ID)
+		if err != nil {
+			return err
 		}
+		metric.Histogram = &value
 	default:
-		w.WriteHeader(http.StatusNotFound)
+		return &service.TypeError{}
 	}
+	return nil
 }
 
-func (a *api) jsonUpdateHandle(w http.ResponseWriter, r *http.Request) {
-	var metric model.Metrics
+// writeReadErr answers 404 for unknown types, since no such metric can exist.
+func writeReadErr(w http.ResponseWriter, r *http.Request, err error, id string) {
+	e := errorFor(err, id)
+	if e.Code == codeUnknownType {
+		e.Status = http.StatusNotFound
+	}
+	writeError(w, r, e)
+}
+
+// saveMetric registers the metadata of the metric, if any, before its value,
+// so that a value of the wrong type is never written.
+func (a *api) saveMetric(ctx context.Context, metric *model.Metrics) error {
+	if metadata, ok := metadataOf(metric); ok {
+		if err := a.service.SetMetadata(ctx, metadata); err != nil {
+			return err
+		}
+	}
+	switch strings.ToLower(metric.MType) {
+	case model.GaugeType:
+		return a.service.Update(ctx, metric.MType, metric.ID, strconv.FormatFloat(*metric.Value, 'f', -1, 64))
+	case model.CounterType:
+		return a.service.Update(ctx, metric.MType, metric.ID, strconv.FormatInt(*metric.Delta, 10))
+	case model.HistogramType:
+		if metric.Histogram != nil {
+			return a.service.UpdateHistogram(ctx, metric.ID, *metric.Histogram)
+		}
+		if metric.Value == nil {
+			return fmt.Errorf("%w: histogram or value is required", service.ErrInvalidValue)
+		}
+		return a.service.Update(ctx, metric.MType, metric.ID, strconv.FormatFloat(*metric.Value, 'f', -1, 64))
+	default:
+		return &service.TypeError{}
+	}
+}
 
+// decodeJSON checks the content type and decodes the body into v, writing
+// the error response when either fails.
+func decodeJSON(w http.ResponseWriter, r *http.Request, v interface{}) bool {
 	contentType, _ := header.ParseValueAndParams(r.Header, "Content-Type")
 	if contentType != "application/json" {
-		msg := "Content-Type header is not application/json"
-		http.Error(w, msg, http.StatusUnsupportedMediaType)
-		return
+		writeError(w, r, newError(http.StatusUnsupportedMediaType, codeUnsupportedMediaType,
+			"Content-Type header is not application/json"))
+		return false
 	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		selfmetrics.Add("decode_errors", 1)
+		writeError(w, r, newError(http.StatusBadRequest, codeInvalidJSON, err.Error()))
+		return false
+	}
+	return true
+}
 
-	decodeErr := json.NewDecoder(r.Body).Decode(&metric)
-	if decodeErr != nil {
-		http.Error(w, decodeErr.Error(), http.StatusBadRequest)
+func (a *api) jsonUpdateHandle(w http.ResponseWriter, r *http.Request) {
+	var metric model.Metrics
+	if !decodeJSON(w, r, &metric) {
 		return
 	}
-
-	if a.key != "" {
-		hashErr := verifyHash(&metric, a.key)
-		if hashErr != nil {
-			http.Error(w, hashErr.Error(), http.StatusBadRequest)
-			return
-		}
+	if err := validateMetric(&metric); err != nil {
+		writeErr(w, r, err, metric.ID)
+		return
 	}
 
-	var value string
-	switch strings.ToLower(metric.MType) {
-	case model.GaugeType:
-		value = strconv.FormatFloat(*metric.Value, 'f', -1, 64)
-	case model.CounterType:
-		value = strconv.FormatInt(*metric.Delta, 10)
-	default:
-		w.WriteHeader(http.StatusNotImplemented)
+	hashErr := a.current().verifyMetric(r, &metric)
+	if hashErr != nil {
+		selfmetrics.Add("rejected_hashes", 1)
+		writeErr(w, r, hashErr, metric.ID)
 		return
 	}
-	err := a.service.Update(r.Context(), metric.MType, metric.ID, value)
 
-	if err != nil {
-		var typeError *service.TypeError
-		if errors.As(err, &typeError) {
-			w.WriteHeader(http.StatusNotImplemented)
-		} else {
-			w.WriteHeader(http.StatusBadRequest)
-		}
-		_, err := w.Write([]byte(err.Error()))
-		if err != nil {
-			log.Println(err)
-		}
-	} else {
-		w.WriteHeader(http.StatusOK)
+	if err := a.saveMetric(r.Context(), &metric); err != nil {
+		writeErr(w, r, err, metric.ID)
+		return
 	}
+	w.WriteHeader(http.StatusOK)
 }
 
 func (a *api) getJSONValueHandle(w http.ResponseWriter, r *http.Request) {
 	var metric model.Metrics
-
-	contentType, _ := header.ParseValueAndParams(r.Header, "Content-Type")
-	if contentType != "application/json" {
-		msg := "Content-Type header is not application/json"
-		http.Error(w, msg, http.StatusUnsupportedMediaType)
+	if !decodeJSON(w, r, &metric) {
+		return
+	}
+	if err := validateID(metric.ID); err != nil {
+		writeErr(w, r, err, metric.ID)
 		return
 	}
 
-	decodeErr := json.NewDecoder(r.Body).Decode(&metric)
-	if decodeErr != nil {
-		http.Error(w, decodeErr.Error(), http.StatusBadRequest)
+	key, keyErr := a.current().signingKey(r, &metric)
+	if keyErr != nil {
+		writeError(w, r, newError(http.StatusForbidden, codeForbidden, keyErr.Error()))
 		return
 	}
 
-	switch strings.ToLower(metric.MType) {
-	case model.GaugeType:
-		if value, err := a.service.GetGauge(r.Context(), metric.ID); err == nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			metric.Value = (*float64)(&value)
-			if a.key != "" {
-				hash(&metric, a.key)
-			}
-			errEncode := json.NewEncoder(w).Encode(metric)
-			if errEncode != nil {
-				log.Println(errEncode)
-			}
-		} else {
-			w.WriteHeader(http.StatusNotFound)
-		}
-	case model.CounterType:
-		if value, err := a.service.GetCounter(r.Context(), metric.ID); err == nil {
-			w.Header().Set("Content-Type", "application/json")
-			w.WriteHeader(http.StatusOK)
-			metric.Delta = (*int64)(&value)
-			if a.key != "" {
-				hash(&metric, a.key)
-			}
-			errEncode := json.NewEncoder(w).Encode(metric)
-			if errEncode != nil {
-				log.Println(errEncode)
-			}
-		} else {
-			w.WriteHeader(http.StatusNotFound)
-		}
-	default:
-		w.WriteHeader(http.StatusNotFound)
+	if err := a.loadValue(r.Context(), &metric); err != nil {
+		writeReadErr(w, r, err, metric.ID)
+		return
+	}
+	if key != "" {
+		hash(&metric, key)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if errEncode := json.NewEncoder(w).Encode(metric); errEncode != nil {
+		requestLog(r).Error(errEncode)
 	}
 }
 
-func (a *api) updatesHandle(w http.ResponseWriter, r *http.Request) {
-	var metrics []model.Metrics
+type updateResult struct {
+	ID     string    `json:"id"`
+	Type   string    `json:"type"`
+	Status int       `json:"status"`
+	Error  *apiError `json:"error,omitempty"`
+}
 
-	contentType, _ := header.ParseValueAndParams(r.Header, "Content-Type")
-	if contentType != "application/json" {
-		msg := "Content-Type header is not application/json"
-		http.Error(w, msg, http.StatusUnsupportedMediaType)
-		return
-	}
+type updatesResponse struct {
+	Accepted int            `json:"accepted"`
+	Rejected int            `json:"rejected"`
+	Results  []updateResult `json:"results"`
+}
 
-	decodeErr := json.NewDecoder(r.Body).Decode(&metrics)
-	if decodeErr != nil {
-		http.Error(w, decodeErr.Error(), http.StatusBadRequest)
+// updatesHandle saves every metric of the batch on its own and reports the
+// result of each. The response is 200 when all of them are accepted and 207
+// otherwise. Errors that concern the sender rather than a metric, like an
+// unknown key id, reject the whole batch before anything is saved.
+func (a *api) updatesHandle(w http.ResponseWriter, r *http.Request) {
+	var metrics []model.Metrics
+	if !decodeJSON(w, r, &metrics) {
 		return
 	}
 
-	for _, metric := range metrics {
-		if a.key != "" {
-			hashErr := verifyHash(&metric, a.key)
-			if hashErr != nil {
-				http.Error(w, hashErr.Error(), http.StatusBadRequest)
+	settings := a.current()
+	errs := make([]error, len(metrics))
+	for i := range metrics {
+		// Invalid metrics are rejected on their own and never hashed.
+		if errs[i] = validateMetric(&metrics[i]); errs[i] != nil {
+			continue
+		}
+		errs[i] = settings.verifyMetric(r, &metrics[i])
+		if errs[i] != nil {
+			selfmetrics.Add("rejected_hashes", 1)
+			if isForbidden(errs[i]) {
+				writeErr(w, r, errs[i], metrics[i].ID)
 				return
 			}
 		}
-		var value string
-		switch strings.ToLower(metric.MType) {
-		case model.GaugeType:
-			value = strconv.FormatFloat(*metric.Value, 'f', -1, 64)
-		case model.CounterType:
-			value = strconv.FormatInt(*metric.Delta, 10)
-		default:
-			w.WriteHeader(http.StatusNotImplemented)
-			return
-		}
-		err := a.service.Update(r.Context(), metric.MType, metric.ID, value)
+	}
 
+	response := updatesResponse{Results: make([]updateResult, len(metrics))}
+	for i := range metrics {
+		metric := &metrics[i]
+		result := updateResult{ID: metric.ID, Type: metric.MType, Status: http.StatusOK}
+		err := errs[i]
+		if err == nil {
+			err = a.saveMetric(r.Context(), metric)
+		}
 		if err != nil {
-			var typeError *service.TypeError
-			if errors.As(err, &typeError) {
-				w.WriteHeader(http.StatusNotImplemented)
-			} else {
-				w.WriteHeader(http.StatusBadRequest)
-			}
-			_, errWr := w.Write([]byte(err.Error()))
-			if errWr != nil {
-				log.Println(errWr)
+			e := errorFor(err, metric.ID)
+			if e.Status >= http.StatusInternalServerError {
+				requestLog(r).WithField("metric", metric.ID).Error(e.Message)
 			}
+			result.Status, result.Error = e.Status, &e
+			response.Rejected++
+		} else {
+			response.Accepted++
 		}
+		response.Results[i] = result
+	}
+
+	status := http.StatusOK
+	if response.Rejected > 0 {
+		status = http.StatusMultiStatus
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if errEncode := json.NewEncoder(w).Encode(response); errEncode != nil {
+		requestLog(r).Error(errEncode)
 	}
 }
 
+// describe formats the unit and description of a metric for the index page.
+func describe(metadata model.Metadata) string {
+	var b strings.Builder
+	if metadata.Unit != "" {
+		b.WriteString(" " + metadata.Unit)
+	}
+	if metadata.Description != "" {
+		// The page has a line per metric.
+		b.WriteString(" # " + strings.Join(strings.Fields(metadata.Description), " "))
+	}
+	return b.String()
+}
+
 func (a *api) getMetricsHandle(w http.ResponseWriter, r *http.Request) {
 	data := a.service.GetStorage(r.Context())
 	data.Counters["PollCount"] = 24
-	htmlTemplate := `{{range $index, $element := .Gauges}}{{$index}} {{printf "%f" $element}}
-{{end}}{{range $index, $element := .Counters}}{{$index}} {{printf "%d" $element}}
+	htmlTemplate := `{{range $index, $element := .Gauges}}{{$index}} {{printf "%f" $element}}{{describe (index $.Metadata $index)}}
+{{end}}{{range $index, $element := .Counters}}{{$index}} {{printf "%d" $element}}{{describe (index $.Metadata $index)}}
+{{end}}{{range $index, $element := .Histograms}}{{$index}} count={{$element.Count}} sum={{printf "%f" $element.Sum}}{{describe (index $.Metadata $index)}}
 {{end}}`
-	tmpl, err := template.New("metrics").Parse(htmlTemplate)
+	tmpl, err := template.New("metrics").Funcs(template.FuncMap{"describe": describe}).Parse(htmlTemplate)
 	if err != nil {
-		log.Println(err)
+		requestLog(r).Error(err)
 	}
 	w.Header().Set("Content-Type", "text/html")
 	errExec := tmpl.Execute(w, &data)
 	if errExec != nil {
-		log.Println(err)
+		requestLog(r).Error(errExec)
 	}
 }
 
 func (a *api) pingStoreHandle(w http.ResponseWriter, r *http.Request) {
 	err := a.service.Ping(r.Context())
 	if err != nil {
-		log.Println(err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, r, newError(http.StatusInternalServerError, codeInternal, err.Error()))
 	} else {
 		w.WriteHeader(http.StatusOK)
 	}
@@ -293,11 +411,7 @@ func gzipCompressHandle(next http.Handler) http.Handler {
 
 		gz, err := gzip.NewWriterLevel(w, gzip.BestSpeed)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			_, err := io.WriteString(w, err.Error())
-			if err != nil {
-				return
-			}
+			writeError(w, r, newError(http.StatusInternalServerError, codeInternal, err.Error()))
 			return
 		}
 		defer gz.Close()
@@ -307,6 +421,37 @@ func gzipCompressHandle(next http.Handler) http.Handler {
 	})
 }
 
+// decryptHandle runs before gzipDecompressHandle since clients compress the
+// body before encrypting it.
+func (a *api) decryptHandle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scheme := r.Header.Get(encryption.Header)
+		if scheme == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if a.privateKey == nil {
+			writeError(w, r, newError(http.StatusBadRequest, codeInvalidBody, "encrypted requests are not supported"))
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, newError(http.StatusBadRequest, codeInvalidBody, err.Error()))
+			return
+		}
+		decrypted, err := encryption.Decrypt(a.privateKey, scheme, body)
+		if err != nil {
+			requestLog(r).WithError(err).Warn("unable to decrypt request")
+			selfmetrics.Add("decode_errors", 1)
+			writeError(w, r, newError(http.StatusBadRequest, codeInvalidBody, "unable to decrypt request body"))
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(decrypted))
+		r.Header.Del(encryption.Header)
+		next.ServeHTTP(w, r)
+	})
+}
+
 func gzipDecompressHandle(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !strings.Contains(r.Header.Get("Content-Encoding"), "gzip") {
@@ -316,11 +461,8 @@ func gzipDecompressHandle(next http.Handler) http.Handler {
 
 		gz, err := gzip.NewReader(r.Body)
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			_, err := io.WriteString(w, err.Error())
-			if err != nil {
-				return
-			}
+			selfmetrics.Add("decode_errors", 1)
+			writeError(w, r, newError(http.StatusBadRequest, codeInvalidBody, "invalid gzip body: "+err.Error()))
 			return
 		}
 		defer gz.Close()
@@ -329,38 +471,150 @@ func gzipDecompressHandle(next http.Handler) http.Handler {
 	})
 }
 
+// agentIP takes the address the agent reported in X-Real-IP and falls back
+// to the address of the connection.
+func agentIP(r *http.Request) net.IP {
+	if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+		return net.ParseIP(strings.TrimSpace(realIP))
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return net.ParseIP(r.RemoteAddr)
+	}
+	return net.ParseIP(host)
+}
+
+// sourceHandle names the agent behind a write for the storage: the key id
+// that signed the body, or its address otherwise. An X-Key-ID header alone
+// is not trusted, as anyone can send it.
+func sourceHandle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		source, _ := r.Context().Value(keyIDKey).(string)
+		if source == "" {
+			if ip := agentIP(r); ip != nil {
+				source = ip.String()
+			}
+		}
+		next.ServeHTTP(w, r.WithContext(service.WithSource(r.Context(), source)))
+	})
+}
+
+func (a *api) trustedSubnetHandle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		subnets := a.current().TrustedSubnets
+		if len(subnets) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		ip := agentIP(r)
+		if ip != nil {
+			for _, subnet := range subnets {
+				if subnet.Contains(ip) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+		auditLog(r).WithField("agent_ip", ip.String()).Warn("rejected request from untrusted address")
+		writeError(w, r, newError(http.StatusForbidden, codeForbidden, "address is not in a trusted subnet"))
+	})
+}
+
+// signedBodyHandle checks the HashSHA256 signature of the whole request body
+// together with its timestamp and nonce. Requests without the header are left
+// to the per-metric hash check unless signed bodies are required.
+func (a *api) signedBodyHandle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		settings := a.current()
+		sign := r.Header.Get(replay.HashHeader)
+		if sign == "" {
+			if settings.RequireSignedBody {
+				auditLog(r).Warn("rejected request without body signature")
+				writeErr(w, r, errKeyRequired, "")
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		keyID := r.Header.Get("X-Key-ID")
+		key, err := settings.keyByID(r, keyID)
+		if err != nil {
+			writeErr(w, r, err, "")
+			return
+		}
+		if key == "" {
+			writeErr(w, r, errKeyRequired, "")
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, newError(http.StatusBadRequest, codeInvalidBody, err.Error()))
+			return
+		}
+		timestamp := r.Header.Get(replay.TimestampHeader)
+		nonce := r.Header.Get(replay.NonceHeader)
+		if !replay.Verify(key, timestamp, nonce, r.URL.Path, body, sign) {
+			auditLog(r).Warn("rejected body signature")
+			selfmetrics.Add("rejected_hashes", 1)
+			writeErr(w, r, errHashMismatch, "")
+			return
+		}
+		if settings.ReplayGuard != nil {
+			seconds, errParse := strconv.ParseInt(timestamp, 10, 64)
+			if errParse != nil {
+				writeError(w, r, newError(http.StatusBadRequest, codeInvalidBody, "invalid timestamp: "+errParse.Error()))
+				return
+			}
+			errCheck := settings.ReplayGuard.Check(time.Unix(seconds, 0), nonce)
+			if errCheck != nil {
+				auditLog(r).WithError(errCheck).Warn("rejected signed request")
+				writeErr(w, r, errCheck, "")
+				return
+			}
+		}
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		ctx := context.WithValue(r.Context(), bodyVerifiedKey, true)
+		if keyID != "" && settings.Keyring != nil {
+			ctx = context.WithValue(ctx, keyIDKey, keyID)
+		}
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 func verifyHash(metric *model.Metrics, key string) error {
-	var data []byte
-	switch strings.ToLower(metric.MType) {
-	case model.GaugeType:
-		data = []byte(fmt.Sprintf("%s:gauge:%f", metric.ID, *metric.Value))
-	case model.CounterType:
-		data = []byte(fmt.Sprintf("%s:counter:%d", metric.ID, *metric.Delta))
-	default:
-		return errors.New("bad request")
+	data := metric.HashData()
+	if data == nil {
+		return errHashMismatch
 	}
+	return checkHMAC(data, metric.Hash, key)
+}
+
+// checkHMAC compares the hex HMAC-SHA256 sign of data with the key.
+func checkHMAC(data []byte, sign string, key string) error {
 	h := hmac.New(sha256.New, []byte(key))
 	h.Write(data)
-	sign := h.Sum(nil)
-	hash, err := hex.DecodeString(metric.Hash)
+	hash, err := hex.DecodeString(sign)
 	if err != nil {
-		return errors.New("bad request")
+		return errHashMismatch
 	}
-	if hmac.Equal(sign, hash) {
-		return nil
-	} else {
-		return errors.New("bad request")
+	if !hmac.Equal(h.Sum(nil), hash) {
+		return errHashMismatch
 	}
+	return nil
+}
+
+// metadataHashData is the signed content of a metadata entry. The text
+// fields are quoted, as they may contain the separator.
+func metadataHashData(metadata *model.Metadata) []byte {
+	return []byte(fmt.Sprintf("%s:metadata:%s:%q:%q:%q", metadata.ID, strings.ToLower(metadata.Type),
+		metadata.Unit, metadata.Description, metadata.Owner))
 }
 
 func hash(metric *model.Metrics, key string) {
-	var data []byte
-	switch strings.ToLower(metric.MType) {
-	case model.GaugeType:
-		data = []byte(fmt.Sprintf("%s:gauge:%f", metric.ID, *metric.Value))
-	case model.CounterType:
-		data = []byte(fmt.Sprintf("%s:counter:%d", metric.ID, *metric.Delta))
-	default:
+	data := metric.HashData()
+	if data == nil {
 		return
 	}
 	h := hmac.New(sha256.New, []byte(key))
@@ -368,15 +622,54 @@ func hash(metric *model.Metrics, key string) {
 	metric.Hash = hex.EncodeToString(h.Sum(nil))
 }
 
-func (a *api) Run(addr string) error {
+// routes registers the middlewares and handlers. Every route is documented
+// in openapi.json.
+func (a *api) routes() {
+	a.r.Use(logHandle)
+	a.r.Use(instrumentHandle)
 	a.r.Use(gzipCompressHandle)
+	a.r.Use(a.decryptHandle)
 	a.r.Use(gzipDecompressHandle)
-	a.r.Post("/update/{type}/{name}/{value}", a.updateHandle)
+	a.r.Group(func(r chi.Router) {
+		r.Use(a.trustedSubnetHandle)
+		r.Use(a.signedBodyHandle)
+		r.Use(sourceHandle)
+		r.Post("/update/{type}/{name}/{value}", a.updateHandle)
+		r.Post("/update/", a.jsonUpdateHandle)
+		r.Post("/updates/", a.updatesHandle)
+		r.Post("/import", a.importHandle)
+		r.Post("/metadata/", a.setMetadataHandle)
+	})
 	a.r.Get("/value/{type}/{name}", a.getValueHandle)
-	a.r.Post("/update/", a.jsonUpdateHandle)
-	a.r.Post("/updates/", a.updatesHandle)
 	a.r.Post("/value/", a.getJSONValueHandle)
+	a.r.Get("/export", a.exportHandle)
+	a.r.Get("/metadata/", a.listMetadataHandle)
+	a.r.Get("/metadata/{name}", a.getMetadataHandle)
 	a.r.Get("/", a.getMetricsHandle)
 	a.r.Get("/ping", a.pingStoreHandle)
-	return http.ListenAndServe(addr, a.r)
+	a.r.Get("/healthz", a.healthHandle(a.liveness))
+	a.r.Get("/readyz", a.healthHandle(a.readiness))
+	a.r.Get("/metrics", a.prometheusHandle)
+	a.r.Get("/openapi.json", a.openAPIHandle)
+}
+
+// Run serves the api until Shutdown, after which it returns
+// http.ErrServerClosed.
+func (a *api) Run(addr string) error {
+	a.routes()
+	server := &http.Server{Addr: addr, Handler: a.r, TLSConfig: a.tlsConfig}
+	a.server.Store(server)
+	if a.tlsConfig != nil {
+		return server.ListenAndServeTLS("", "")
+	}
+	return server.ListenAndServe()
+}
+
+// Shutdown stops accepting requests and waits for the running ones.
+func (a *api) Shutdown(ctx context.Context) error {
+	server, ok := a.server.Load().(*http.Server)
+	if !ok {
+		return nil
+	}
+	return server.Shutdown(ctx)
 }
@@ -2,17 +2,27 @@ package api
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"testing"
+	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/NikWaltz/metrics-collector/internal/encryption"
+	"github.com/NikWaltz/metrics-collector/internal/keyring"
+	"github.com/NikWaltz/metrics-collector/internal/replay"
+	"github.com/NikWaltz/metrics-collector/internal/service"
 	"github.com/NikWaltz/metrics-collector/model"
 )
 
@@ -31,12 +41,56 @@ func (c mockCollector) GetGauge(ctx context.Context, name string) (model.Gauge,
 func (c mockCollector) GetCounter(ctx context.Context, name string) (model.Counter, error) {
 	return c.st.Counters[name], c.err
 }
+func (c mockCollector) GetHistogram(ctx context.Context, name string) (model.Histogram, error) {
+	value, ok := c.st.Histograms[name]
+	if !ok && c.err == nil {
+		return value, service.ErrNotFound
+	}
+	return value, c.err
+}
+
+func (c mockCollector) UpdateHistogram(ctx context.Context, name string, value model.Histogram) error {
+	return c.err
+}
+
+func (c mockCollector) AddGauge(ctx context.Context, name string, delta model.Gauge) error {
+	return c.err
+}
+
 func (c mockCollector) GetStorage(ctx context.Context) model.Storage {
 	return c.st
 }
 
+func (c mockCollector) Export(ctx context.Context) (model.Storage, error) {
+	return c.st, c.err
+}
+
+func (c mockCollector) Import(ctx context.Context, storage model.Storage, mode service.ImportMode) error {
+	return c.err
+}
+
+func (c mockCollector) SetMetadata(ctx context.Context, metadata model.Metadata) error {
+	return c.err
+}
+
+func (c mockCollector) GetMetadata(ctx context.Context, name string) (model.Metadata, error) {
+	value, ok := c.st.Metadata[name]
+	if !ok && c.err == nil {
+		return value, service.ErrNotFound
+	}
+	return value, c.err
+}
+
+func (c mockCollector) ListMetadata(ctx context.Context) ([]model.Metadata, error) {
+	var list []model.Metadata
+	for _, value := range c.st.Metadata {
+		list = append(list, value)
+	}
+	return list, c.err
+}
+
 func (c mockCollector) Ping(ctx context.Context) error {
-	return nil
+	return c.err
 }
 
 func (c mockCollector) Close() {
@@ -49,6 +103,7 @@ func Test_updateHandle(t *testing.T) {
 	tests := []struct {
 		name           string
 		fields         fields
+		path           string
 		wantStatusCode int
 	}{
 		{
@@ -57,15 +112,36 @@ func Test_updateHandle(t *testing.T) {
 			wantStatusCode: 200,
 		},
 		{
-			name:           "Handle with errors",
-			fields:         fields{mockCollector{err: errors.New("wrong types")}},
+			name:           "Handle invalid value",
+			fields:         fields{mockCollector{err: fmt.Errorf("%w: wrong value", service.ErrInvalidValue)}},
+			wantStatusCode: 400,
+		},
+		{
+			name:           "Handle unknown type",
+			fields:         fields{mockCollector{err: &service.TypeError{}}},
+			wantStatusCode: 501,
+		},
+		{
+			name:           "Handle storage failure",
+			fields:         fields{mockCollector{err: errors.New("connection refused")}},
+			wantStatusCode: 500,
+		},
+		{
+			name:           "Handle invalid name",
+			fields:         fields{mockCollector{err: nil}},
+			path:           "/update/gauge/na%20me/1",
 			wantStatusCode: 400,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			a := New(tt.fields.service, "")
-			assert.HTTPStatusCode(t, a.updateHandle, http.MethodPost, "/update/type/name/value", nil, tt.wantStatusCode)
+			a.r.Post("/update/{type}/{name}/{value}", a.updateHandle)
+			path := tt.path
+			if path == "" {
+				path = "/update/type/name/value"
+			}
+			assert.HTTPStatusCode(t, a.r.ServeHTTP, http.MethodPost, path, nil, tt.wantStatusCode)
 		})
 	}
 }
@@ -74,6 +150,12 @@ func Test_getValueHandle(t *testing.T) {
 	stor := model.Storage{
 		Gauges:   map[string]model.Gauge{"Alloc": 43.53234, "Mem": 72},
 		Counters: map[string]model.Counter{"PollCounter": 5},
+		Histograms: map[string]model.Histogram{"GCPause": {
+			Bounds: []float64{1, 2},
+			Counts: []int64{1, 0, 2},
+			Count:  3,
+			Sum:    9.5,
+		}},
 	}
 	type fields struct {
 		r       chi.Router
@@ -115,6 +197,20 @@ func Test_getValueHandle(t *testing.T) {
 			wantStatusCode: 200,
 			wantBody:       "43.53234",
 		},
+		{
+			name: "Get histogram value",
+			fields: fields{
+				r: chi.NewRouter(),
+				service: mockCollector{
+					err: nil,
+					st:  stor,
+				},
+			},
+			metricType:     model.HistogramType,
+			metricName:     "GCPause",
+			wantStatusCode: 200,
+			wantBody:       "{\"bounds\":[1,2],\"counts\":[1,0,2],\"count\":3,\"sum\":9.5}\n",
+		},
 		{
 			name: "Get wrong type",
 			fields: fields{
@@ -124,24 +220,24 @@ func Test_getValueHandle(t *testing.T) {
 					st:  stor,
 				},
 			},
-			metricType:     "histogram",
+			metricType:     "summary",
 			metricName:     "Alloc",
 			wantStatusCode: 404,
-			wantBody:       "",
+			wantBody:       "{\"code\":\"unknown_type\",\"message\":\"wrong metric type\",\"id\":\"Alloc\"}\n",
 		},
 		{
 			name: "Get wrong metric",
 			fields: fields{
 				r: chi.NewRouter(),
 				service: mockCollector{
-					err: errors.New("some error"),
+					err: service.ErrNotFound,
 					st:  stor,
 				},
 			},
 			metricType:     model.GaugeType,
 			metricName:     "Hello",
 			wantStatusCode: 404,
-			wantBody:       "",
+			wantBody:       "{\"code\":\"not_found\",\"message\":\"metric not exist\",\"id\":\"Hello\"}\n",
 		},
 	}
 	for _, tt := range tests {
@@ -209,11 +305,60 @@ func Test_jsonUpdateHandle(t *testing.T) {
 			},
 			wantStatusCode: 200,
 		},
+		{
+			name: "Update histogram",
+			metrics: model.Metrics{
+				ID:    "GCPause",
+				MType: "Histogram",
+				Histogram: &model.Histogram{
+					Bounds: []float64{1, 2},
+					Counts: []int64{1, 0, 0},
+					Count:  1,
+					Sum:    0.5,
+				},
+			},
+			fields: fields{
+				r: chi.NewRouter(),
+				service: mockCollector{
+					err: nil,
+				},
+			},
+			wantStatusCode: 200,
+		},
+		{
+			name: "Observe histogram value",
+			metrics: model.Metrics{
+				ID:    "GCPause",
+				MType: "Histogram",
+				Value: &floatValue,
+			},
+			fields: fields{
+				r: chi.NewRouter(),
+				service: mockCollector{
+					err: nil,
+				},
+			},
+			wantStatusCode: 200,
+		},
+		{
+			name: "Update histogram without data",
+			metrics: model.Metrics{
+				ID:    "GCPause",
+				MType: "Histogram",
+			},
+			fields: fields{
+				r: chi.NewRouter(),
+				service: mockCollector{
+					err: nil,
+				},
+			},
+			wantStatusCode: 400,
+		},
 		{
 			name: "Update wrong type",
 			metrics: model.Metrics{
 				ID:    "Metric",
-				MType: "Histogram",
+				MType: "Summary",
 				Value: &floatValue,
 			},
 			fields: fields{
@@ -255,6 +400,10 @@ func Test_getJsonValueHandle(t *testing.T) {
 	stor := model.Storage{
 		Gauges:   map[string]model.Gauge{"Alloc": 43.53234, "Mem": 72},
 		Counters: map[string]model.Counter{"PollCounter": 5},
+		Metadata: map[string]model.Metadata{
+			"Alloc":       {ID: "Alloc", Unit: "bytes", Description: "Bytes of\nallocated heap objects."},
+			"PollCounter": {ID: "PollCounter", Unit: "polls"},
+		},
 	}
 	type fields struct {
 		r       chi.Router
@@ -310,17 +459,17 @@ func Test_getJsonValueHandle(t *testing.T) {
 			},
 			metrics: model.Metrics{
 				ID:    "Alloc",
-				MType: "Histogram",
+				MType: "Summary",
 			},
 			wantStatusCode: 404,
-			wantBody:       "",
+			wantBody:       "{\"code\":\"unknown_type\",\"message\":\"wrong metric type\",\"id\":\"Alloc\"}\n",
 		},
 		{
 			name: "Get wrong metric",
 			fields: fields{
 				r: chi.NewRouter(),
 				service: mockCollector{
-					err: errors.New("some error"),
+					err: service.ErrNotFound,
 					st:  stor,
 				},
 			},
@@ -329,7 +478,7 @@ func Test_getJsonValueHandle(t *testing.T) {
 				MType: "Gauge",
 			},
 			wantStatusCode: 404,
-			wantBody:       "",
+			wantBody:       "{\"code\":\"not_found\",\"message\":\"metric not exist\",\"id\":\"Hello\"}\n",
 		},
 	}
 	for _, tt := range tests {
@@ -363,6 +512,10 @@ func Test_getMetricsHandle(t *testing.T) {
 	stor := model.Storage{
 		Gauges:   map[string]model.Gauge{"Alloc": 43.53234, "Mem": 72},
 		Counters: map[string]model.Counter{"PollCounter": 5},
+		Metadata: map[string]model.Metadata{
+			"Alloc":       {ID: "Alloc", Unit: "bytes", Description: "Bytes of\nallocated heap objects."},
+			"PollCounter": {ID: "PollCounter", Unit: "polls"},
+		},
 	}
 	type fields struct {
 		r       chi.Router
@@ -386,7 +539,7 @@ func Test_getMetricsHandle(t *testing.T) {
 				},
 			},
 			wantStatusCode: 200,
-			wantBody:       "Alloc 43.532340\nMem 72.000000\nPollCount 24\nPollCounter 5\n",
+			wantBody:       "Alloc 43.532340 bytes # Bytes of allocated heap objects.\nMem 72.000000\nPollCount 24\nPollCounter 5 polls\n",
 		},
 	}
 	for _, tt := range tests {
@@ -409,3 +562,550 @@ func Test_getMetricsHandle(t *testing.T) {
 		})
 	}
 }
+
+func Test_verifyHash_histogram(t *testing.T) {
+	metric := model.Metrics{ID: "Latency", MType: model.HistogramType, Histogram: &model.Histogram{
+		Bounds: []float64{0.0000001, 0.5}, Counts: []int64{1, 0, 1}, Count: 2, Sum: 1.0000001,
+	}}
+	hash(&metric, "key")
+	assert.NoError(t, verifyHash(&metric, "key"))
+
+	// Changes past the sixth decimal are signed too.
+	metric.Histogram.Sum = 1.0000002
+	assert.ErrorIs(t, verifyHash(&metric, "key"), errHashMismatch)
+	metric.Histogram.Sum = 1.0000001
+	metric.Histogram.Bounds[0] = 0.0000002
+	assert.ErrorIs(t, verifyHash(&metric, "key"), errHashMismatch)
+}
+
+func Test_jsonUpdateHandle_keyring(t *testing.T) {
+	ring, err := keyring.New([]keyring.Key{
+		{ID: "agent-1", Secret: "old-secret"},
+		{ID: "agent-1-v2", Secret: "new-secret"},
+		{ID: "agent-2", Secret: "revoked-secret", Revoked: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := func(keyID string, secret string) model.Metrics {
+		value := 12.5
+		metric := model.Metrics{ID: "Alloc", MType: model.GaugeType, Value: &value, KeyID: keyID}
+		hash(&metric, secret)
+		return metric
+	}
+	tests := []struct {
+		name           string
+		sharedKey      string
+		metrics        model.Metrics
+		header         string
+		wantStatusCode int
+	}{
+		{
+			name:           "Accept key being rotated out",
+			metrics:        signed("agent-1", "old-secret"),
+			wantStatusCode: 200,
+		},
+		{
+			name:           "Accept new key",
+			metrics:        signed("agent-1-v2", "new-secret"),
+			wantStatusCode: 200,
+		},
+		{
+			name:           "Accept key id from header",
+			metrics:        signed("", "new-secret"),
+			header:         "agent-1-v2",
+			wantStatusCode: 200,
+		},
+		{
+			name:           "Reject wrong secret",
+			metrics:        signed("agent-1", "new-secret"),
+			wantStatusCode: 400,
+		},
+		{
+			name:           "Reject revoked key",
+			metrics:        signed("agent-2", "revoked-secret"),
+			wantStatusCode: 403,
+		},
+		{
+			name:           "Reject unknown key",
+			metrics:        signed("agent-3", "secret"),
+			wantStatusCode: 403,
+		},
+		{
+			name:           "Reject unsigned metric",
+			metrics:        signed("", ""),
+			wantStatusCode: 403,
+		},
+		{
+			name:           "Reject shared key without key id",
+			sharedKey:      "shared",
+			metrics:        signed("", "shared"),
+			wantStatusCode: 403,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(mockCollector{}, tt.sharedKey)
+			a.Reload(Settings{Key: tt.sharedKey, Keyring: ring})
+			a.r.Post("/update/", a.jsonUpdateHandle)
+			body := new(bytes.Buffer)
+			err := json.NewEncoder(body).Encode(tt.metrics)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req, err := http.NewRequest(http.MethodPost, "/update/", body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if tt.header != "" {
+				req.Header.Set("X-Key-ID", tt.header)
+			}
+			rr := httptest.NewRecorder()
+			a.r.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.wantStatusCode, rr.Code)
+		})
+	}
+}
+
+func Test_signedBodyHandle(t *testing.T) {
+	value := 12.5
+	body, err := json.Marshal([]model.Metrics{{ID: "Alloc", MType: model.GaugeType, Value: &value}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	tests := []struct {
+		name           string
+		required       bool
+		timestamp      string
+		nonce          string
+		sign           string
+		wantStatusCode int
+	}{
+		{
+			name:           "Accept signed body",
+			timestamp:      now,
+			nonce:          "n1",
+			sign:           replay.Sign("key", now, "n1", "/updates/", body),
+			wantStatusCode: 200,
+		},
+		{
+			name:           "Reject replayed nonce",
+			timestamp:      now,
+			nonce:          "n1",
+			sign:           replay.Sign("key", now, "n1", "/updates/", body),
+			wantStatusCode: 403,
+		},
+		{
+			name:           "Reject stale timestamp",
+			timestamp:      old,
+			nonce:          "n2",
+			sign:           replay.Sign("key", old, "n2", "/updates/", body),
+			wantStatusCode: 403,
+		},
+		{
+			name:           "Reject wrong signature",
+			timestamp:      now,
+			nonce:          "n3",
+			sign:           replay.Sign("other", now, "n3", "/updates/", body),
+			wantStatusCode: 400,
+		},
+		{
+			name:           "Reject per-metric hash when signed body is required",
+			required:       true,
+			wantStatusCode: 403,
+		},
+	}
+	a := New(mockCollector{}, "key")
+	a.r.Group(func(r chi.Router) {
+		r.Use(a.signedBodyHandle)
+		r.Post("/updates/", a.updatesHandle)
+	})
+	guard := replay.NewGuard(time.Minute)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a.Reload(Settings{Key: "key", ReplayGuard: guard, RequireSignedBody: tt.required})
+			req, err := http.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if tt.sign != "" {
+				req.Header.Set(replay.TimestampHeader, tt.timestamp)
+				req.Header.Set(replay.NonceHeader, tt.nonce)
+				req.Header.Set(replay.HashHeader, tt.sign)
+			}
+			rr := httptest.NewRecorder()
+			a.r.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.wantStatusCode, rr.Code)
+		})
+	}
+}
+
+func Test_signedBodyHandle_source(t *testing.T) {
+	ring, err := keyring.New([]keyring.Key{{ID: "agent-1", Secret: "secret"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := []byte(`[]`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	a := New(mockCollector{}, "")
+	a.Reload(Settings{Keyring: ring})
+	var got string
+	a.r.Group(func(r chi.Router) {
+		r.Use(a.signedBodyHandle)
+		r.Use(sourceHandle)
+		r.Post("/updates/", func(w http.ResponseWriter, r *http.Request) {
+			got = service.SourceOf(r.Context())
+		})
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+	req.RemoteAddr = "10.0.0.2:5555"
+	req.Header.Set("X-Key-ID", "agent-1")
+	req.Header.Set(replay.TimestampHeader, now)
+	req.Header.Set(replay.NonceHeader, "n1")
+	req.Header.Set(replay.HashHeader, replay.Sign("secret", now, "n1", "/updates/", body))
+	a.r.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "agent-1", got)
+
+	// Without a body signature the key id is only checked per metric.
+	req = httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+	req.RemoteAddr = "10.0.0.2:5555"
+	req.Header.Set("X-Key-ID", "agent-1")
+	a.r.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, "10.0.0.2", got)
+
+	// With a keyring, the shared key is not accepted.
+	a.Reload(Settings{Key: "shared", Keyring: ring})
+	got = ""
+	req = httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+	req.Header.Set(replay.TimestampHeader, now)
+	req.Header.Set(replay.NonceHeader, "n2")
+	req.Header.Set(replay.HashHeader, replay.Sign("shared", now, "n2", "/updates/", body))
+	rr := httptest.NewRecorder()
+	a.r.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusForbidden, rr.Code)
+	assert.Equal(t, "", got)
+}
+
+func Test_decryptHandle(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := 12.5
+	metrics := make([]model.Metrics, 100)
+	for i := range metrics {
+		metrics[i] = model.Metrics{ID: fmt.Sprintf("Metric%d", i), MType: model.GaugeType, Value: &value}
+	}
+	batch, err := json.Marshal(metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	single, err := json.Marshal(metrics[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	_, err = gz.Write(batch)
+	assert.NoError(t, err)
+	assert.NoError(t, gz.Close())
+
+	tests := []struct {
+		name           string
+		body           []byte
+		gzip           bool
+		encrypt        bool
+		privateKey     *rsa.PrivateKey
+		wantStatusCode int
+	}{
+		{name: "Decrypt small body", body: single, encrypt: true, privateKey: key, wantStatusCode: 200},
+		{name: "Decrypt large batch", body: batch, encrypt: true, privateKey: key, wantStatusCode: 200},
+		{name: "Decrypt compressed batch", body: compressed.Bytes(), gzip: true, encrypt: true, privateKey: key, wantStatusCode: 200},
+		{name: "Pass plain body", body: batch, privateKey: key, wantStatusCode: 200},
+		{name: "Reject encrypted body without key", body: single, encrypt: true, wantStatusCode: 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(mockCollector{}, "")
+			a.SetPrivateKey(tt.privateKey)
+			a.r.Use(a.decryptHandle)
+			a.r.Use(gzipDecompressHandle)
+			a.r.Post("/updates/", a.updatesHandle)
+
+			body := tt.body
+			scheme := ""
+			if tt.encrypt {
+				scheme, body, err = encryption.Encrypt(&key.PublicKey, tt.body)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			req, err := http.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if tt.gzip {
+				req.Header.Set("Content-Encoding", "gzip")
+			}
+			if scheme != "" {
+				req.Header.Set(encryption.Header, scheme)
+			}
+			rr := httptest.NewRecorder()
+			a.r.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.wantStatusCode, rr.Code)
+		})
+	}
+}
+
+func Test_trustedSubnetHandle(t *testing.T) {
+	_, agents, err := net.ParseCIDR("192.168.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, local, err := net.ParseCIDR("127.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name           string
+		subnets        []*net.IPNet
+		realIP         string
+		remoteAddr     string
+		wantStatusCode int
+	}{
+		{
+			name:           "Allow everything without subnets",
+			realIP:         "10.0.0.1",
+			remoteAddr:     "10.0.0.1:5555",
+			wantStatusCode: 200,
+		},
+		{
+			name:           "Allow real ip in subnet",
+			subnets:        []*net.IPNet{agents},
+			realIP:         "192.168.1.20",
+			remoteAddr:     "10.0.0.1:5555",
+			wantStatusCode: 200,
+		},
+		{
+			name:           "Reject real ip outside subnet",
+			subnets:        []*net.IPNet{agents},
+			realIP:         "192.168.2.20",
+			remoteAddr:     "192.168.1.20:5555",
+			wantStatusCode: 403,
+		},
+		{
+			name:           "Allow remote address from second subnet",
+			subnets:        []*net.IPNet{agents, local},
+			remoteAddr:     "127.0.0.1:5555",
+			wantStatusCode: 200,
+		},
+		{
+			name:           "Reject malformed real ip",
+			subnets:        []*net.IPNet{agents},
+			realIP:         "agent-1",
+			remoteAddr:     "192.168.1.20:5555",
+			wantStatusCode: 403,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(mockCollector{}, "")
+			a.Reload(Settings{TrustedSubnets: tt.subnets})
+			a.r.With(a.trustedSubnetHandle).Post("/update/{type}/{name}/{value}", a.updateHandle)
+
+			req, err := http.NewRequest(http.MethodPost, "/update/gauge/Alloc/1", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.RemoteAddr = tt.remoteAddr
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			rr := httptest.NewRecorder()
+			a.r.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.wantStatusCode, rr.Code)
+		})
+	}
+}
+
+func Test_logHandle(t *testing.T) {
+	tests := []struct {
+		name      string
+		requestID string
+	}{
+		{
+			name:      "Keep request id of the client",
+			requestID: "agent-42",
+		},
+		{
+			name: "Generate request id",
+		},
+	}
+	r := chi.NewRouter()
+	r.Use(logHandle)
+	r.Get("/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodGet, "/ping", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.requestID != "" {
+				req.Header.Set(requestIDHeader, tt.requestID)
+			}
+			rr := httptest.NewRecorder()
+			r.ServeHTTP(rr, req)
+
+			assert.Equal(t, http.StatusOK, rr.Code)
+			if tt.requestID != "" {
+				assert.Equal(t, tt.requestID, rr.Header().Get(requestIDHeader))
+			} else {
+				assert.NotEmpty(t, rr.Header().Get(requestIDHeader))
+			}
+		})
+	}
+}
+
+func Test_updatesHandle(t *testing.T) {
+	value := 1.5
+	delta := int64(2)
+	tests := []struct {
+		name           string
+		contentType    string
+		body           string
+		metrics        []model.Metrics
+		wantStatusCode int
+		wantResponse   updatesResponse
+		wantError      apiError
+	}{
+		{
+			name:        "All accepted",
+			contentType: "application/json",
+			metrics: []model.Metrics{
+				{ID: "Alloc", MType: model.GaugeType, Value: &value},
+				{ID: "PollCount", MType: model.CounterType, Delta: &delta},
+			},
+			wantStatusCode: http.StatusOK,
+			wantResponse: updatesResponse{Accepted: 2, Results: []updateResult{
+				{ID: "Alloc", Type: model.GaugeType, Status: http.StatusOK},
+				{ID: "PollCount", Type: model.CounterType, Status: http.StatusOK},
+			}},
+		},
+		{
+			name:        "Partially rejected",
+			contentType: "application/json",
+			metrics: []model.Metrics{
+				{ID: "Alloc", MType: model.GaugeType, Value: &value},
+				{ID: "Requests", MType: "summary", Value: &value},
+				{ID: "Latency", MType: model.HistogramType},
+			},
+			wantStatusCode: http.StatusMultiStatus,
+			wantResponse: updatesResponse{Accepted: 1, Rejected: 2, Results: []updateResult{
+				{ID: "Alloc", Type: model.GaugeType, Status: http.StatusOK},
+				{ID: "Requests", Type: "summary", Status: http.StatusNotImplemented, Error: &apiError{
+					Code: codeUnknownType, Message: "wrong metric type", ID: "Requests",
+				}},
+				{ID: "Latency", Type: model.HistogramType, Status: http.StatusBadRequest, Error: &apiError{
+					Code: codeInvalidMetric, Message: "invalid metric: histogram requires either histogram or value", ID: "Latency",
+				}},
+			}},
+		},
+		{
+			name:           "Invalid JSON",
+			contentType:    "application/json",
+			body:           `[{"id":`,
+			wantStatusCode: http.StatusBadRequest,
+			wantError:      apiError{Code: codeInvalidJSON, Message: "unexpected EOF"},
+		},
+		{
+			name:           "Wrong content type",
+			contentType:    "text/plain",
+			body:           `[]`,
+			wantStatusCode: http.StatusUnsupportedMediaType,
+			wantError:      apiError{Code: codeUnsupportedMediaType, Message: "Content-Type header is not application/json"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(mockCollector{}, "")
+			a.r.Post("/updates/", a.updatesHandle)
+			body := []byte(tt.body)
+			if tt.metrics != nil {
+				var err error
+				body, err = json.Marshal(tt.metrics)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			req, err := http.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", tt.contentType)
+			rr := httptest.NewRecorder()
+			a.r.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.wantStatusCode, rr.Code)
+			assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+			if tt.metrics != nil {
+				var response updatesResponse
+				assert.NoError(t, json.NewDecoder(rr.Body).Decode(&response))
+				assert.Equal(t, tt.wantResponse, response)
+			} else {
+				var e apiError
+				assert.NoError(t, json.NewDecoder(rr.Body).Decode(&e))
+				assert.Equal(t, tt.wantError, e)
+			}
+		})
+	}
+}
+
+func Test_sourceHandle(t *testing.T) {
+	tests := []struct {
+		name       string
+		keyID      string
+		verified   bool
+		realIP     string
+		remoteAddr string
+		want       string
+	}{
+		{name: "Verified key id", keyID: "agent-1", verified: true, realIP: "10.0.0.1", remoteAddr: "10.0.0.2:5555", want: "agent-1"},
+		{name: "Unverified key id", keyID: "agent-1", realIP: "10.0.0.1", remoteAddr: "10.0.0.2:5555", want: "10.0.0.1"},
+		{name: "Real ip", realIP: "10.0.0.1", remoteAddr: "10.0.0.2:5555", want: "10.0.0.1"},
+		{name: "Connection", remoteAddr: "10.0.0.2:5555", want: "10.0.0.2"},
+		{name: "Unknown", remoteAddr: "pipe", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			handler := sourceHandle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = service.SourceOf(r.Context())
+			}))
+			req := httptest.NewRequest(http.MethodPost, "/update/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.keyID != "" {
+				req.Header.Set("X-Key-ID", tt.keyID)
+			}
+			if tt.verified {
+				req = req.WithContext(context.WithValue(req.Context(), keyIDKey, tt.keyID))
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/golang/gddo/httputil/header"
+
+	"github.com/NikWaltz/metrics-collector/internal/dump"
+	"github.com/NikWaltz/metrics-collector/internal/selfmetrics"
+	"github.com/NikWaltz/metrics-collector/internal/service"
+)
+
+type importResponse struct {
+	Mode     service.ImportMode `json:"mode"`
+	Imported int                `json:"imported"`
+}
+
+// exportHandle writes all metrics as NDJSON, or as CSV with ?format=csv.
+func (a *api) exportHandle(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = dump.FormatNDJSON
+	}
+	if format != dump.FormatNDJSON && format != dump.FormatCSV {
+		writeError(w, r, newError(http.StatusBadRequest, codeInvalidBody, fmt.Sprintf("unknown format %q", format)))
+		return
+	}
+	storage, err := a.service.Export(r.Context())
+	if err != nil {
+		writeErr(w, r, err, "")
+		return
+	}
+	w.Header().Set("Content-Type", dump.ContentType(format))
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="metrics.%s"`, format))
+	w.WriteHeader(http.StatusOK)
+	if errWrite := dump.Write(w, format, dump.Metrics(storage)); errWrite != nil {
+		requestLog(r).Error(errWrite)
+	}
+}
+
+// importHandle writes an export in NDJSON or CSV into the backend. Counters
+// and histograms replace the stored ones unless ?mode=add. The import is
+// rejected as a whole when any metric is invalid or fails its hash check.
+func (a *api) importHandle(w http.ResponseWriter, r *http.Request) {
+	mode, err := service.ParseImportMode(r.URL.Query().Get("mode"))
+	if err != nil {
+		writeErr(w, r, err, "")
+		return
+	}
+	contentType, _ := header.ParseValueAndParams(r.Header, "Content-Type")
+	format := dump.FormatOf(contentType)
+	if format == "" {
+		writeError(w, r, newError(http.StatusUnsupportedMediaType, codeUnsupportedMediaType,
+			"Content-Type header is not application/x-ndjson or text/csv"))
+		return
+	}
+	metrics, err := dump.Read(r.Body, format)
+	if err != nil {
+		selfmetrics.Add("decode_errors", 1)
+		writeError(w, r, newError(http.StatusBadRequest, codeInvalidBody, err.Error()))
+		return
+	}
+
+	settings := a.current()
+	for i := range metrics {
+		metric := &metrics[i]
+		if errValidate := validateMetric(metric); errValidate != nil {
+			writeErr(w, r, errValidate, metric.ID)
+			return
+		}
+		if errHash := settings.verifyMetric(r, metric); errHash != nil {
+			selfmetrics.Add("rejected_hashes", 1)
+			writeErr(w, r, errHash, metric.ID)
+			return
+		}
+	}
+	storage, err := dump.Storage(metrics)
+	if err != nil {
+		writeError(w, r, newError(http.StatusBadRequest, codeInvalidMetric, err.Error()))
+		return
+	}
+	if errImport := a.service.Import(r.Context(), storage, mode); errImport != nil {
+		writeErr(w, r, errImport, "")
+		return
+	}
+	requestLog(r).WithField("mode", mode).WithField("metrics", len(metrics)).Info("metrics imported")
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if errEncode := json.NewEncoder(w).Encode(importResponse{Mode: mode, Imported: len(metrics)}); errEncode != nil {
+		requestLog(r).Error(errEncode)
+	}
+}
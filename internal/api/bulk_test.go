@@ -0,0 +1,169 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NikWaltz/metrics-collector/internal/service"
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+// importCollector keeps the last import.
+type importCollector struct {
+	mockCollector
+	storage *model.Storage
+	mode    *service.ImportMode
+}
+
+func (c importCollector) Import(ctx context.Context, storage model.Storage, mode service.ImportMode) error {
+	*c.storage, *c.mode = storage, mode
+	return c.err
+}
+
+func Test_exportHandle(t *testing.T) {
+	stor := model.Storage{
+		Gauges:   map[string]model.Gauge{"Alloc": 1.5},
+		Counters: map[string]model.Counter{"PollCount": 5},
+	}
+	tests := []struct {
+		name            string
+		query           string
+		service         Collector
+		wantStatusCode  int
+		wantContentType string
+		wantBody        string
+	}{
+		{
+			name:            "NDJSON by default",
+			service:         mockCollector{st: stor},
+			wantStatusCode:  http.StatusOK,
+			wantContentType: "application/x-ndjson",
+			wantBody:        "{\"id\":\"PollCount\",\"type\":\"counter\",\"delta\":5}\n{\"id\":\"Alloc\",\"type\":\"gauge\",\"value\":1.5}\n",
+		},
+		{
+			name:            "CSV",
+			query:           "?format=csv",
+			service:         mockCollector{st: stor},
+			wantStatusCode:  http.StatusOK,
+			wantContentType: "text/csv",
+			wantBody:        "id,type,value\nPollCount,counter,5\nAlloc,gauge,1.5\n",
+		},
+		{
+			name:            "Unknown format",
+			query:           "?format=xml",
+			service:         mockCollector{st: stor},
+			wantStatusCode:  http.StatusBadRequest,
+			wantContentType: "application/json",
+		},
+		{
+			name:            "Storage failure",
+			service:         mockCollector{err: errors.New("connection refused")},
+			wantStatusCode:  http.StatusInternalServerError,
+			wantContentType: "application/json",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(tt.service, "")
+			a.r.Get("/export", a.exportHandle)
+
+			req, err := http.NewRequest(http.MethodGet, "/export"+tt.query, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			a.r.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.wantStatusCode, rr.Code)
+			assert.Equal(t, tt.wantContentType, rr.Header().Get("Content-Type"))
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, rr.Body.String())
+			}
+		})
+	}
+}
+
+func Test_importHandle(t *testing.T) {
+	tests := []struct {
+		name           string
+		query          string
+		contentType    string
+		body           string
+		key            string
+		wantStatusCode int
+		wantMode       service.ImportMode
+		wantCounters   map[string]model.Counter
+	}{
+		{
+			name:           "Import NDJSON",
+			contentType:    "application/x-ndjson",
+			body:           "{\"id\":\"PollCount\",\"type\":\"counter\",\"delta\":5}\n{\"id\":\"Alloc\",\"type\":\"gauge\",\"value\":1.5}\n",
+			wantStatusCode: http.StatusOK,
+			wantMode:       service.ImportReplace,
+			wantCounters:   map[string]model.Counter{"PollCount": 5},
+		},
+		{
+			name:           "Add CSV",
+			query:          "?mode=add",
+			contentType:    "text/csv",
+			body:           "id,type,value\nPollCount,counter,5\n",
+			wantStatusCode: http.StatusOK,
+			wantMode:       service.ImportAdd,
+			wantCounters:   map[string]model.Counter{"PollCount": 5},
+		},
+		{
+			name:           "Unknown mode",
+			query:          "?mode=merge",
+			contentType:    "text/csv",
+			body:           "PollCount,counter,5\n",
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "Unsupported content type",
+			contentType:    "application/json",
+			body:           "[]",
+			wantStatusCode: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:           "Invalid metric rejects the import",
+			contentType:    "application/x-ndjson",
+			body:           "{\"id\":\"PollCount\",\"type\":\"counter\",\"delta\":5}\n{\"id\":\"Alloc\",\"type\":\"gauge\"}\n",
+			wantStatusCode: http.StatusBadRequest,
+		},
+		{
+			name:           "Unsigned metrics with a key",
+			contentType:    "text/csv",
+			body:           "PollCount,counter,5\n",
+			key:            "secret",
+			wantStatusCode: http.StatusBadRequest,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var storage model.Storage
+			var mode service.ImportMode
+			a := New(importCollector{storage: &storage, mode: &mode}, tt.key)
+			a.r.Post("/import", a.importHandle)
+
+			req, err := http.NewRequest(http.MethodPost, "/import"+tt.query, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", tt.contentType)
+			rr := httptest.NewRecorder()
+			a.r.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.wantStatusCode, rr.Code)
+			assert.Equal(t, tt.wantMode, mode)
+			if tt.wantCounters != nil {
+				assert.Equal(t, tt.wantCounters, storage.Counters)
+			}
+		})
+	}
+}
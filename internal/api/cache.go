@@ -0,0 +1,248 @@
+package api
+
+import (
+	"container/list"
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NikWaltz/metrics-collector/internal/selfmetrics"
+	"github.com/NikWaltz/metrics-collector/internal/service"
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+// DefaultCacheSize is the number of metrics a cache keeps when no size is
+// given.
+const DefaultCacheSize = 10000
+
+type cacheEntry struct {
+	key     string
+	value   interface{}
+	expires time.Time
+}
+
+// cachedCollector keeps the metrics read from the collector for a while.
+// Gauges are written through. Counters and histograms are dropped on writes
+// instead, as their new value depends on what other servers sharing the
+// storage have added.
+type cachedCollector struct {
+	Collector
+	ttl  time.Duration
+	size int
+	now  func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	// generation grows with every write and invalidation. A read of the
+	// collector is only cached when no write happened meanwhile, otherwise
+	// it could cache a value older than the write.
+	generation uint64
+}
+
+// Cache keeps up to size metrics read from the collector for ttl. A size of
+// 0 means DefaultCacheSize.
+func Cache(collector Collector, ttl time.Duration, size int) *cachedCollector {
+	if size <= 0 {
+		size = DefaultCacheSize
+	}
+	c := &cachedCollector{
+		Collector: collector,
+		ttl:       ttl,
+		size:      size,
+		now:       time.Now,
+		entries:   make(map[string]*list.Element),
+		lru:       list.New(),
+	}
+	selfmetrics.RegisterGauge("cache.entries", func() float64 {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return float64(c.lru.Len())
+	})
+	return c
+}
+
+func cacheKey(metricType string, name string) string {
+	return metricType + "/" + name
+}
+
+// get returns the cached value of the key and the generation to store a
+// value read from the collector with.
+func (c *cachedCollector) get(key string) (interface{}, bool, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*cacheEntry)
+		if c.now().Before(entry.expires) {
+			c.lru.MoveToFront(element)
+			selfmetrics.Add("cache.hits", 1)
+			return entry.value, true, c.generation
+		}
+		c.remove(element)
+	}
+	selfmetrics.Add("cache.misses", 1)
+	return nil, false, c.generation
+}
+
+// put caches the value unless a write happened since generation.
+func (c *cachedCollector) put(key string, value interface{}, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	c.set(key, value)
+}
+
+func (c *cachedCollector) set(key string, value interface{}) {
+	expires := c.now().Add(c.ttl)
+	if element, ok := c.entries[key]; ok {
+		element.Value = &cacheEntry{key: key, value: value, expires: expires}
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, value: value, expires: expires})
+	for c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+		selfmetrics.Add("cache.evictions", 1)
+	}
+}
+
+func (c *cachedCollector) remove(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*cacheEntry).key)
+}
+
+// written updates the cache after a write of the key that started at
+// generation. The value is only written through when no other write
+// happened meanwhile, as the order of the two in the collector is unknown.
+func (c *cachedCollector) written(key string, value interface{}, through bool, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if through && generation == c.generation {
+		c.set(key, value)
+	} else if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+	c.generation++
+}
+
+func (c *cachedCollector) currentGeneration() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generation
+}
+
+// Invalidate drops a metric from the cache, or all metrics when metricType
+// is empty. It is called for changes made by other servers.
+func (c *cachedCollector) Invalidate(metricType string, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	if metricType == "" {
+		c.entries = make(map[string]*list.Element)
+		c.lru.Init()
+		return
+	}
+	if element, ok := c.entries[cacheKey(metricType, name)]; ok {
+		c.remove(element)
+	}
+}
+
+// retyped drops the other types of a metric after a write of metricType,
+// which may have deleted them, see service.ConflictMigrate.
+func (c *cachedCollector) retyped(metricType string, name string) {
+	for _, other := range []string{model.GaugeType, model.CounterType, model.HistogramType} {
+		if other != metricType {
+			c.Invalidate(other, name)
+		}
+	}
+}
+
+func (c *cachedCollector) GetGauge(ctx context.Context, name string) (model.Gauge, error) {
+	key := cacheKey(model.GaugeType, name)
+	cached, ok, generation := c.get(key)
+	if ok {
+		return cached.(model.Gauge), nil
+	}
+	value, err := c.Collector.GetGauge(ctx, name)
+	if err == nil {
+		c.put(key, value, generation)
+	}
+	return value, err
+}
+
+func (c *cachedCollector) GetCounter(ctx context.Context, name string) (model.Counter, error) {
+	key := cacheKey(model.CounterType, name)
+	cached, ok, generation := c.get(key)
+	if ok {
+		return cached.(model.Counter), nil
+	}
+	value, err := c.Collector.GetCounter(ctx, name)
+	if err == nil {
+		c.put(key, value, generation)
+	}
+	return value, err
+}
+
+func (c *cachedCollector) GetHistogram(ctx context.Context, name string) (model.Histogram, error) {
+	key := cacheKey(model.HistogramType, name)
+	cached, ok, generation := c.get(key)
+	if ok {
+		return cached.(model.Histogram).Copy(), nil
+	}
+	value, err := c.Collector.GetHistogram(ctx, name)
+	if err == nil {
+		c.put(key, value.Copy(), generation)
+	}
+	return value, err
+}
+
+func (c *cachedCollector) Update(ctx context.Context, metricType string, name string, value string) error {
+	generation := c.currentGeneration()
+	err := c.Collector.Update(ctx, metricType, name, value)
+	metricType = strings.ToLower(metricType)
+	key := cacheKey(metricType, name)
+	if err != nil {
+		// A failed write may still have reached the storage.
+		c.written(key, nil, false, generation)
+		return err
+	}
+	if metricType == model.GaugeType {
+		gauge, errParse := strconv.ParseFloat(value, 64)
+		c.written(key, model.Gauge(gauge), errParse == nil, generation)
+	} else {
+		c.written(key, nil, false, generation)
+	}
+	c.retyped(metricType, name)
+	return nil
+}
+
+func (c *cachedCollector) UpdateHistogram(ctx context.Context, name string, histogram model.Histogram) error {
+	err := c.Collector.UpdateHistogram(ctx, name, histogram)
+	c.Invalidate(model.HistogramType, name)
+	if err == nil {
+		c.retyped(model.HistogramType, name)
+	}
+	return err
+}
+
+func (c *cachedCollector) AddGauge(ctx context.Context, name string, delta model.Gauge) error {
+	err := c.Collector.AddGauge(ctx, name, delta)
+	c.Invalidate(model.GaugeType, name)
+	if err == nil {
+		c.retyped(model.GaugeType, name)
+	}
+	return err
+}
+
+func (c *cachedCollector) Import(ctx context.Context, storage model.Storage, mode service.ImportMode) error {
+	err := c.Collector.Import(ctx, storage, mode)
+	// Metadata is not cached.
+	if len(storage.Gauges)+len(storage.Counters)+len(storage.Histograms) > 0 {
+		c.Invalidate("", "")
+	}
+	return err
+}
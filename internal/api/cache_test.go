@@ -0,0 +1,201 @@
+package api
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NikWaltz/metrics-collector/internal/service"
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+// readCounter counts the reads that reach the collector.
+type readCounter struct {
+	Collector
+	reads int64
+	// onRead runs before a read returns.
+	onRead func()
+}
+
+func (c *readCounter) GetGauge(ctx context.Context, name string) (model.Gauge, error) {
+	atomic.AddInt64(&c.reads, 1)
+	value, err := c.Collector.GetGauge(ctx, name)
+	if c.onRead != nil {
+		c.onRead()
+	}
+	return value, err
+}
+
+func (c *readCounter) GetCounter(ctx context.Context, name string) (model.Counter, error) {
+	atomic.AddInt64(&c.reads, 1)
+	value, err := c.Collector.GetCounter(ctx, name)
+	if c.onRead != nil {
+		c.onRead()
+	}
+	return value, err
+}
+
+func (c *readCounter) GetHistogram(ctx context.Context, name string) (model.Histogram, error) {
+	atomic.AddInt64(&c.reads, 1)
+	return c.Collector.GetHistogram(ctx, name)
+}
+
+func newTestCache(size int) (*cachedCollector, *readCounter, *time.Time) {
+	backend := &readCounter{Collector: service.NewService(model.NewStorage())}
+	c := Cache(backend, time.Minute, size)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.now = func() time.Time { return now }
+	return c, backend, &now
+}
+
+func TestCache_counterIncrements(t *testing.T) {
+	ctx := context.Background()
+	c, backend, _ := newTestCache(0)
+	assert.NoError(t, c.Update(ctx, "counter", "PollCount", "1"))
+
+	for i := 0; i < 3; i++ {
+		value, err := c.GetCounter(ctx, "PollCount")
+		assert.NoError(t, err)
+		assert.Equal(t, model.Counter(1), value)
+	}
+	assert.Equal(t, int64(1), backend.reads)
+
+	assert.NoError(t, c.Update(ctx, "Counter", "PollCount", "5"))
+	value, err := c.GetCounter(ctx, "PollCount")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Counter(6), value)
+	assert.Equal(t, int64(2), backend.reads)
+}
+
+func TestCache_concurrentIncrements(t *testing.T) {
+	ctx := context.Background()
+	c, _, _ := newTestCache(0)
+	const writers = 50
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, c.Update(ctx, "counter", "Requests", "1"))
+			c.GetCounter(ctx, "Requests")
+		}()
+	}
+	wg.Wait()
+	value, err := c.GetCounter(ctx, "Requests")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Counter(writers), value)
+}
+
+func TestCache_readRacingWrite(t *testing.T) {
+	ctx := context.Background()
+	c, backend, _ := newTestCache(0)
+	assert.NoError(t, c.Update(ctx, "counter", "PollCount", "1"))
+	// The increment lands after the read of the storage but before the read
+	// is cached, so the cached value would be behind.
+	backend.onRead = func() {
+		backend.onRead = nil
+		assert.NoError(t, c.Update(ctx, "counter", "PollCount", "1"))
+	}
+	value, err := c.GetCounter(ctx, "PollCount")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Counter(1), value)
+
+	value, err = c.GetCounter(ctx, "PollCount")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Counter(2), value)
+}
+
+func TestCache_gaugeWriteThrough(t *testing.T) {
+	ctx := context.Background()
+	c, backend, _ := newTestCache(0)
+	assert.NoError(t, c.Update(ctx, "gauge", "Alloc", "1.5"))
+	value, err := c.GetGauge(ctx, "Alloc")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Gauge(1.5), value)
+	assert.Equal(t, int64(0), backend.reads)
+
+	assert.Error(t, c.Update(ctx, "gauge", "Alloc", "x"))
+	value, err = c.GetGauge(ctx, "Alloc")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Gauge(1.5), value)
+	assert.Equal(t, int64(1), backend.reads)
+}
+
+func TestCache_migratedType(t *testing.T) {
+	ctx := context.Background()
+	backend := service.NewService(model.NewStorage())
+	backend.SetConflictPolicy(service.ConflictMigrate)
+	c := Cache(backend, time.Minute, 0)
+	assert.NoError(t, c.Update(ctx, "gauge", "Alloc", "1.5"))
+	_, err := c.GetGauge(ctx, "Alloc")
+	assert.NoError(t, err)
+
+	assert.NoError(t, c.Update(ctx, "counter", "Alloc", "1"))
+	_, err = c.GetGauge(ctx, "Alloc")
+	assert.ErrorIs(t, err, service.ErrNotFound)
+}
+
+func TestCache_expiry(t *testing.T) {
+	ctx := context.Background()
+	c, backend, now := newTestCache(0)
+	assert.NoError(t, c.Update(ctx, "counter", "PollCount", "1"))
+	c.GetCounter(ctx, "PollCount")
+
+	*now = now.Add(59 * time.Second)
+	c.GetCounter(ctx, "PollCount")
+	assert.Equal(t, int64(1), backend.reads)
+
+	*now = now.Add(time.Second)
+	c.GetCounter(ctx, "PollCount")
+	assert.Equal(t, int64(2), backend.reads)
+}
+
+func TestCache_eviction(t *testing.T) {
+	ctx := context.Background()
+	c, backend, _ := newTestCache(2)
+	for _, name := range []string{"A", "B", "C"} {
+		assert.NoError(t, c.Update(ctx, "counter", name, "1"))
+	}
+	c.GetCounter(ctx, "A")
+	c.GetCounter(ctx, "B")
+	c.GetCounter(ctx, "A")
+	// C evicts B, the least recently used.
+	c.GetCounter(ctx, "C")
+	assert.Equal(t, int64(3), backend.reads)
+	c.GetCounter(ctx, "A")
+	assert.Equal(t, int64(3), backend.reads)
+	c.GetCounter(ctx, "B")
+	assert.Equal(t, int64(4), backend.reads)
+}
+
+func TestCache_Invalidate(t *testing.T) {
+	ctx := context.Background()
+	c, backend, _ := newTestCache(0)
+	assert.NoError(t, c.Update(ctx, "counter", "A", "1"))
+	assert.NoError(t, c.Update(ctx, "counter", "B", "1"))
+	assert.NoError(t, c.UpdateHistogram(ctx, "Latency", model.NewHistogram([]float64{1})))
+	c.GetCounter(ctx, "A")
+	c.GetCounter(ctx, "B")
+	histogram, err := c.GetHistogram(ctx, "Latency")
+	assert.NoError(t, err)
+	histogram.Observe(0.5)
+	cached, err := c.GetHistogram(ctx, "Latency")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), cached.Count, "the cached histogram is a copy")
+	assert.Equal(t, int64(3), backend.reads)
+
+	c.Invalidate(model.CounterType, "A")
+	c.GetCounter(ctx, "A")
+	c.GetCounter(ctx, "B")
+	assert.Equal(t, int64(4), backend.reads)
+
+	c.Invalidate("", "")
+	c.GetCounter(ctx, "A")
+	c.GetCounter(ctx, "B")
+	c.GetHistogram(ctx, "Latency")
+	assert.Equal(t, int64(7), backend.reads)
+}
@@ -0,0 +1,279 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NikWaltz/metrics-collector/internal/service"
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+// replica is one server of a cluster sharing a database.
+type replica struct {
+	db interface {
+		Collector
+		Seed(ctx context.Context, fileName string) (bool, error)
+		Listen(ctx context.Context, onChange func(service.Change)) error
+		SetConflictPolicy(policy service.ConflictPolicy)
+	}
+	srv *httptest.Server
+}
+
+// newCluster starts servers against the scratch database of
+// TEST_DATABASE_DSN, which is wiped first. The servers start together, so
+// they also race for the migrations.
+func newCluster(t *testing.T, size int) []replica {
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DATABASE_DSN is not set")
+	}
+	conn, err := pgx.Connect(context.Background(), dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Exec(context.Background(),
+		`DROP TABLE IF EXISTS gauges, counters, histograms, seeds, metadata, schema_migrations CASCADE;`)
+	conn.Close(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replicas := make([]replica, size)
+	var wg sync.WaitGroup
+	for i := range replicas {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			db := service.NewDBService(dsn)
+			db.SetNotify(true)
+			replicas[i].db = db
+		}(i)
+	}
+	wg.Wait()
+	for i := range replicas {
+		if err := replicas[i].db.Ping(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		a := New(replicas[i].db, "")
+		a.routes()
+		replicas[i].srv = httptest.NewServer(a.r)
+	}
+	t.Cleanup(func() {
+		for _, r := range replicas {
+			r.srv.Close()
+			r.db.Close()
+		}
+	})
+	return replicas
+}
+
+func (r replica) post(t *testing.T, path string) {
+	response, err := http.Post(r.srv.URL+path, "text/plain", nil)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Errorf("POST %s: %s", path, response.Status)
+	}
+}
+
+func (r replica) get(t *testing.T, path string) string {
+	response, err := http.Get(r.srv.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestCluster_writes(t *testing.T) {
+	replicas := newCluster(t, 2)
+
+	const writes = 50
+	var wg sync.WaitGroup
+	for i := 0; i < writes; i++ {
+		wg.Add(1)
+		go func(r replica) {
+			defer wg.Done()
+			r.post(t, "/update/counter/Requests/1")
+			r.post(t, "/update/histogram/Latency/0.5")
+		}(replicas[i%len(replicas)])
+	}
+	wg.Wait()
+	replicas[0].post(t, "/update/gauge/Alloc/12.5")
+
+	conn, err := pgx.Connect(context.Background(), os.Getenv("TEST_DATABASE_DSN"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(context.Background())
+	var source string
+	var updatedLater bool
+	err = conn.QueryRow(context.Background(), `SELECT source, updated_at > created_at FROM counters WHERE id='Requests';`).
+		Scan(&source, &updatedLater)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", source)
+	assert.True(t, updatedLater)
+
+	for i, r := range replicas {
+		assert.Equal(t, fmt.Sprint(writes), r.get(t, "/value/counter/Requests"), "replica %d", i)
+		assert.Equal(t, "12.5", r.get(t, "/value/gauge/Alloc"), "replica %d", i)
+		assert.Contains(t, r.get(t, "/value/histogram/Latency"), fmt.Sprintf(`"count":%d`, writes), "replica %d", i)
+		assert.Contains(t, r.get(t, "/"), "Requests", "replica %d", i)
+	}
+}
+
+func TestCluster_seedOnce(t *testing.T) {
+	replicas := newCluster(t, 2)
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+	storage := model.NewStorage()
+	storage.SaveCounter("PollCount", 10)
+	if err := service.WriteSnapshot(fileName, *storage); err != nil {
+		t.Fatal(err)
+	}
+
+	seeded := make(chan bool, len(replicas))
+	for _, r := range replicas {
+		go func(r replica) {
+			ok, err := r.db.Seed(context.Background(), fileName)
+			assert.NoError(t, err)
+			seeded <- ok
+		}(r)
+	}
+	var seeds int
+	for range replicas {
+		if <-seeded {
+			seeds++
+		}
+	}
+	assert.Equal(t, 1, seeds)
+	assert.Equal(t, "10", replicas[1].get(t, "/value/counter/PollCount"))
+}
+
+func TestCluster_notifications(t *testing.T) {
+	replicas := newCluster(t, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := make(chan service.Change, 16)
+	go replicas[1].db.Listen(ctx, func(change service.Change) {
+		changes <- change
+	})
+	// Listen has no signal for being subscribed yet.
+	time.Sleep(200 * time.Millisecond)
+
+	replicas[0].post(t, "/update/counter/Requests/1")
+	replicas[0].post(t, "/update/histogram/Latency/0.5")
+	for _, want := range []service.Change{
+		{Type: model.CounterType, ID: "Requests"},
+		{Type: model.HistogramType, ID: "Latency"},
+	} {
+		select {
+		case change := <-changes:
+			assert.Equal(t, want, change)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no notification for %s %s", want.Type, want.ID)
+		}
+	}
+}
+
+func TestCluster_metadata(t *testing.T) {
+	replicas := newCluster(t, 2)
+	replicas[0].post(t, "/update/counter/PollCount/1")
+	body := `[{"id":"Alloc","type":"gauge","unit":"bytes"},{"id":"PollCount","unit":"polls"}]`
+	response, err := http.Post(replicas[0].srv.URL+"/metadata/", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusOK, response.StatusCode)
+
+	response, err = http.Post(replicas[1].srv.URL+"/update/counter/Alloc/1", "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	assert.Equal(t, http.StatusConflict, response.StatusCode)
+	replicas[1].post(t, "/update/gauge/Alloc/12.5")
+	err = replicas[1].db.SetMetadata(context.Background(), model.Metadata{ID: "PollCount", Type: model.GaugeType})
+	var conflict *service.ConflictError
+	assert.ErrorAs(t, err, &conflict)
+
+	assert.JSONEq(t, `{"id":"Alloc","type":"gauge","unit":"bytes"}`, replicas[1].get(t, "/metadata/Alloc"))
+	assert.Contains(t, replicas[1].get(t, "/metrics"), "# HELP PollCount (polls)")
+	storage, err := replicas[1].db.Export(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "polls", storage.Metadata["PollCount"].Unit)
+}
+
+func TestCluster_typeConflicts(t *testing.T) {
+	replicas := newCluster(t, 2)
+	setPolicy := func(policy service.ConflictPolicy) {
+		for _, r := range replicas {
+			r.db.SetConflictPolicy(policy)
+		}
+	}
+	setPolicy(service.ConflictReject)
+	replicas[0].post(t, "/update/gauge/Alloc/12.5")
+	for _, path := range []string{"/update/counter/Alloc/1", "/update/histogram/Alloc/1"} {
+		response, err := http.Post(replicas[1].srv.URL+path, "text/plain", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+		assert.Equal(t, http.StatusConflict, response.StatusCode, path)
+	}
+	err := replicas[1].db.Import(context.Background(), model.Storage{
+		Gauges:   map[string]model.Gauge{"Mem": 1},
+		Counters: map[string]model.Counter{"Mem": 1},
+	}, service.ImportAdd)
+	var conflict *service.ConflictError
+	assert.ErrorAs(t, err, &conflict)
+
+	setPolicy(service.ConflictMigrate)
+	replicas[1].post(t, "/update/counter/Alloc/1")
+	storage, err := replicas[0].db.Export(context.Background())
+	assert.NoError(t, err)
+	assert.NotContains(t, storage.Gauges, "Alloc")
+	assert.Equal(t, model.Counter(1), storage.Counters["Alloc"])
+	err = replicas[0].db.Import(context.Background(), model.Storage{
+		Histograms: map[string]model.Histogram{"Alloc": model.NewHistogram([]float64{1})},
+	}, service.ImportAdd)
+	assert.NoError(t, err)
+	storage, err = replicas[1].db.Export(context.Background())
+	assert.NoError(t, err)
+	assert.NotContains(t, storage.Counters, "Alloc")
+	assert.Contains(t, storage.Histograms, "Alloc")
+}
+
+func TestCluster_migrate(t *testing.T) {
+	newCluster(t, 1)
+	dsn := os.Getenv("TEST_DATABASE_DSN")
+	latest, dirty, err := service.Migrate(dsn, service.MigrateVersion)
+	assert.NoError(t, err)
+	assert.False(t, dirty)
+
+	version, _, err := service.Migrate(dsn, service.MigrateDown)
+	assert.NoError(t, err)
+	assert.Equal(t, latest-1, version)
+	version, _, err = service.Migrate(dsn, service.MigrateUp)
+	assert.NoError(t, err)
+	assert.Equal(t, latest, version)
+}
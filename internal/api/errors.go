@@ -0,0 +1,108 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/NikWaltz/metrics-collector/internal/keyring"
+	"github.com/NikWaltz/metrics-collector/internal/replay"
+	"github.com/NikWaltz/metrics-collector/internal/service"
+)
+
+// Error codes of the JSON error envelope.
+const (
+	codeUnsupportedMediaType = "unsupported_media_type"
+	codeInvalidJSON          = "invalid_json"
+	codeInvalidBody          = "invalid_body"
+	codeInvalidMetric        = "invalid_metric"
+	codeInvalidValue         = "invalid_value"
+	codeInvalidHash          = "invalid_hash"
+	codeUnknownType          = "unknown_type"
+	codeNotFound             = "not_found"
+	codeTypeConflict         = "type_conflict"
+	codeForbidden            = "forbidden"
+	codeInternal             = "internal"
+)
+
+var errHashMismatch = errors.New("hash does not match")
+
+// apiError is the body of every error response:
+//
+//	{"code": "invalid_value", "message": "...", "id": "Alloc"}
+//
+// ID names the offending metric when there is one.
+type apiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	ID      string `json:"id,omitempty"`
+}
+
+// errorFor maps an error of the service or of the hash checks to a status:
+//
+//	service.TypeError                       501 unknown_type
+//	service.ErrNotFound                     404 not_found
+//	service.ConflictError                   409 type_conflict
+//	errInvalidMetric                        400 invalid_metric
+//	service.ErrInvalidValue                 400 invalid_value
+//	errHashMismatch                         400 invalid_hash
+//	replay.ErrEmptyNonce                    400 invalid_body
+//	keyring, replay and missing key errors  403 forbidden
+//	anything else                           500 internal
+//
+// Reads of an unknown type answer 404 instead of 501, since no metric of
+// that type can exist.
+func errorFor(err error, id string) apiError {
+	e := apiError{Message: err.Error(), ID: id}
+	var typeError *service.TypeError
+	var conflictError *service.ConflictError
+	switch {
+	case errors.As(err, &typeError):
+		e.Status, e.Code = http.StatusNotImplemented, codeUnknownType
+	case errors.Is(err, service.ErrNotFound):
+		e.Status, e.Code = http.StatusNotFound, codeNotFound
+	case errors.As(err, &conflictError):
+		e.Status, e.Code = http.StatusConflict, codeTypeConflict
+	case errors.Is(err, errInvalidMetric):
+		e.Status, e.Code = http.StatusBadRequest, codeInvalidMetric
+	case errors.Is(err, service.ErrInvalidValue):
+		e.Status, e.Code = http.StatusBadRequest, codeInvalidValue
+	case errors.Is(err, errHashMismatch):
+		e.Status, e.Code = http.StatusBadRequest, codeInvalidHash
+	case errors.Is(err, replay.ErrEmptyNonce):
+		e.Status, e.Code = http.StatusBadRequest, codeInvalidBody
+	case isForbidden(err):
+		e.Status, e.Code = http.StatusForbidden, codeForbidden
+	default:
+		e.Status, e.Code = http.StatusInternalServerError, codeInternal
+	}
+	return e
+}
+
+func isForbidden(err error) bool {
+	return errors.Is(err, keyring.ErrUnknownKey) || errors.Is(err, keyring.ErrRevokedKey) ||
+		errors.Is(err, keyring.ErrExpiredKey) || errors.Is(err, errKeyRequired) ||
+		errors.Is(err, replay.ErrStaleRequest) || errors.Is(err, replay.ErrReplayedNonce)
+}
+
+func writeError(w http.ResponseWriter, r *http.Request, e apiError) {
+	if e.Status >= http.StatusInternalServerError {
+		requestLog(r).WithField("metric", e.ID).Error(e.Message)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Status)
+	if err := json.NewEncoder(w).Encode(e); err != nil {
+		requestLog(r).Error(err)
+	}
+}
+
+// writeErr writes the mapped error of err.
+func writeErr(w http.ResponseWriter, r *http.Request, err error, id string) {
+	writeError(w, r, errorFor(err, id))
+}
+
+func newError(status int, code string, message string) apiError {
+	return apiError{Status: status, Code: code, Message: message}
+}
@@ -0,0 +1,50 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"time"
+
+	"github.com/NikWaltz/metrics-collector/internal/health"
+)
+
+// AddLivenessCheck adds a check to /healthz. Liveness checks must not depend
+// on the storage or other services, or an outage restarts every server.
+func (a *api) AddLivenessCheck(name string, check health.CheckFunc) {
+	a.liveness.Add(name, check)
+}
+
+// AddReadinessCheck adds a check to /readyz.
+func (a *api) AddReadinessCheck(name string, check health.CheckFunc) {
+	a.readiness.Add(name, check)
+}
+
+func processCheck(started time.Time) health.CheckFunc {
+	return func(ctx context.Context) health.Result {
+		return health.OK(map[string]interface{}{
+			"started":        started.UTC().Format(time.RFC3339),
+			"uptime_seconds": time.Since(started).Seconds(),
+			"goroutines":     runtime.NumGoroutine(),
+		})
+	}
+}
+
+// healthHandle responds with the report of the checks, using 503 when any
+// of them fails so that probes need not parse the body.
+func (a *api) healthHandle(checks *health.Registry) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := checks.Run(r.Context())
+		status := http.StatusOK
+		if report.Status != health.StatusOK {
+			status = http.StatusServiceUnavailable
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(report); err != nil {
+			requestLog(r).Error(err)
+		}
+	}
+}
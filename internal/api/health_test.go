@@ -0,0 +1,81 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NikWaltz/metrics-collector/internal/health"
+)
+
+func Test_healthHandle(t *testing.T) {
+	tests := []struct {
+		name           string
+		path           string
+		pingErr        error
+		extra          health.CheckFunc
+		wantStatusCode int
+		wantChecks     []string
+	}{
+		{
+			name:           "Liveness ignores the storage",
+			path:           "/healthz",
+			pingErr:        errors.New("connection refused"),
+			wantStatusCode: http.StatusOK,
+			wantChecks:     []string{"process"},
+		},
+		{
+			name:           "Ready",
+			path:           "/readyz",
+			extra:          func(ctx context.Context) health.Result { return health.OK(nil) },
+			wantStatusCode: http.StatusOK,
+			wantChecks:     []string{"snapshot", "storage"},
+		},
+		{
+			name:           "Storage is unreachable",
+			path:           "/readyz",
+			pingErr:        errors.New("connection refused"),
+			wantStatusCode: http.StatusServiceUnavailable,
+			wantChecks:     []string{"storage"},
+		},
+		{
+			name:           "Component check fails",
+			path:           "/readyz",
+			extra:          func(ctx context.Context) health.Result { return health.Fail(errors.New("snapshot is overdue"), nil) },
+			wantStatusCode: http.StatusServiceUnavailable,
+			wantChecks:     []string{"snapshot", "storage"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := New(mockCollector{err: tt.pingErr}, "")
+			if tt.extra != nil {
+				a.AddReadinessCheck("snapshot", tt.extra)
+			}
+			a.r.Get("/healthz", a.healthHandle(a.liveness))
+			a.r.Get("/readyz", a.healthHandle(a.readiness))
+
+			req, err := http.NewRequest(http.MethodGet, tt.path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			a.r.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.wantStatusCode, rr.Code)
+			assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+			var report health.Report
+			assert.NoError(t, json.NewDecoder(rr.Body).Decode(&report))
+			var checks []string
+			for name := range report.Checks {
+				checks = append(checks, name)
+			}
+			assert.ElementsMatch(t, tt.wantChecks, checks)
+		})
+	}
+}
@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+
+	"github.com/NikWaltz/metrics-collector/internal/selfmetrics"
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+// routeName turns a route pattern like "/update/{type}/{name}/{value}" into a
+// name that can be a part of a metric name.
+func routeName(pattern string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r == '{' || r == '}' || r == '*':
+			return -1
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			return unicode.ToLower(r)
+		default:
+			return '_'
+		}
+	}, pattern)
+	name = strings.Trim(name, "_")
+	if name == "" {
+		return "root"
+	}
+	return name
+}
+
+// instrumentHandle counts requests, failed requests and their latency per
+// route. Requests that match no route are counted together as "unmatched".
+func instrumentHandle(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+		next.ServeHTTP(ww, r)
+
+		route := "unmatched"
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = strings.ToLower(r.Method) + "_" + routeName(rctx.RoutePattern())
+		}
+		selfmetrics.ObserveDuration("http."+route+".latency", start)
+		selfmetrics.Add("http."+route+".requests", 1)
+		if ww.Status() >= http.StatusBadRequest {
+			selfmetrics.Add("http."+route+".errors", 1)
+		}
+	})
+}
+
+type instrumentedCollector struct {
+	Collector
+}
+
+// Instrument measures the latency of every call to the collector and counts
+// the accepted updates.
+func Instrument(collector Collector) Collector {
+	return instrumentedCollector{Collector: collector}
+}
+
+func (c instrumentedCollector) Update(ctx context.Context, metricType string, name string, value string) error {
+	defer selfmetrics.ObserveDuration("backend.update.latency", time.Now())
+	err := c.Collector.Update(ctx, metricType, name, value)
+	if err == nil {
+		selfmetrics.Add("updates", 1)
+	}
+	return err
+}
+
+func (c instrumentedCollector) UpdateHistogram(ctx context.Context, name string, histogram model.Histogram) error {
+	defer selfmetrics.ObserveDuration("backend.update.latency", time.Now())
+	err := c.Collector.UpdateHistogram(ctx, name, histogram)
+	if err == nil {
+		selfmetrics.Add("updates", 1)
+	}
+	return err
+}
+
+func (c instrumentedCollector) AddGauge(ctx context.Context, name string, delta model.Gauge) error {
+	defer selfmetrics.ObserveDuration("backend.update.latency", time.Now())
+	err := c.Collector.AddGauge(ctx, name, delta)
+	if err == nil {
+		selfmetrics.Add("updates", 1)
+	}
+	return err
+}
+
+func (c instrumentedCollector) GetGauge(ctx context.Context, name string) (model.Gauge, error) {
+	defer selfmetrics.ObserveDuration("backend.get.latency", time.Now())
+	return c.Collector.GetGauge(ctx, name)
+}
+
+func (c instrumentedCollector) GetCounter(ctx context.Context, name string) (model.Counter, error) {
+	defer selfmetrics.ObserveDuration("backend.get.latency", time.Now())
+	return c.Collector.GetCounter(ctx, name)
+}
+
+func (c instrumentedCollector) GetHistogram(ctx context.Context, name string) (model.Histogram, error) {
+	defer selfmetrics.ObserveDuration("backend.get.latency", time.Now())
+	return c.Collector.GetHistogram(ctx, name)
+}
+
+func (c instrumentedCollector) GetStorage(ctx context.Context) model.Storage {
+	defer selfmetrics.ObserveDuration("backend.get_all.latency", time.Now())
+	return c.Collector.GetStorage(ctx)
+}
+
+func (c instrumentedCollector) Ping(ctx context.Context) error {
+	defer selfmetrics.ObserveDuration("backend.ping.latency", time.Now())
+	return c.Collector.Ping(ctx)
+}
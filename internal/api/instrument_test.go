@@ -0,0 +1,93 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NikWaltz/metrics-collector/internal/selfmetrics"
+	"github.com/NikWaltz/metrics-collector/internal/service"
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+func Test_routeName(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    string
+	}{
+		{pattern: "/", want: "root"},
+		{pattern: "/update/", want: "update"},
+		{pattern: "/update/{type}/{name}/{value}", want: "update_type_name_value"},
+		{pattern: "/metrics", want: "metrics"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			assert.Equal(t, tt.want, routeName(tt.pattern))
+		})
+	}
+}
+
+// published drains the self metrics into a new collector.
+func published() Collector {
+	collector := service.NewService(model.NewStorage())
+	selfmetrics.Publish(context.Background(), collector)
+	return collector
+}
+
+func Test_instrumentHandle(t *testing.T) {
+	published()
+	r := chi.NewRouter()
+	r.Use(instrumentHandle)
+	r.Get("/value/{type}/{name}", func(w http.ResponseWriter, r *http.Request) {
+		if chi.URLParam(r, "name") == "Missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+	for _, path := range []string{"/value/gauge/Alloc", "/value/gauge/Missing", "/nowhere"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	got := published()
+	ctx := context.Background()
+	for name, want := range map[string]model.Counter{
+		"http.get_value_type_name.requests": 2,
+		"http.get_value_type_name.errors":   1,
+		"http.unmatched.requests":           1,
+		"http.unmatched.errors":             1,
+	} {
+		counter, err := got.GetCounter(ctx, selfmetrics.Prefix+name)
+		assert.NoError(t, err, name)
+		assert.Equal(t, want, counter, name)
+	}
+	latency, err := got.GetHistogram(ctx, selfmetrics.Prefix+"http.get_value_type_name.latency")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), latency.Count)
+}
+
+func TestInstrument(t *testing.T) {
+	published()
+	ctx := context.Background()
+	c := Instrument(mockCollector{st: *model.NewStorage()})
+	assert.NoError(t, c.Update(ctx, model.GaugeType, "Alloc", "1"))
+	assert.NoError(t, c.AddGauge(ctx, "Alloc", 1))
+	assert.NoError(t, c.UpdateHistogram(ctx, "Latency", model.NewHistogram(model.DefaultBuckets)))
+	_, _ = c.GetGauge(ctx, "Alloc")
+	failing := Instrument(mockCollector{err: errors.New("database is down")})
+	assert.Error(t, failing.Update(ctx, model.GaugeType, "Alloc", "1"))
+
+	got := published()
+	updates, err := got.GetCounter(ctx, selfmetrics.Prefix+"updates")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Counter(3), updates, "failed updates are not counted")
+	latency, err := got.GetHistogram(ctx, selfmetrics.Prefix+"backend.update.latency")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), latency.Count, "failed updates are timed")
+	latency, err = got.GetHistogram(ctx, selfmetrics.Prefix+"backend.get.latency")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), latency.Count)
+}
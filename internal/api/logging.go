@@ -0,0 +1,54 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/sirupsen/logrus"
+
+	"github.com/NikWaltz/metrics-collector/internal/logger"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+var log = logger.For("api")
+
+// requestLog returns the api logger with the id of the request, so that
+// every entry written while serving it can be matched with its access log.
+func requestLog(r *http.Request) *logrus.Entry {
+	return log.WithField("request_id", middleware.GetReqID(r.Context()))
+}
+
+// auditLog is used for rejected writes, which are kept apart from the
+// other warnings by the "audit" field.
+func auditLog(r *http.Request) *logrus.Entry {
+	return requestLog(r).WithFields(logrus.Fields{
+		"audit":       true,
+		"remote_addr": r.RemoteAddr,
+	})
+}
+
+// logHandle assigns a request id, taken from the X-Request-ID header when the
+// client sent one, returns it in the response and logs every request once
+// it is served.
+func logHandle(next http.Handler) http.Handler {
+	return middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(requestIDHeader, middleware.GetReqID(r.Context()))
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		start := time.Now()
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+		requestLog(r).WithFields(logrus.Fields{
+			"method":      r.Method,
+			"uri":         r.RequestURI,
+			"status":      status,
+			"size":        ww.BytesWritten(),
+			"duration_ms": float64(time.Since(start).Microseconds()) / 1000,
+		}).Info("request served")
+	}))
+}
@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/NikWaltz/metrics-collector/internal/selfmetrics"
+	"github.com/NikWaltz/metrics-collector/internal/service"
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+type metadataResponse struct {
+	Registered int `json:"registered"`
+}
+
+// metadataOf returns the metadata a metric registers along with its value
+// and whether there is any.
+func metadataOf(metric *model.Metrics) (model.Metadata, bool) {
+	metadata := model.Metadata{
+		ID:          metric.ID,
+		Type:        strings.ToLower(metric.MType),
+		Unit:        metric.Unit,
+		Description: metric.Description,
+		Owner:       metric.Owner,
+	}
+	return metadata, metric.Unit != "" || metric.Description != "" || metric.Owner != ""
+}
+
+// setMetadataHandle registers the metadata of a JSON array of metrics.
+// Empty fields keep the registered values. The array is saved as a whole,
+// or not at all when any entry is invalid, unsigned while a key is set or
+// conflicts with the type of a metric.
+func (a *api) setMetadataHandle(w http.ResponseWriter, r *http.Request) {
+	var list []model.Metadata
+	if !decodeJSON(w, r, &list) {
+		return
+	}
+	settings := a.current()
+	storage := model.NewStorage()
+	for i := range list {
+		if err := validateMetadata(&list[i]); err != nil {
+			writeErr(w, r, err, list[i].ID)
+			return
+		}
+		if err := settings.verifyMetadata(r, &list[i]); err != nil {
+			selfmetrics.Add("rejected_hashes", 1)
+			writeErr(w, r, err, list[i].ID)
+			return
+		}
+		stored, _ := storage.GetMetadata(list[i].ID)
+		storage.SaveMetadata(list[i].ID, stored.Merge(list[i]))
+	}
+	if err := a.service.Import(r.Context(), *storage, service.ImportAdd); err != nil {
+		writeErr(w, r, err, "")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if errEncode := json.NewEncoder(w).Encode(metadataResponse{Registered: len(storage.Metadata)}); errEncode != nil {
+		requestLog(r).Error(errEncode)
+	}
+}
+
+// listMetadataHandle answers the metadata of all metrics ordered by name.
+func (a *api) listMetadataHandle(w http.ResponseWriter, r *http.Request) {
+	list, err := a.service.ListMetadata(r.Context())
+	if err != nil {
+		writeErr(w, r, err, "")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if errEncode := json.NewEncoder(w).Encode(list); errEncode != nil {
+		requestLog(r).Error(errEncode)
+	}
+}
+
+func (a *api) getMetadataHandle(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if err := validateID(name); err != nil {
+		writeErr(w, r, err, name)
+		return
+	}
+	metadata, err := a.service.GetMetadata(r.Context(), name)
+	if err != nil {
+		writeErr(w, r, err, name)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if errEncode := json.NewEncoder(w).Encode(metadata); errEncode != nil {
+		requestLog(r).Error(errEncode)
+	}
+}
@@ -0,0 +1,187 @@
+package api
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NikWaltz/metrics-collector/internal/replay"
+	"github.com/NikWaltz/metrics-collector/internal/service"
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+func Test_metadataHandles(t *testing.T) {
+	// The steps share the storage.
+	tests := []struct {
+		name           string
+		method         string
+		target         string
+		body           string
+		wantStatusCode int
+		wantCode       string
+		wantBody       string
+	}{
+		{
+			name:           "Register",
+			method:         http.MethodPost,
+			target:         "/metadata/",
+			body:           `[{"id":"Alloc","type":"gauge","unit":"bytes"},{"id":"PollCount","owner":"agent"}]`,
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"registered":2}`,
+		},
+		{
+			name:           "Update of another type",
+			method:         http.MethodPost,
+			target:         "/update/counter/Alloc/1",
+			wantStatusCode: http.StatusConflict,
+			wantCode:       codeTypeConflict,
+		},
+		{
+			name:           "Register along with a value",
+			method:         http.MethodPost,
+			target:         "/update/",
+			body:           `{"id":"PollCount","type":"counter","delta":1,"unit":"polls"}`,
+			wantStatusCode: http.StatusOK,
+		},
+		{
+			name:           "Value of another type with metadata",
+			method:         http.MethodPost,
+			target:         "/update/",
+			body:           `{"id":"PollCount","type":"gauge","value":1,"description":"Polls."}`,
+			wantStatusCode: http.StatusConflict,
+			wantCode:       codeTypeConflict,
+		},
+		{
+			name:           "Conflict rejects the whole array",
+			method:         http.MethodPost,
+			target:         "/metadata/",
+			body:           `[{"id":"Mem","unit":"bytes"},{"id":"PollCount","type":"histogram"}]`,
+			wantStatusCode: http.StatusConflict,
+			wantCode:       codeTypeConflict,
+		},
+		{
+			name:           "Invalid id",
+			method:         http.MethodPost,
+			target:         "/metadata/",
+			body:           `[{"id":"heap alloc"}]`,
+			wantStatusCode: http.StatusBadRequest,
+			wantCode:       codeInvalidMetric,
+		},
+		{
+			name:           "Unknown type",
+			method:         http.MethodPost,
+			target:         "/metadata/",
+			body:           `[{"id":"Requests","type":"summary"}]`,
+			wantStatusCode: http.StatusNotImplemented,
+			wantCode:       codeUnknownType,
+		},
+		{
+			name:           "List",
+			method:         http.MethodGet,
+			target:         "/metadata/",
+			wantStatusCode: http.StatusOK,
+			wantBody: `[{"id":"Alloc","type":"gauge","unit":"bytes"},` +
+				`{"id":"PollCount","type":"counter","unit":"polls","owner":"agent"}]`,
+		},
+		{
+			name:           "Get",
+			method:         http.MethodGet,
+			target:         "/metadata/Alloc",
+			wantStatusCode: http.StatusOK,
+			wantBody:       `{"id":"Alloc","type":"gauge","unit":"bytes"}`,
+		},
+		{
+			name:           "Get unknown",
+			method:         http.MethodGet,
+			target:         "/metadata/Mem",
+			wantStatusCode: http.StatusNotFound,
+			wantCode:       codeNotFound,
+		},
+	}
+	a := New(service.NewService(model.NewStorage()), "")
+	a.routes()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			rr := httptest.NewRecorder()
+			a.r.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.wantStatusCode, rr.Code)
+			if tt.wantCode != "" {
+				var e apiError
+				assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &e))
+				assert.Equal(t, tt.wantCode, e.Code)
+			}
+			if tt.wantBody != "" {
+				assert.JSONEq(t, tt.wantBody, rr.Body.String())
+			}
+		})
+	}
+}
+
+func Test_setMetadataHandle_signed(t *testing.T) {
+	signed := model.Metadata{ID: "Alloc", Type: "gauge", Unit: "bytes"}
+	h := hmac.New(sha256.New, []byte("key"))
+	h.Write(metadataHashData(&signed))
+	signed.Hash = hex.EncodeToString(h.Sum(nil))
+	entry, err := json.Marshal([]model.Metadata{signed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	unsigned := `[{"id":"Alloc","type":"counter"}]`
+	tests := []struct {
+		name           string
+		body           string
+		sign           string
+		wantStatusCode int
+	}{
+		{name: "Reject unsigned entries", body: unsigned, wantStatusCode: http.StatusForbidden},
+		{name: "Reject a wrong hash", body: `[{"id":"Alloc","type":"counter","hash":"00"}]`, wantStatusCode: http.StatusBadRequest},
+		{name: "Accept hashed entries", body: string(entry), wantStatusCode: http.StatusOK},
+		{
+			name:           "Accept a signed body",
+			body:           `[{"id":"Alloc","description":"Heap bytes."}]`,
+			sign:           replay.Sign("key", now, "n1", "/metadata/", []byte(`[{"id":"Alloc","description":"Heap bytes."}]`)),
+			wantStatusCode: http.StatusOK,
+		},
+	}
+	s := service.NewService(model.NewStorage())
+	a := New(s, "key")
+	a.routes()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := http.NewRequest(http.MethodPost, "/metadata/", strings.NewReader(tt.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			if tt.sign != "" {
+				req.Header.Set(replay.TimestampHeader, now)
+				req.Header.Set(replay.NonceHeader, "n1")
+				req.Header.Set(replay.HashHeader, tt.sign)
+			}
+			rr := httptest.NewRecorder()
+			a.r.ServeHTTP(rr, req)
+
+			assert.Equal(t, tt.wantStatusCode, rr.Code)
+		})
+	}
+	metadata, err := s.GetMetadata(context.Background(), "Alloc")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Metadata{ID: "Alloc", Type: "gauge", Unit: "bytes", Description: "Heap bytes."}, metadata)
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+// openAPISpec is the OpenAPI 3 contract of the routes registered in routes.
+// The request validation below implements the Metric schema of the spec.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+// maxIDLength bounds metric IDs, matching the ID schema of the spec.
+const maxIDLength = 255
+
+// maxMetadataLength bounds the unit, description and owner of a metric,
+// matching the Metadata schema of the spec.
+const maxMetadataLength = 1024
+
+var errInvalidMetric = errors.New("invalid metric")
+
+func (a *api) openAPIHandle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if _, err := w.Write(openAPISpec); err != nil {
+		requestLog(r).Error(err)
+	}
+}
+
+func invalidMetric(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", errInvalidMetric, fmt.Sprintf(format, args...))
+}
+
+// validateID checks that the ID is 1 to 255 characters of letters, digits
+// and "_.:-".
+func validateID(id string) error {
+	if id == "" {
+		return invalidMetric("id is required")
+	}
+	if len(id) > maxIDLength {
+		return invalidMetric("id is longer than %d characters", maxIDLength)
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '_', c == '.', c == ':', c == '-':
+		default:
+			return invalidMetric("id contains %q", c)
+		}
+	}
+	return nil
+}
+
+// validateMetric checks a metric to be saved: a gauge has exactly a value, a
+// counter exactly a delta and a histogram exactly one of histogram or value.
+// Unknown types pass, so that saving them fails with service.TypeError.
+func validateMetric(metric *model.Metrics) error {
+	if err := validateID(metric.ID); err != nil {
+		return err
+	}
+	switch strings.ToLower(metric.MType) {
+	case model.GaugeType:
+		if metric.Value == nil || metric.Delta != nil || metric.Histogram != nil {
+			return invalidMetric("gauge requires value only")
+		}
+	case model.CounterType:
+		if metric.Delta == nil || metric.Value != nil || metric.Histogram != nil {
+			return invalidMetric("counter requires delta only")
+		}
+	case model.HistogramType:
+		if (metric.Value == nil) == (metric.Histogram == nil) || metric.Delta != nil {
+			return invalidMetric("histogram requires either histogram or value")
+		}
+	case "":
+		return invalidMetric("type is required")
+	}
+	metadata, _ := metadataOf(metric)
+	return validateMetadata(&metadata)
+}
+
+// validateMetadata implements the Metadata schema of the spec. The type is
+// left to the service.
+func validateMetadata(metadata *model.Metadata) error {
+	if err := validateID(metadata.ID); err != nil {
+		return err
+	}
+	fields := []struct {
+		name  string
+		value string
+	}{
+		{"unit", metadata.Unit},
+		{"description", metadata.Description},
+		{"owner", metadata.Owner},
+	}
+	for _, field := range fields {
+		if len(field.value) > maxMetadataLength {
+			return invalidMetric("%s is longer than %d characters", field.name, maxMetadataLength)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+func Test_openAPISpecCoversRoutes(t *testing.T) {
+	var spec struct {
+		OpenAPI string                                `json:"openapi"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, strings.HasPrefix(spec.OpenAPI, "3."))
+
+	a := New(mockCollector{}, "")
+	a.routes()
+	routes := 0
+	err := chi.Walk(a.r, func(method string, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		routes++
+		operations, ok := spec.Paths[route]
+		if assert.True(t, ok, "route %s is not in the spec", route) {
+			assert.Contains(t, operations, strings.ToLower(method), "route %s %s is not in the spec", method, route)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	operations := 0
+	for _, path := range spec.Paths {
+		operations += len(path)
+	}
+	assert.Equal(t, operations, routes, "routes and operations of the spec differ")
+}
+
+func Test_openAPIHandle(t *testing.T) {
+	a := New(mockCollector{}, "")
+	a.r.Get("/openapi.json", a.openAPIHandle)
+
+	req, err := http.NewRequest(http.MethodGet, "/openapi.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	a.r.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "application/json", rr.Header().Get("Content-Type"))
+	assert.True(t, json.Valid(rr.Body.Bytes()))
+}
+
+func Test_validateMetric(t *testing.T) {
+	value := 1.5
+	delta := int64(2)
+	histogram := &model.Histogram{Bounds: []float64{1}, Counts: []int64{0, 1}, Count: 1, Sum: 1.5}
+	tests := []struct {
+		name    string
+		metric  model.Metrics
+		wantErr bool
+	}{
+		{name: "Gauge", metric: model.Metrics{ID: "Alloc", MType: "gauge", Value: &value}},
+		{name: "Counter in any case", metric: model.Metrics{ID: "PollCount", MType: "Counter", Delta: &delta}},
+		{name: "Histogram", metric: model.Metrics{ID: "GCPause", MType: "histogram", Histogram: histogram}},
+		{name: "Histogram observation", metric: model.Metrics{ID: "GCPause", MType: "histogram", Value: &value}},
+		{name: "Unknown type is left to the service", metric: model.Metrics{ID: "Requests", MType: "summary"}},
+		{name: "ID with punctuation", metric: model.Metrics{ID: "api.latency:p99-ms_1", MType: "gauge", Value: &value}},
+		{name: "Gauge without value", metric: model.Metrics{ID: "Alloc", MType: "gauge"}, wantErr: true},
+		{name: "Gauge with delta", metric: model.Metrics{ID: "Alloc", MType: "gauge", Value: &value, Delta: &delta}, wantErr: true},
+		{name: "Counter without delta", metric: model.Metrics{ID: "PollCount", MType: "counter", Value: &value}, wantErr: true},
+		{name: "Histogram without data", metric: model.Metrics{ID: "GCPause", MType: "histogram"}, wantErr: true},
+		{name: "Histogram with both", metric: model.Metrics{ID: "GCPause", MType: "histogram", Value: &value, Histogram: histogram}, wantErr: true},
+		{name: "Missing type", metric: model.Metrics{ID: "Alloc", Value: &value}, wantErr: true},
+		{name: "Missing ID", metric: model.Metrics{MType: "gauge", Value: &value}, wantErr: true},
+		{name: "ID with space", metric: model.Metrics{ID: "heap alloc", MType: "gauge", Value: &value}, wantErr: true},
+		{name: "ID too long", metric: model.Metrics{ID: strings.Repeat("a", maxIDLength+1), MType: "gauge", Value: &value}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateMetric(&tt.metric)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, errInvalidMetric)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,137 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+// prometheusName replaces every character that is not allowed in a
+// Prometheus metric name with an underscore.
+func prometheusName(name string) string {
+	var b strings.Builder
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':':
+			b.WriteRune(c)
+		case c >= '0' && c <= '9' && i > 0:
+			b.WriteRune(c)
+		default:
+			b.WriteRune('_')
+		}
+	}
+	return b.String()
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch v := m.(type) {
+	case map[string]model.Gauge:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]model.Counter:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	case map[string]model.Histogram:
+		for k := range v {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// uniqueName returns the Prometheus name of a metric that has not been
+// written yet. A name taken by a metric of another type, or by another id
+// that sanitizes to the same name, gets the type as a suffix. When that is
+// taken too, the metric is skipped with a warning and "" is returned.
+func uniqueName(written map[string]bool, id string, metricType string) string {
+	name := prometheusName(id)
+	if written[name] {
+		name += "_" + metricType
+	}
+	if written[name] {
+		log.WithField("metric", id).WithField("type", metricType).Warn("skipping metric with a duplicate prometheus name")
+		return ""
+	}
+	written[name] = true
+	return name
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+// writeHelp writes the HELP line of a metric with a description or a unit:
+// the description followed by the unit in parentheses.
+func writeHelp(buf *bytes.Buffer, name string, metadata model.Metadata) {
+	help := metadata.Description
+	switch {
+	case metadata.Unit == "":
+	case help == "":
+		help = "(" + metadata.Unit + ")"
+	default:
+		help += " (" + metadata.Unit + ")"
+	}
+	if help == "" {
+		return
+	}
+	fmt.Fprintf(buf, "# HELP %s %s\n", name, helpEscaper.Replace(help))
+}
+
+func writePrometheus(buf *bytes.Buffer, data model.Storage) {
+	written := make(map[string]bool)
+	for _, id := range sortedKeys(data.Gauges) {
+		name := uniqueName(written, id, model.GaugeType)
+		if name == "" {
+			continue
+		}
+		writeHelp(buf, name, data.Metadata[id])
+		fmt.Fprintf(buf, "# TYPE %s gauge\n%s %s\n", name, name, formatFloat(float64(data.Gauges[id])))
+	}
+	for _, id := range sortedKeys(data.Counters) {
+		name := uniqueName(written, id, model.CounterType)
+		if name == "" {
+			continue
+		}
+		writeHelp(buf, name, data.Metadata[id])
+		fmt.Fprintf(buf, "# TYPE %s counter\n%s %d\n", name, name, data.Counters[id])
+	}
+	for _, id := range sortedKeys(data.Histograms) {
+		name := uniqueName(written, id, model.HistogramType)
+		if name == "" {
+			continue
+		}
+		h := data.Histograms[id]
+		writeHelp(buf, name, data.Metadata[id])
+		fmt.Fprintf(buf, "# TYPE %s histogram\n", name)
+		var cumulative int64
+		for i, bound := range h.Bounds {
+			cumulative += h.Counts[i]
+			fmt.Fprintf(buf, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(buf, "%s_bucket{le=\"+Inf\"} %d\n", name, h.Count)
+		fmt.Fprintf(buf, "%s_sum %s\n", name, formatFloat(h.Sum))
+		fmt.Fprintf(buf, "%s_count %d\n", name, h.Count)
+	}
+}
+
+func (a *api) prometheusHandle(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	writePrometheus(&buf, a.service.GetStorage(r.Context()))
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	_, err := w.Write(buf.Bytes())
+	if err != nil {
+		requestLog(r).Error(err)
+	}
+}
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+func Test_prometheusName(t *testing.T) {
+	tests := []struct {
+		name string
+		id   string
+		want string
+	}{
+		{name: "Keep valid name", id: "HeapAlloc", want: "HeapAlloc"},
+		{name: "Replace dots", id: "api.latency.mean", want: "api_latency_mean"},
+		{name: "Replace leading digit", id: "1min", want: "_min"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, prometheusName(tt.id))
+		})
+	}
+}
+
+func Test_prometheusHandle(t *testing.T) {
+	stor := model.Storage{
+		Gauges:   map[string]model.Gauge{"Alloc": 43.5, "api.mean": 2},
+		Counters: map[string]model.Counter{"PollCount": 5},
+		Histograms: map[string]model.Histogram{"GCPause": {
+			Bounds: []float64{1, 2.5},
+			Counts: []int64{1, 2, 3},
+			Count:  6,
+			Sum:    21,
+		}},
+		Metadata: map[string]model.Metadata{
+			"Alloc":     {ID: "Alloc", Unit: "bytes", Description: "Bytes of allocated heap objects."},
+			"PollCount": {ID: "PollCount", Description: "Polls\nof C:\\"},
+			"GCPause":   {ID: "GCPause", Unit: "nanoseconds"},
+		},
+	}
+	a := &api{
+		r:       chi.NewRouter(),
+		service: mockCollector{st: stor},
+	}
+	a.r.Get("/metrics", a.prometheusHandle)
+
+	req, err := http.NewRequest(http.MethodGet, "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	a.r.ServeHTTP(rr, req)
+
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, `# HELP Alloc Bytes of allocated heap objects. (bytes)
+# TYPE Alloc gauge
+Alloc 43.5
+# TYPE api_mean gauge
+api_mean 2
+# HELP PollCount Polls\nof C:\\
+# TYPE PollCount counter
+PollCount 5
+# HELP GCPause (nanoseconds)
+# TYPE GCPause histogram
+GCPause_bucket{le="1"} 1
+GCPause_bucket{le="2.5"} 3
+GCPause_bucket{le="+Inf"} 6
+GCPause_sum 21
+GCPause_count 6
+`, rr.Body.String())
+}
+
+func Test_writePrometheus_duplicateNames(t *testing.T) {
+	var buf bytes.Buffer
+	writePrometheus(&buf, model.Storage{
+		Gauges:   map[string]model.Gauge{"api.mean": 1, "api_mean": 2, "api-mean": 3, "Requests": 4},
+		Counters: map[string]model.Counter{"Requests": 5},
+	})
+	// Ids are written in order, so api_mean finds both names taken.
+	assert.Equal(t, `# TYPE Requests gauge
+Requests 4
+# TYPE api_mean gauge
+api_mean 3
+# TYPE api_mean_gauge gauge
+api_mean_gauge 1
+# TYPE Requests_counter counter
+Requests_counter 5
+`, buf.String())
+}
@@ -0,0 +1,109 @@
+package api
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/NikWaltz/metrics-collector/internal/keyring"
+	"github.com/NikWaltz/metrics-collector/internal/replay"
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+// Settings control how write requests are authenticated. They may be
+// replaced with Reload while the server is running; every request works
+// with the settings that were current when it started.
+type Settings struct {
+	// Key is the shared key of all agents when there is no keyring.
+	Key string
+	// Keyring enables per-agent keys. Every write must then name the key
+	// it is signed with; the shared key is no longer accepted.
+	Keyring *keyring.Keyring
+	// ReplayGuard enables timestamp and nonce checks of signed request bodies.
+	ReplayGuard *replay.Guard
+	// RequireSignedBody rejects write requests without a body signature,
+	// so the per-metric hash mode is no longer accepted.
+	RequireSignedBody bool
+	// TrustedSubnets limits write requests to agents from the given
+	// networks. An empty list allows every address.
+	TrustedSubnets []*net.IPNet
+}
+
+func (a *api) Reload(settings Settings) {
+	a.settings.Store(&settings)
+}
+
+func (a *api) current() *Settings {
+	settings, ok := a.settings.Load().(*Settings)
+	if !ok {
+		return &Settings{}
+	}
+	return settings
+}
+
+// signingKey selects the key of the agent by the key id from the payload or
+// the X-Key-ID header, see keyByID.
+func (s *Settings) signingKey(r *http.Request, metric *model.Metrics) (string, error) {
+	keyID := metric.KeyID
+	if keyID == "" {
+		keyID = r.Header.Get("X-Key-ID")
+	}
+	return s.keyByID(r, keyID)
+}
+
+// keyByID returns the shared key when there is no keyring, and the key with
+// the id otherwise. A missing id is rejected then, as a write signed with
+// the shared key names no agent whose key could be revoked.
+func (s *Settings) keyByID(r *http.Request, keyID string) (string, error) {
+	if s.Keyring == nil {
+		return s.Key, nil
+	}
+	if keyID == "" {
+		auditLog(r).Warn("rejected write without key id")
+		return "", errKeyRequired
+	}
+	key, err := s.Keyring.Lookup(keyID)
+	if err != nil {
+		auditLog(r).WithError(err).WithField("key_id", keyID).Warn("rejected key id")
+		return "", err
+	}
+	return key, nil
+}
+
+func (s *Settings) verifyMetric(r *http.Request, metric *model.Metrics) error {
+	if verified, _ := r.Context().Value(bodyVerifiedKey).(bool); verified {
+		return nil
+	}
+	key, err := s.signingKey(r, metric)
+	if err != nil {
+		return err
+	}
+	if key == "" {
+		return nil
+	}
+	return verifyHash(metric, key)
+}
+
+// verifyMetadata checks the hash of a metadata entry once a key or a keyring
+// is set, unless the whole body is signed. Unsigned entries are rejected
+// then, as a registered type locks the metric to it.
+func (s *Settings) verifyMetadata(r *http.Request, metadata *model.Metadata) error {
+	if verified, _ := r.Context().Value(bodyVerifiedKey).(bool); verified {
+		return nil
+	}
+	if s.Key == "" && s.Keyring == nil {
+		return nil
+	}
+	keyID := metadata.KeyID
+	if keyID == "" {
+		keyID = r.Header.Get("X-Key-ID")
+	}
+	key, err := s.keyByID(r, keyID)
+	if err != nil {
+		return err
+	}
+	if key == "" || metadata.Hash == "" {
+		auditLog(r).WithField("metric", metadata.ID).Warn("rejected unsigned metadata")
+		return errKeyRequired
+	}
+	return checkHMAC(metadataHashData(metadata), metadata.Hash, key)
+}
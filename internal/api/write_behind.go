@@ -0,0 +1,410 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NikWaltz/metrics-collector/internal/selfmetrics"
+	"github.com/NikWaltz/metrics-collector/internal/service"
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+// writeBehindCollector keeps gauge and counter updates in memory and writes
+// them to the collector in batches: the last value of every gauge and the sum
+// of the deltas of every counter, in one Import. Histograms are written
+// directly. Reads include the pending updates.
+type writeBehindCollector struct {
+	Collector
+	interval  time.Duration
+	batch     int
+	capacity  int
+	conflicts service.ConflictPolicy
+
+	mu      sync.Mutex
+	pending model.Storage
+	// sources names the agent of the last update of every pending metric.
+	sources map[service.Change]string
+	// failed is the error of the last flush. While it is set, updates that
+	// find no room fail instead of waiting.
+	failed error
+	// space is closed by a flush to wake up the updates waiting for room.
+	space chan struct{}
+	full  chan struct{}
+
+	// flushing is held by a flush and shared by reads, so that a read never
+	// sees a batch both in pending and in the collector.
+	flushing sync.RWMutex
+	done     chan struct{}
+	stopped  chan struct{}
+	close    sync.Once
+}
+
+// WriteBehind buffers the gauge and counter updates of the collector and
+// flushes them every interval, or earlier when batch metrics are pending.
+// At most capacity metrics are pending; an update of another metric waits
+// for the next flush, or fails when the last flush failed.
+func WriteBehind(collector Collector, interval time.Duration, batch int, capacity int) *writeBehindCollector {
+	if capacity < batch {
+		capacity = batch
+	}
+	c := &writeBehindCollector{
+		Collector: collector,
+		interval:  interval,
+		batch:     batch,
+		capacity:  capacity,
+		conflicts: service.ConflictAllow,
+		pending:   *model.NewStorage(),
+		sources:   make(map[service.Change]string),
+		space:     make(chan struct{}),
+		full:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	selfmetrics.RegisterGauge("write_behind.pending", func() float64 {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return float64(c.size())
+	})
+	go c.run()
+	return c
+}
+
+// SetConflictPolicy sets the policy of the collector, so that the updates
+// it would reject are rejected before they are buffered.
+func (c *writeBehindCollector) SetConflictPolicy(policy service.ConflictPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conflicts = policy
+}
+
+func (c *writeBehindCollector) run() {
+	defer close(c.stopped)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.full:
+		case <-c.done:
+			return
+		}
+		if err := c.Flush(context.Background()); err != nil {
+			log.WithError(err).Error("unable to write buffered metrics")
+		}
+	}
+}
+
+func (c *writeBehindCollector) size() int {
+	return len(c.pending.Gauges) + len(c.pending.Counters)
+}
+
+// Flush writes the pending updates to the collector. When that fails they
+// are kept for the next flush.
+func (c *writeBehindCollector) Flush(ctx context.Context) error {
+	c.flushing.Lock()
+	defer c.flushing.Unlock()
+	c.mu.Lock()
+	batch := c.pending
+	sources := c.sources
+	c.pending = *model.NewStorage()
+	c.sources = make(map[service.Change]string)
+	c.mu.Unlock()
+	if len(batch.Gauges)+len(batch.Counters) == 0 {
+		return nil
+	}
+
+	defer selfmetrics.ObserveDuration("write_behind.flush.latency", time.Now())
+	err := c.importBatch(service.WithSources(ctx, sources), batch)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.failed = err
+	// The updates waiting for room check again, and fail if this flush did.
+	close(c.space)
+	c.space = make(chan struct{})
+	if err != nil {
+		selfmetrics.Add("write_behind.flush.errors", 1)
+		c.requeue(batch, sources)
+		return err
+	}
+	selfmetrics.Add("write_behind.flushes", 1)
+	selfmetrics.Add("write_behind.flushed", int64(len(batch.Gauges)+len(batch.Counters)))
+	return nil
+}
+
+// requeue puts back the updates of a failed flush. Updates that came in
+// meanwhile are newer than the batch. c.mu is held.
+func (c *writeBehindCollector) requeue(batch model.Storage, sources map[service.Change]string) {
+	for name, value := range batch.Gauges {
+		key := service.Change{Type: model.GaugeType, ID: name}
+		if _, ok := c.pending.Gauges[name]; !ok {
+			c.pending.Gauges[name] = value
+			c.sources[key] = sources[key]
+		}
+	}
+	for name, value := range batch.Counters {
+		key := service.Change{Type: model.CounterType, ID: name}
+		if _, ok := c.pending.Counters[name]; !ok {
+			c.sources[key] = sources[key]
+		}
+		c.pending.Counters[name] += value
+	}
+}
+
+// importBatch imports the batch without the metrics that conflict with the
+// type in their metadata. Updates are checked before they are buffered, so
+// this only drops those that raced with a change of the metadata.
+func (c *writeBehindCollector) importBatch(ctx context.Context, batch model.Storage) error {
+	for {
+		err := c.Collector.Import(ctx, batch, service.ImportAdd)
+		var conflict *service.ConflictError
+		if !errors.As(err, &conflict) {
+			return err
+		}
+		_, gauge := batch.Gauges[conflict.ID]
+		_, counter := batch.Counters[conflict.ID]
+		switch {
+		case conflict.Type == model.GaugeType && gauge:
+			delete(batch.Gauges, conflict.ID)
+		case conflict.Type == model.CounterType && counter:
+			delete(batch.Counters, conflict.ID)
+		default:
+			return err
+		}
+		log.WithField("metric", conflict.ID).WithField("type", conflict.Type).Warn("dropped buffered updates of another type")
+		selfmetrics.Add("write_behind.conflicts", 1)
+	}
+}
+
+func (c *writeBehindCollector) Update(ctx context.Context, metricType string, name string, value string) error {
+	metricType = strings.ToLower(metricType)
+	switch metricType {
+	case model.GaugeType:
+		gauge, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%w: %v", service.ErrInvalidValue, err)
+		}
+		if errType := c.checkType(ctx, metricType, name); errType != nil {
+			return errType
+		}
+		return c.add(ctx, metricType, name, func() bool {
+			_, ok := c.pending.Gauges[name]
+			c.pending.Gauges[name] = model.Gauge(gauge)
+			return !ok
+		})
+	case model.CounterType:
+		delta, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: %v", service.ErrInvalidValue, err)
+		}
+		if errType := c.checkType(ctx, metricType, name); errType != nil {
+			return errType
+		}
+		return c.add(ctx, metricType, name, func() bool {
+			_, ok := c.pending.Counters[name]
+			c.pending.Counters[name] += model.Counter(delta)
+			return !ok
+		})
+	default:
+		return c.Collector.Update(ctx, metricType, name, value)
+	}
+}
+
+// AddGauge adds delta to a pending gauge. Other gauges are changed in the
+// collector while no flush runs, so that a batch on its way cannot
+// overwrite the change with an older value.
+func (c *writeBehindCollector) AddGauge(ctx context.Context, name string, delta model.Gauge) error {
+	c.flushing.RLock()
+	defer c.flushing.RUnlock()
+	c.mu.Lock()
+	if value, ok := c.pending.Gauges[name]; ok {
+		c.pending.Gauges[name] = value + delta
+		c.sources[service.Change{Type: model.GaugeType, ID: name}] = service.SourceOf(ctx)
+		c.mu.Unlock()
+		return nil
+	}
+	c.mu.Unlock()
+	return c.Collector.AddGauge(ctx, name, delta)
+}
+
+// checkType rejects the updates that the collector would reject at the
+// flush: those of another type than the metadata and, when conflicts are
+// rejected, those of a metric that has values of another type.
+func (c *writeBehindCollector) checkType(ctx context.Context, metricType string, name string) error {
+	metadata, err := c.Collector.GetMetadata(ctx, name)
+	if err != nil && !errors.Is(err, service.ErrNotFound) {
+		return err
+	}
+	if metadata.Type != "" && metadata.Type != metricType {
+		return &service.ConflictError{ID: name, Type: metricType}
+	}
+	c.mu.Lock()
+	policy := c.conflicts
+	c.mu.Unlock()
+	if policy != service.ConflictReject {
+		return nil
+	}
+	exists, err := c.hasOtherType(ctx, metricType, name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return &service.ConflictError{ID: name, Type: metricType}
+	}
+	return nil
+}
+
+// hasOtherType reports whether the metric has a pending or stored value of
+// a type other than metricType.
+func (c *writeBehindCollector) hasOtherType(ctx context.Context, metricType string, name string) (bool, error) {
+	lookups := map[string]func() error{
+		model.GaugeType: func() error {
+			_, err := c.GetGauge(ctx, name)
+			return err
+		},
+		model.CounterType: func() error {
+			_, err := c.GetCounter(ctx, name)
+			return err
+		},
+		model.HistogramType: func() error {
+			_, err := c.Collector.GetHistogram(ctx, name)
+			return err
+		},
+	}
+	for other, lookup := range lookups {
+		if other == metricType {
+			continue
+		}
+		err := lookup()
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, service.ErrNotFound) {
+			return false, err
+		}
+	}
+	return false, nil
+}
+
+// add applies an update to the pending metrics, which reports whether it
+// added a metric. When the buffer is full it waits for a flush, unless the
+// metric is already pending, and fails when the last flush failed, as the
+// buffer stays full until the collector is back. When conflicts migrate, a pending value of the
+// other type is dropped, as the flush would delete it.
+func (c *writeBehindCollector) add(ctx context.Context, metricType string, name string, apply func() bool) error {
+	c.mu.Lock()
+	for c.size() >= c.capacity {
+		_, gauge := c.pending.Gauges[name]
+		_, counter := c.pending.Counters[name]
+		if gauge || counter {
+			break
+		}
+		if c.failed != nil {
+			err := c.failed
+			c.mu.Unlock()
+			selfmetrics.Add("write_behind.dropped", 1)
+			return fmt.Errorf("write buffer is full: %w", err)
+		}
+		space := c.space
+		c.mu.Unlock()
+		c.notifyFull()
+		selfmetrics.Add("write_behind.waits", 1)
+		select {
+		case <-space:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		c.mu.Lock()
+	}
+	if c.conflicts == service.ConflictMigrate {
+		other := model.CounterType
+		if metricType == model.CounterType {
+			other = model.GaugeType
+		}
+		c.pending.Delete(other, name)
+		delete(c.sources, service.Change{Type: other, ID: name})
+	}
+	added := apply()
+	c.sources[service.Change{Type: metricType, ID: name}] = service.SourceOf(ctx)
+	full := added && c.size() >= c.batch
+	c.mu.Unlock()
+	if full {
+		c.notifyFull()
+	}
+	return nil
+}
+
+func (c *writeBehindCollector) notifyFull() {
+	select {
+	case c.full <- struct{}{}:
+	default:
+	}
+}
+
+func (c *writeBehindCollector) GetGauge(ctx context.Context, name string) (model.Gauge, error) {
+	c.flushing.RLock()
+	defer c.flushing.RUnlock()
+	c.mu.Lock()
+	value, ok := c.pending.Gauges[name]
+	c.mu.Unlock()
+	if ok {
+		return value, nil
+	}
+	return c.Collector.GetGauge(ctx, name)
+}
+
+func (c *writeBehindCollector) GetCounter(ctx context.Context, name string) (model.Counter, error) {
+	c.flushing.RLock()
+	defer c.flushing.RUnlock()
+	c.mu.Lock()
+	delta, ok := c.pending.Counters[name]
+	c.mu.Unlock()
+	value, err := c.Collector.GetCounter(ctx, name)
+	if errors.Is(err, service.ErrNotFound) && ok {
+		return delta, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return value + delta, nil
+}
+
+// GetStorage, Export and Import flush first, so they see and keep the order
+// of the pending updates.
+func (c *writeBehindCollector) GetStorage(ctx context.Context) model.Storage {
+	if err := c.Flush(ctx); err != nil {
+		log.WithError(err).Error("unable to write buffered metrics")
+	}
+	return c.Collector.GetStorage(ctx)
+}
+
+func (c *writeBehindCollector) Export(ctx context.Context) (model.Storage, error) {
+	if err := c.Flush(ctx); err != nil {
+		return model.Storage{}, err
+	}
+	return c.Collector.Export(ctx)
+}
+
+func (c *writeBehindCollector) Import(ctx context.Context, storage model.Storage, mode service.ImportMode) error {
+	if err := c.Flush(ctx); err != nil {
+		return err
+	}
+	return c.Collector.Import(ctx, storage, mode)
+}
+
+// Close stops the flushes, writes the pending updates and closes the
+// collector.
+func (c *writeBehindCollector) Close() {
+	c.close.Do(func() {
+		close(c.done)
+		<-c.stopped
+		if err := c.Flush(context.Background()); err != nil {
+			log.WithError(err).Error("unable to write buffered metrics, they are lost")
+		}
+		c.Collector.Close()
+	})
+}
@@ -0,0 +1,280 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NikWaltz/metrics-collector/internal/service"
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+// batchBackend records the imports of a write-behind buffer.
+type batchBackend struct {
+	Collector
+	mu      sync.Mutex
+	imports int
+	sources map[string]string
+	err     error
+	closed  bool
+}
+
+func newBatchBackend() *batchBackend {
+	return &batchBackend{Collector: service.NewService(model.NewStorage()), sources: make(map[string]string)}
+}
+
+func (b *batchBackend) Import(ctx context.Context, storage model.Storage, mode service.ImportMode) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.err != nil {
+		return b.err
+	}
+	b.imports++
+	for name := range storage.Gauges {
+		b.sources[name] = service.SourceFor(ctx, model.GaugeType, name)
+	}
+	for name := range storage.Counters {
+		b.sources[name] = service.SourceFor(ctx, model.CounterType, name)
+	}
+	return b.Collector.Import(ctx, storage, mode)
+}
+
+func (b *batchBackend) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+}
+
+func (b *batchBackend) setErr(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.err = err
+}
+
+func (b *batchBackend) importCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.imports
+}
+
+func TestWriteBehind_coalesces(t *testing.T) {
+	ctx := context.Background()
+	backend := newBatchBackend()
+	assert.NoError(t, backend.Update(ctx, "counter", "PollCount", "10"))
+	c := WriteBehind(backend, time.Hour, 100, 100)
+	defer c.Close()
+
+	for _, value := range []string{"1", "2", "3.5"} {
+		assert.NoError(t, c.Update(ctx, "gauge", "Alloc", value))
+		assert.NoError(t, c.Update(ctx, "Counter", "PollCount", value[:1]))
+	}
+	assert.NoError(t, c.Update(ctx, "counter", "Requests", "4"))
+	assert.True(t, errors.Is(c.Update(ctx, "counter", "Requests", "x"), service.ErrInvalidValue))
+
+	_, err := backend.GetGauge(ctx, "Alloc")
+	assert.ErrorIs(t, err, service.ErrNotFound)
+	gauge, err := c.GetGauge(ctx, "Alloc")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Gauge(3.5), gauge)
+	counter, err := c.GetCounter(ctx, "PollCount")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Counter(16), counter)
+	counter, err = c.GetCounter(ctx, "Requests")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Counter(4), counter)
+
+	assert.NoError(t, c.Flush(ctx))
+	assert.Equal(t, 1, backend.importCount())
+	counter, err = backend.GetCounter(ctx, "PollCount")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Counter(16), counter)
+	counter, err = c.GetCounter(ctx, "PollCount")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Counter(16), counter)
+}
+
+func TestWriteBehind_flushesFullBatch(t *testing.T) {
+	ctx := context.Background()
+	backend := newBatchBackend()
+	c := WriteBehind(backend, time.Hour, 2, 10)
+	defer c.Close()
+
+	assert.NoError(t, c.Update(ctx, "counter", "A", "1"))
+	assert.NoError(t, c.Update(ctx, "counter", "A", "1"))
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, 0, backend.importCount())
+
+	assert.NoError(t, c.Update(ctx, "gauge", "B", "1"))
+	assert.Eventually(t, func() bool { return backend.importCount() == 1 }, time.Second, 5*time.Millisecond)
+}
+
+func TestWriteBehind_flushesOnInterval(t *testing.T) {
+	ctx := context.Background()
+	backend := newBatchBackend()
+	c := WriteBehind(backend, 10*time.Millisecond, 100, 100)
+	defer c.Close()
+
+	assert.NoError(t, c.Update(ctx, "counter", "A", "1"))
+	assert.Eventually(t, func() bool { return backend.importCount() == 1 }, time.Second, 5*time.Millisecond)
+}
+
+func TestWriteBehind_backpressure(t *testing.T) {
+	ctx := context.Background()
+	backend := newBatchBackend()
+	c := WriteBehind(backend, time.Hour, 2, 2)
+	defer c.Close()
+
+	// Hold the backend, so that the flush of the full buffer waits in the
+	// import while the buffer fills up again.
+	backend.mu.Lock()
+	backend.err = errors.New("database is down")
+	assert.NoError(t, c.Update(ctx, "gauge", "A", "1"))
+	assert.NoError(t, c.Update(ctx, "counter", "B", "1"))
+	assert.Eventually(t, func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.size() == 0
+	}, time.Second, 5*time.Millisecond)
+	assert.NoError(t, c.Update(ctx, "gauge", "D", "1"))
+	assert.NoError(t, c.Update(ctx, "counter", "E", "1"))
+	// Metrics that are pending take more updates.
+	assert.NoError(t, c.Update(ctx, "counter", "E", "1"))
+
+	timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, c.Update(timeout, "counter", "C", "1"), context.DeadlineExceeded)
+
+	waiting := make(chan error)
+	go func() {
+		waiting <- c.Update(ctx, "counter", "C", "1")
+	}()
+	select {
+	case <-waiting:
+		t.Fatal("update did not wait for room")
+	case <-time.After(20 * time.Millisecond):
+	}
+	// The flush fails and keeps the batch. The waiting update fails instead
+	// of waiting for the database.
+	backend.mu.Unlock()
+	select {
+	case err := <-waiting:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("update still waits after a failed flush")
+	}
+	assert.Error(t, c.Update(ctx, "counter", "C", "1"))
+	// Updates of pending metrics are newer than the failed batch.
+	assert.NoError(t, c.Update(ctx, "gauge", "A", "2"))
+
+	backend.setErr(nil)
+	// The next tick.
+	assert.NoError(t, c.Flush(ctx))
+	assert.NoError(t, c.Update(ctx, "counter", "C", "1"))
+	assert.NoError(t, c.Flush(ctx))
+	gauge, err := backend.GetGauge(ctx, "A")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Gauge(2), gauge)
+	for name, want := range map[string]model.Counter{"B": 1, "C": 1, "E": 2} {
+		counter, err := backend.GetCounter(ctx, name)
+		assert.NoError(t, err)
+		assert.Equal(t, want, counter, name)
+	}
+}
+
+func TestWriteBehind_AddGauge(t *testing.T) {
+	ctx := context.Background()
+	backend := newBatchBackend()
+	assert.NoError(t, backend.Update(ctx, "gauge", "Stored", "10"))
+	c := WriteBehind(backend, time.Hour, 100, 100)
+	defer c.Close()
+
+	// A pending gauge takes the change in the buffer.
+	assert.NoError(t, c.Update(ctx, "gauge", "Pending", "1"))
+	assert.NoError(t, c.AddGauge(ctx, "Pending", 2))
+	_, err := backend.GetGauge(ctx, "Pending")
+	assert.ErrorIs(t, err, service.ErrNotFound)
+	gauge, err := c.GetGauge(ctx, "Pending")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Gauge(3), gauge)
+
+	// Other gauges change in the collector.
+	assert.NoError(t, c.AddGauge(ctx, "Stored", -0.5))
+	gauge, err = backend.GetGauge(ctx, "Stored")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Gauge(9.5), gauge)
+}
+
+func TestWriteBehind_Close(t *testing.T) {
+	ctx := context.Background()
+	backend := newBatchBackend()
+	c := WriteBehind(backend, time.Hour, 100, 100)
+	assert.NoError(t, c.Update(ctx, "counter", "A", "3"))
+	assert.NoError(t, c.Update(ctx, "histogram", "Latency", "0.5"))
+	// Histograms are not buffered.
+	_, err := backend.GetHistogram(ctx, "Latency")
+	assert.NoError(t, err)
+
+	c.Close()
+	c.Close()
+	assert.True(t, backend.closed)
+	counter, err := backend.GetCounter(ctx, "A")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Counter(3), counter)
+}
+
+func TestWriteBehind_conflicts(t *testing.T) {
+	ctx := context.Background()
+	backend := newBatchBackend()
+	assert.NoError(t, backend.SetMetadata(ctx, model.Metadata{ID: "Alloc", Type: model.GaugeType}))
+	assert.NoError(t, backend.Update(ctx, "gauge", "Mem", "72"))
+	c := WriteBehind(backend, time.Hour, 100, 100)
+	defer c.Close()
+
+	var conflict *service.ConflictError
+	assert.ErrorAs(t, c.Update(ctx, "counter", "Alloc", "1"), &conflict)
+	assert.NoError(t, c.Update(ctx, "counter", "Mem", "1"), "conflicts are allowed by default")
+
+	c.SetConflictPolicy(service.ConflictReject)
+	assert.ErrorAs(t, c.Update(ctx, "counter", "Mem", "1"), &conflict)
+	assert.NoError(t, c.Update(ctx, "gauge", "Sys", "1"))
+	assert.ErrorAs(t, c.Update(ctx, "counter", "Sys", "1"), &conflict, "pending values count")
+
+	c.SetConflictPolicy(service.ConflictMigrate)
+	assert.NoError(t, c.Update(ctx, "counter", "Sys", "2"))
+	_, err := c.GetGauge(ctx, "Sys")
+	assert.ErrorIs(t, err, service.ErrNotFound)
+
+	// Metadata registered after the update was buffered drops it.
+	assert.NoError(t, c.Update(ctx, "counter", "Frees", "1"))
+	assert.NoError(t, backend.SetMetadata(ctx, model.Metadata{ID: "Frees", Type: model.GaugeType}))
+	assert.NoError(t, c.Flush(ctx))
+	_, err = c.GetCounter(ctx, "Frees")
+	assert.ErrorIs(t, err, service.ErrNotFound)
+	counter, err := c.GetCounter(ctx, "Sys")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Counter(2), counter)
+}
+
+func TestWriteBehind_sources(t *testing.T) {
+	backend := newBatchBackend()
+	c := WriteBehind(backend, time.Hour, 100, 100)
+	defer c.Close()
+
+	agentA := service.WithSource(context.Background(), "agent-a")
+	agentB := service.WithSource(context.Background(), "agent-b")
+	assert.NoError(t, c.Update(agentA, "gauge", "Alloc", "1"))
+	assert.NoError(t, c.Update(agentA, "counter", "PollCount", "1"))
+	assert.NoError(t, c.Update(agentB, "counter", "PollCount", "1"))
+	assert.NoError(t, c.Update(context.Background(), "gauge", "Mem", "1"))
+	assert.NoError(t, c.Flush(agentA))
+
+	assert.Equal(t, 1, backend.importCount(), "one import for all agents")
+	assert.Equal(t, map[string]string{"Alloc": "agent-a", "PollCount": "agent-b", "Mem": ""}, backend.sources)
+	counter, err := backend.GetCounter(context.Background(), "PollCount")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Counter(2), counter)
+}
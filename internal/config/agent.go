@@ -0,0 +1,101 @@
+package config
+
+import (
+	"flag"
+	"time"
+
+	"github.com/NikWaltz/metrics-collector/internal/logger"
+)
+
+type Agent struct {
+	ConfigFile     string        `env:"CONFIG" yaml:"-"`
+	Address        string        `env:"ADDRESS" yaml:"address"`
+	PollInterval   time.Duration `env:"POLL_INTERVAL" yaml:"poll_interval"`
+	ReportInterval time.Duration `env:"REPORT_INTERVAL" yaml:"report_interval"`
+	Key            string        `env:"KEY" yaml:"key"`
+	KeyID          string        `env:"KEY_ID" yaml:"key_id"`
+	CryptoKey      string        `env:"CRYPTO_KEY" yaml:"crypto_key"`
+	TLS            bool          `env:"TLS" yaml:"tls"`
+	TLSCA          string        `env:"TLS_CA" yaml:"tls_ca"`
+	TLSCert        string        `env:"TLS_CERT" yaml:"tls_cert"`
+	TLSKey         string        `env:"TLS_KEY" yaml:"tls_key"`
+	LogLevel       string        `env:"LOG_LEVEL" yaml:"log_level"`
+	LogFormat      string        `env:"LOG_FORMAT" yaml:"log_format"`
+}
+
+func DefaultAgent() *Agent {
+	return &Agent{
+		Address:        "127.0.0.1:8080",
+		PollInterval:   time.Second * 2,
+		ReportInterval: time.Second * 10,
+		LogLevel:       "info",
+		LogFormat:      logger.FormatJSON,
+	}
+}
+
+func (c *Agent) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ConfigFile, "config", c.ConfigFile, "Config file path (JSON or YAML)")
+	fs.StringVar(&c.ConfigFile, "c", c.ConfigFile, "Config file path (shorthand)")
+	fs.StringVar(&c.Address, "a", c.Address, "Server address for sending metrics")
+	fs.DurationVar(&c.PollInterval, "p", c.PollInterval, "Poll metrics interval")
+	fs.DurationVar(&c.ReportInterval, "r", c.ReportInterval, "Sending report interval")
+	fs.StringVar(&c.Key, "k", c.Key, "Key for hash")
+	fs.StringVar(&c.KeyID, "kid", c.KeyID, "Key id of the agent in the server keyring")
+	fs.StringVar(&c.CryptoKey, "crypto-key", c.CryptoKey, "Public RSA key file of the server for encrypting payloads")
+	fs.BoolVar(&c.TLS, "tls", c.TLS, "Send metrics over HTTPS")
+	fs.StringVar(&c.TLSCA, "tls-ca", c.TLSCA, "CA bundle for verifying the server certificate")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "Client certificate file for mTLS")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "Client private key file for mTLS")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "Log level with optional per-component levels, e.g. info,agent=debug")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "Log format: json or text")
+}
+
+// LoadAgent builds the agent config from the command-line arguments
+// (without the program name), the environment and the config file.
+func LoadAgent(args []string) (*Agent, error) {
+	parsed := DefaultAgent()
+	fs := flag.NewFlagSet("agent", flag.ContinueOnError)
+	parsed.bindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := DefaultAgent()
+	if err := load(cfg, fs, cfg.bindFlags, parsed.ConfigFile); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Agent) Validate() error {
+	errs := &validationError{}
+	checkAddress(errs, "address", c.Address)
+	if c.PollInterval <= 0 {
+		errs.add("poll_interval must be positive")
+	}
+	if c.ReportInterval <= 0 {
+		errs.add("report_interval must be positive")
+	}
+	if c.KeyID != "" && c.Key == "" {
+		errs.add("key_id needs a key")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs.add("tls_cert and tls_key must be set together")
+	}
+	checkLogging(errs, c.LogLevel, c.LogFormat)
+	return errs.err()
+}
+
+func (c *Agent) UseTLS() bool {
+	return c.TLS || c.TLSCA != "" || c.TLSCert != ""
+}
+
+func (c *Agent) Scheme() string {
+	if c.UseTLS() {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,209 @@
+// Package config loads the settings of the server and the agent.
+//
+// Every setting may come from a command-line flag, an environment variable,
+// a JSON or YAML file given by -config/-c or CONFIG, or its default. When a
+// setting is set in several places, flags win over the environment, the
+// environment wins over the file and the file wins over the defaults.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caarlos0/env/v6"
+	"gopkg.in/yaml.v3"
+
+	"github.com/NikWaltz/metrics-collector/internal/logger"
+)
+
+// stringList is a comma separated flag. The first Set replaces the value
+// loaded from the file or the environment, repeated flags append to it.
+type stringList struct {
+	values *[]string
+	set    bool
+}
+
+func (l *stringList) String() string {
+	if l.values == nil {
+		return ""
+	}
+	return strings.Join(*l.values, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	if !l.set {
+		*l.values = nil
+		l.set = true
+	}
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			*l.values = append(*l.values, field)
+		}
+	}
+	return nil
+}
+
+type floatList struct {
+	values *[]float64
+}
+
+func (l *floatList) String() string {
+	if l.values == nil {
+		return ""
+	}
+	fields := make([]string, len(*l.values))
+	for i, value := range *l.values {
+		fields[i] = strconv.FormatFloat(value, 'g', -1, 64)
+	}
+	return strings.Join(fields, ",")
+}
+
+func (l *floatList) Set(value string) error {
+	var values []float64
+	for _, field := range strings.Split(value, ",") {
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return err
+		}
+		values = append(values, parsed)
+	}
+	*l.values = values
+	return nil
+}
+
+// load applies the config file, the environment and finally the flags that
+// were set in parsed to cfg. bind must register the same flags as parsed, using
+// the current fields of cfg as their defaults.
+func load(cfg interface{}, parsed *flag.FlagSet, bind func(*flag.FlagSet), configFile string) error {
+	if configFile == "" {
+		configFile = os.Getenv("CONFIG")
+	}
+	if configFile != "" {
+		if err := readFile(configFile, cfg); err != nil {
+			return err
+		}
+	}
+	if err := env.Parse(cfg); err != nil {
+		return err
+	}
+
+	final := flag.NewFlagSet(parsed.Name(), flag.ContinueOnError)
+	bind(final)
+	var errSet error
+	parsed.Visit(func(f *flag.Flag) {
+		if err := final.Set(f.Name, f.Value.String()); err != nil && errSet == nil {
+			errSet = fmt.Errorf("invalid value for flag -%s: %w", f.Name, err)
+		}
+	})
+	return errSet
+}
+
+// readFile decodes a JSON or YAML file. JSON is decoded by the YAML decoder
+// too, so durations are written as strings like "10s" in both formats.
+func readFile(fileName string, cfg interface{}) error {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".json":
+		var syntax interface{}
+		if errJSON := json.Unmarshal(data, &syntax); errJSON != nil {
+			return fmt.Errorf("config: %s is not valid JSON: %w", fileName, errJSON)
+		}
+	case ".yaml", ".yml":
+	default:
+		return fmt.Errorf("config: unsupported config file extension %q, use .json, .yaml or .yml", filepath.Ext(fileName))
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if errDecode := decoder.Decode(cfg); errDecode != nil {
+		return fmt.Errorf("config: %s: %w", fileName, errDecode)
+	}
+	return nil
+}
+
+// validationError collects every problem found in a config so that all of
+// them can be fixed at once.
+type validationError struct {
+	problems []string
+}
+
+func (e *validationError) add(format string, args ...interface{}) {
+	e.problems = append(e.problems, fmt.Sprintf(format, args...))
+}
+
+func (e *validationError) err() error {
+	if len(e.problems) == 0 {
+		return nil
+	}
+	return errors.New("invalid config: " + strings.Join(e.problems, "; "))
+}
+
+func checkAddress(errs *validationError, name string, address string) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		errs.add("%s %q must be in host:port form", name, address)
+	}
+}
+
+func checkLogging(errs *validationError, level string, format string) {
+	if _, _, err := logger.ParseLevels(level); err != nil {
+		errs.add("log_level: %v", err)
+	}
+	if format != logger.FormatJSON && format != logger.FormatText {
+		errs.add("log_format must be %s or %s", logger.FormatJSON, logger.FormatText)
+	}
+}
+
+func ParseSubnets(values []string) ([]*net.IPNet, error) {
+	var subnets []*net.IPNet
+	for _, value := range values {
+		_, subnet, err := net.ParseCIDR(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		subnets = append(subnets, subnet)
+	}
+	return subnets, nil
+}
+
+// WatchFile calls onChange whenever the modification time or the size of the
+// file changes, checking every interval until done is closed. A file that
+// cannot be read is reported once and checked again later.
+func WatchFile(fileName string, interval time.Duration, done <-chan struct{}, onChange func()) {
+	log := logger.For("config").WithField("file", fileName)
+	last, err := os.Stat(fileName)
+	if err != nil {
+		log.WithError(err).Warn("unable to watch config file")
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			info, errStat := os.Stat(fileName)
+			if errStat != nil {
+				if last != nil {
+					log.WithError(errStat).Warn("unable to watch config file")
+				}
+				last = nil
+				continue
+			}
+			if last == nil || !info.ModTime().Equal(last.ModTime()) || info.Size() != last.Size() {
+				last = info
+				onChange()
+			}
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeFile(t *testing.T, name string, content string) string {
+	fileName := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(fileName, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func setenv(t *testing.T, env map[string]string) {
+	for key, value := range env {
+		t.Setenv(key, value)
+	}
+}
+
+func TestLoadServer(t *testing.T) {
+	jsonFile := writeFile(t, "server.json", `{
+	"address": "0.0.0.0:9090",
+	"store_interval": "30s",
+	"restore": false,
+	"key": "from-file",
+	"trusted_subnet": ["10.0.0.0/8"],
+	"histogram_buckets": [1, 2.5, 10]
+}`)
+	yamlFile := writeFile(t, "server.yaml", `
+address: 0.0.0.0:9191
+store_interval: 1m
+key: from-yaml
+`)
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		check   func(t *testing.T, cfg *Server)
+		wantErr string
+	}{
+		{
+			name: "Defaults",
+			check: func(t *testing.T, cfg *Server) {
+				assert.Equal(t, DefaultServer(), cfg)
+			},
+		},
+		{
+			name: "JSON file over defaults",
+			args: []string{"-config", jsonFile},
+			check: func(t *testing.T, cfg *Server) {
+				assert.Equal(t, "0.0.0.0:9090", cfg.Address)
+				assert.Equal(t, 30*time.Second, cfg.StoreInterval)
+				assert.False(t, cfg.Restore)
+				assert.Equal(t, []string{"10.0.0.0/8"}, cfg.TrustedSubnet)
+				assert.Equal(t, []float64{1, 2.5, 10}, cfg.Buckets)
+				assert.Equal(t, "/tmp/devops-metrics-db.json", cfg.StoreFile)
+			},
+		},
+		{
+			name: "YAML file from environment",
+			env:  map[string]string{"CONFIG": yamlFile},
+			check: func(t *testing.T, cfg *Server) {
+				assert.Equal(t, "0.0.0.0:9191", cfg.Address)
+				assert.Equal(t, time.Minute, cfg.StoreInterval)
+				assert.Equal(t, "from-yaml", cfg.Key)
+			},
+		},
+		{
+			name: "Environment over file",
+			args: []string{"-c", jsonFile},
+			env:  map[string]string{"KEY": "from-env", "TRUSTED_SUBNET": "192.168.0.0/16,172.16.0.0/12"},
+			check: func(t *testing.T, cfg *Server) {
+				assert.Equal(t, "from-env", cfg.Key)
+				assert.Equal(t, []string{"192.168.0.0/16", "172.16.0.0/12"}, cfg.TrustedSubnet)
+				assert.Equal(t, "0.0.0.0:9090", cfg.Address)
+			},
+		},
+		{
+			name: "Flags over environment and file",
+			args: []string{"-c", jsonFile, "-k", "from-flag", "-t", "127.0.0.0/8", "-i", "5s", "-hb", "0.5,1"},
+			env:  map[string]string{"KEY": "from-env", "STORE_INTERVAL": "10s", "TRUSTED_SUBNET": "192.168.0.0/16"},
+			check: func(t *testing.T, cfg *Server) {
+				assert.Equal(t, "from-flag", cfg.Key)
+				assert.Equal(t, 5*time.Second, cfg.StoreInterval)
+				assert.Equal(t, []string{"127.0.0.0/8"}, cfg.TrustedSubnet)
+				assert.Equal(t, []float64{0.5, 1}, cfg.Buckets)
+				assert.Equal(t, "0.0.0.0:9090", cfg.Address)
+			},
+		},
+		{
+			name: "Config flag over config environment",
+			args: []string{"-config", jsonFile},
+			env:  map[string]string{"CONFIG": yamlFile},
+			check: func(t *testing.T, cfg *Server) {
+				assert.Equal(t, "from-file", cfg.Key)
+			},
+		},
+		{
+			name:    "Unknown field in file",
+			args:    []string{"-c", writeFile(t, "typo.yaml", "adress: 0.0.0.0:1\n")},
+			wantErr: "field adress not found",
+		},
+		{
+			name:    "Broken JSON",
+			args:    []string{"-c", writeFile(t, "broken.json", `{"address": `)},
+			wantErr: "is not valid JSON",
+		},
+		{
+			name:    "Unsupported extension",
+			args:    []string{"-c", writeFile(t, "server.toml", `address = "x"`)},
+			wantErr: "unsupported config file extension",
+		},
+		{
+			name:    "Missing file",
+			args:    []string{"-c", "/nonexistent/server.json"},
+			wantErr: "no such file",
+		},
+		{
+			name:    "Bad flag value",
+			args:    []string{"-hb", "1,x"},
+			wantErr: "invalid value",
+		},
+		{
+			name:    "Bad log settings",
+			args:    []string{"-log-level", "info,api=loud", "-log-format", "xml"},
+			wantErr: `log_level: not a valid logrus Level: "loud"; log_format must be json or text`,
+		},
+		{
+			name: "Seed file from environment",
+			env:  map[string]string{"DATABASE_DSN": "postgres://localhost/metrics", "SEED_FILE": "/var/lib/metrics.json"},
+			check: func(t *testing.T, cfg *Server) {
+				assert.Equal(t, "/var/lib/metrics.json", cfg.SeedFile)
+			},
+		},
+		{
+			name: "Migrate command",
+			args: []string{"-migrate", "down", "-d", "postgres://localhost/metrics"},
+			check: func(t *testing.T, cfg *Server) {
+				assert.Equal(t, "down", cfg.Migrate)
+			},
+		},
+		{
+			name:    "Unknown migrate command without database",
+			args:    []string{"-migrate", "sideways"},
+			wantErr: "migrate must be up, down or version; migrate needs a database_dsn",
+		},
+		{
+			name: "Type conflicts from environment",
+			env:  map[string]string{"TYPE_CONFLICTS": "migrate"},
+			check: func(t *testing.T, cfg *Server) {
+				assert.Equal(t, "migrate", cfg.TypeConflicts)
+			},
+		},
+		{
+			name:    "Unknown type conflict policy",
+			args:    []string{"-tc", "merge"},
+			wantErr: "type_conflicts must be allow, reject or migrate",
+		},
+		{
+			name: "Alerting rules",
+			args: []string{"-ar", "/etc/metrics/alerts.yaml", "-ai", "5s"},
+			check: func(t *testing.T, cfg *Server) {
+				assert.Equal(t, "/etc/metrics/alerts.yaml", cfg.AlertRules)
+				assert.Equal(t, 5*time.Second, cfg.AlertInterval)
+			},
+		},
+		{
+			name:    "Alerting rules without an interval",
+			env:     map[string]string{"ALERT_RULES": "/etc/metrics/alerts.yaml", "ALERT_INTERVAL": "0s"},
+			wantErr: "alert_interval must be positive",
+		},
+		{
+			name:    "Write-behind without database",
+			args:    []string{"-wb", "100ms", "-wbn", "100", "-wbs", "10"},
+			wantErr: "write_behind_interval needs a database_dsn; write_behind_batch must be positive and at most write_behind_buffer",
+		},
+		{
+			name:    "Seed file and notifications without database",
+			args:    []string{"-seed", "/var/lib/metrics.json", "-dn"},
+			wantErr: "seed_file needs a database_dsn; database_notify needs a database_dsn",
+		},
+		{
+			name:    "Validation reports every problem",
+			args:    []string{"-a", "localhost", "-t", "10.0.0.1", "-tls-cert", "server.crt", "-rs"},
+			wantErr: `invalid config: address "localhost" must be in host:port form; require_signed_body needs a key or a keyring_file; tls_cert and tls_key must be set together; trusted_subnet: invalid CIDR address: 10.0.0.1`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, tt.env)
+			cfg, err := LoadServer(tt.args)
+			if tt.wantErr != "" {
+				assert.Error(t, err)
+				if err != nil {
+					assert.Contains(t, err.Error(), tt.wantErr)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			if err == nil {
+				tt.check(t, cfg)
+			}
+		})
+	}
+}
+
+func TestLoadAgent(t *testing.T) {
+	yamlFile := writeFile(t, "agent.yml", `
+address: collector:8080
+poll_interval: 1s
+report_interval: 5s
+tls: true
+`)
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		check   func(t *testing.T, cfg *Agent)
+		wantErr string
+	}{
+		{
+			name: "Defaults",
+			check: func(t *testing.T, cfg *Agent) {
+				assert.Equal(t, DefaultAgent(), cfg)
+				assert.Equal(t, "http", cfg.Scheme())
+			},
+		},
+		{
+			name: "File, environment and flags",
+			args: []string{"-c", yamlFile, "-r", "20s"},
+			env:  map[string]string{"POLL_INTERVAL": "3s", "REPORT_INTERVAL": "30s"},
+			check: func(t *testing.T, cfg *Agent) {
+				assert.Equal(t, "collector:8080", cfg.Address)
+				assert.Equal(t, 3*time.Second, cfg.PollInterval)
+				assert.Equal(t, 20*time.Second, cfg.ReportInterval)
+				assert.Equal(t, "https", cfg.Scheme())
+			},
+		},
+		{
+			name:    "Invalid intervals",
+			args:    []string{"-p", "0s", "-kid", "agent-1"},
+			wantErr: "invalid config: poll_interval must be positive; key_id needs a key",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setenv(t, tt.env)
+			cfg, err := LoadAgent(tt.args)
+			if tt.wantErr != "" {
+				assert.Error(t, err)
+				if err != nil {
+					assert.Contains(t, err.Error(), tt.wantErr)
+				}
+				return
+			}
+			assert.NoError(t, err)
+			if err == nil {
+				tt.check(t, cfg)
+			}
+		})
+	}
+}
+
+func TestServer_RestartRequired(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *Server)
+		want   []string
+	}{
+		{
+			name: "Reloadable settings",
+			change: func(cfg *Server) {
+				cfg.Key = "new"
+				cfg.StoreInterval = time.Minute
+				cfg.ReplayWindow = time.Minute
+				cfg.TrustedSubnet = []string{"10.0.0.0/8"}
+			},
+		},
+		{
+			name: "Listener and storage",
+			change: func(cfg *Server) {
+				cfg.Address = "0.0.0.0:9090"
+				cfg.DatabaseDsn = "postgres://localhost/metrics"
+				cfg.ReplayWindow = 0
+			},
+			want: []string{"address", "database_dsn", "replay_window"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			next := DefaultServer()
+			tt.change(next)
+			assert.Equal(t, tt.want, DefaultServer().RestartRequired(next))
+		})
+	}
+}
+
+func TestWatchFile(t *testing.T) {
+	fileName := writeFile(t, "server.yaml", "key: a\n")
+	changes := make(chan struct{}, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go WatchFile(fileName, 5*time.Millisecond, done, func() {
+		changes <- struct{}{}
+	})
+
+	time.Sleep(20 * time.Millisecond)
+	if err := os.WriteFile(fileName, []byte("key: changed\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changes:
+	case <-time.After(time.Second):
+		t.Fatal("change of the config file was not noticed")
+	}
+}
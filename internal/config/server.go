@@ -0,0 +1,241 @@
+package config
+
+import (
+	"flag"
+	"reflect"
+	"time"
+
+	"github.com/NikWaltz/metrics-collector/internal/logger"
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+type Server struct {
+	ConfigFile    string        `env:"CONFIG" yaml:"-"`
+	ConfigWatch   time.Duration `env:"CONFIG_WATCH_INTERVAL" yaml:"config_watch_interval"`
+	Migrate       string        `yaml:"-"`
+	Address       string        `env:"ADDRESS" yaml:"address"`
+	StoreInterval time.Duration `env:"STORE_INTERVAL" yaml:"store_interval"`
+	StoreFile     string        `env:"STORE_FILE" yaml:"store_file"`
+	Restore       bool          `env:"RESTORE" yaml:"restore"`
+	DatabaseDsn   string        `env:"DATABASE_DSN" yaml:"database_dsn"`
+	SeedFile      string        `env:"SEED_FILE" yaml:"seed_file"`
+	DBNotify      bool          `env:"DATABASE_NOTIFY" yaml:"database_notify"`
+	CacheTTL      time.Duration `env:"CACHE_TTL" yaml:"cache_ttl"`
+	CacheSize     int           `env:"CACHE_SIZE" yaml:"cache_size"`
+	WriteBehind   time.Duration `env:"WRITE_BEHIND_INTERVAL" yaml:"write_behind_interval"`
+	WriteBatch    int           `env:"WRITE_BEHIND_BATCH" yaml:"write_behind_batch"`
+	WriteBuffer   int           `env:"WRITE_BEHIND_BUFFER" yaml:"write_behind_buffer"`
+	TypeConflicts string        `env:"TYPE_CONFLICTS" yaml:"type_conflicts"`
+	AlertRules    string        `env:"ALERT_RULES" yaml:"alert_rules"`
+	AlertInterval time.Duration `env:"ALERT_INTERVAL" yaml:"alert_interval"`
+	Key           string        `env:"KEY" yaml:"key"`
+	KeyringFile   string        `env:"KEYRING_FILE" yaml:"keyring_file"`
+	ReplayWindow  time.Duration `env:"REPLAY_WINDOW" yaml:"replay_window"`
+	RequireSigned bool          `env:"REQUIRE_SIGNED_BODY" yaml:"require_signed_body"`
+	CryptoKey     string        `env:"CRYPTO_KEY" yaml:"crypto_key"`
+	TLSCert       string        `env:"TLS_CERT" yaml:"tls_cert"`
+	TLSKey        string        `env:"TLS_KEY" yaml:"tls_key"`
+	TLSClientCA   string        `env:"TLS_CLIENT_CA" yaml:"tls_client_ca"`
+	TrustedSubnet []string      `env:"TRUSTED_SUBNET" envSeparator:"," yaml:"trusted_subnet"`
+	StatsdAddress string        `env:"STATSD_ADDRESS" yaml:"statsd_address"`
+	StatsdFlush   time.Duration `env:"STATSD_FLUSH_INTERVAL" yaml:"statsd_flush_interval"`
+	Buckets       []float64     `env:"HISTOGRAM_BUCKETS" envSeparator:"," yaml:"histogram_buckets"`
+	LogLevel      string        `env:"LOG_LEVEL" yaml:"log_level"`
+	SelfMetrics   time.Duration `env:"SELF_METRICS_INTERVAL" yaml:"self_metrics_interval"`
+	LogFormat     string        `env:"LOG_FORMAT" yaml:"log_format"`
+}
+
+func DefaultServer() *Server {
+	return &Server{
+		Address:       "127.0.0.1:8080",
+		StoreInterval: time.Second * 300,
+		StoreFile:     "/tmp/devops-metrics-db.json",
+		Restore:       true,
+		ReplayWindow:  time.Minute * 5,
+		StatsdFlush:   time.Second * 10,
+		LogLevel:      "info",
+		SelfMetrics:   time.Second * 10,
+		CacheSize:     10000,
+		WriteBatch:    1000,
+		WriteBuffer:   10000,
+		TypeConflicts: "allow",
+		AlertInterval: time.Second * 10,
+		LogFormat:     logger.FormatJSON,
+	}
+}
+
+func (c *Server) bindFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.ConfigFile, "config", c.ConfigFile, "Config file path (JSON or YAML)")
+	fs.StringVar(&c.ConfigFile, "c", c.ConfigFile, "Config file path (shorthand)")
+	fs.DurationVar(&c.ConfigWatch, "cw", c.ConfigWatch, "Reload the config file when it changes, checking at this interval")
+	fs.StringVar(&c.Address, "a", c.Address, "Server address")
+	fs.DurationVar(&c.StoreInterval, "i", c.StoreInterval, "Store to file interval")
+	fs.StringVar(&c.StoreFile, "f", c.StoreFile, "Store file path")
+	fs.BoolVar(&c.Restore, "r", c.Restore, "Restore storage from file")
+	fs.StringVar(&c.DatabaseDsn, "d", c.DatabaseDsn, "Data source name")
+	fs.BoolVar(&c.DBNotify, "dn", c.DBNotify, "Announce changes to the servers sharing the database with LISTEN/NOTIFY")
+	fs.DurationVar(&c.CacheTTL, "ct", c.CacheTTL, "Keep read metrics in memory for this long, 0 disables the cache")
+	fs.IntVar(&c.CacheSize, "cs", c.CacheSize, "Maximum number of cached metrics")
+	fs.DurationVar(&c.WriteBehind, "wb", c.WriteBehind, "Buffer gauge and counter updates and write them to the database at this interval, 0 writes at once")
+	fs.IntVar(&c.WriteBatch, "wbn", c.WriteBatch, "Write the buffered updates once this many metrics are pending")
+	fs.IntVar(&c.WriteBuffer, "wbs", c.WriteBuffer, "Maximum number of pending metrics; further updates wait for a write")
+	fs.StringVar(&c.TypeConflicts, "tc", c.TypeConflicts, "Writes of a metric as another type than it has: allow, reject or migrate")
+	fs.StringVar(&c.AlertRules, "ar", c.AlertRules, "Alerting rules file path (JSON or YAML)")
+	fs.DurationVar(&c.AlertInterval, "ai", c.AlertInterval, "Interval of checking the for-durations and absences of the alerting rules")
+	fs.StringVar(&c.Migrate, "migrate", c.Migrate, "Run a migration command on the database and exit: up, down or version")
+	fs.StringVar(&c.SeedFile, "seed", c.SeedFile, "Store file to seed the database from on its first start")
+	fs.StringVar(&c.Key, "k", c.Key, "Key for hash")
+	fs.StringVar(&c.KeyringFile, "kr", c.KeyringFile, "Per-agent keyring file path")
+	fs.DurationVar(&c.ReplayWindow, "rw", c.ReplayWindow, "Acceptance window of signed request timestamps")
+	fs.BoolVar(&c.RequireSigned, "rs", c.RequireSigned, "Require whole-body signatures and reject per-metric hashes")
+	fs.StringVar(&c.CryptoKey, "crypto-key", c.CryptoKey, "Private RSA key file for decrypting agent payloads")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "TLS certificate file")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "TLS private key file")
+	fs.StringVar(&c.TLSClientCA, "tls-client-ca", c.TLSClientCA, "CA bundle for verifying agent certificates (mTLS)")
+	fs.Var(&stringList{values: &c.TrustedSubnet}, "t", "Comma separated trusted subnets in CIDR notation")
+	fs.StringVar(&c.StatsdAddress, "s", c.StatsdAddress, "StatsD UDP listener address")
+	fs.DurationVar(&c.StatsdFlush, "si", c.StatsdFlush, "StatsD aggregation flush interval")
+	fs.Var(&floatList{values: &c.Buckets}, "hb", "Comma separated default histogram buckets")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "Log level with optional per-component levels, e.g. info,api=debug")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "Log format: json or text")
+	fs.DurationVar(&c.SelfMetrics, "mi", c.SelfMetrics, "Interval of publishing the collector's own metrics, 0 disables them")
+}
+
+// LoadServer builds the server config from the command-line arguments
+// (without the program name), the environment and the config file.
+func LoadServer(args []string) (*Server, error) {
+	parsed := DefaultServer()
+	fs := flag.NewFlagSet("server", flag.ContinueOnError)
+	parsed.bindFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	cfg := DefaultServer()
+	if err := load(cfg, fs, cfg.bindFlags, parsed.ConfigFile); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Server) Validate() error {
+	errs := &validationError{}
+	checkAddress(errs, "address", c.Address)
+	if c.DatabaseDsn == "" && c.StoreInterval <= 0 {
+		errs.add("store_interval must be positive")
+	}
+	if c.DatabaseDsn == "" && c.StoreFile == "" && c.Restore {
+		errs.add("restore needs a store_file")
+	}
+	switch c.Migrate {
+	case "", "up", "down", "version":
+	default:
+		errs.add("migrate must be up, down or version")
+	}
+	if c.Migrate != "" && c.DatabaseDsn == "" {
+		errs.add("migrate needs a database_dsn")
+	}
+	if c.SeedFile != "" && c.DatabaseDsn == "" {
+		errs.add("seed_file needs a database_dsn")
+	}
+	if c.DBNotify && c.DatabaseDsn == "" {
+		errs.add("database_notify needs a database_dsn")
+	}
+	if c.WriteBehind < 0 {
+		errs.add("write_behind_interval must not be negative")
+	}
+	if c.WriteBehind > 0 && c.DatabaseDsn == "" {
+		errs.add("write_behind_interval needs a database_dsn")
+	}
+	if c.WriteBehind > 0 && (c.WriteBatch <= 0 || c.WriteBuffer < c.WriteBatch) {
+		errs.add("write_behind_batch must be positive and at most write_behind_buffer")
+	}
+	switch c.TypeConflicts {
+	case "allow", "reject", "migrate":
+	default:
+		errs.add("type_conflicts must be allow, reject or migrate")
+	}
+	if c.AlertRules != "" && c.AlertInterval <= 0 {
+		errs.add("alert_interval must be positive")
+	}
+	if c.CacheTTL < 0 {
+		errs.add("cache_ttl must not be negative")
+	}
+	if c.CacheSize < 0 {
+		errs.add("cache_size must not be negative")
+	}
+	if c.ConfigWatch < 0 {
+		errs.add("config_watch_interval must not be negative")
+	}
+	if c.ReplayWindow < 0 {
+		errs.add("replay_window must not be negative")
+	}
+	if c.RequireSigned && c.Key == "" && c.KeyringFile == "" {
+		errs.add("require_signed_body needs a key or a keyring_file")
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs.add("tls_cert and tls_key must be set together")
+	}
+	if c.TLSClientCA != "" && c.TLSCert == "" {
+		errs.add("tls_client_ca needs tls_cert and tls_key")
+	}
+	if _, err := ParseSubnets(c.TrustedSubnet); err != nil {
+		errs.add("trusted_subnet: %v", err)
+	}
+	if c.StatsdAddress != "" {
+		checkAddress(errs, "statsd_address", c.StatsdAddress)
+		if c.StatsdFlush <= 0 {
+			errs.add("statsd_flush_interval must be positive")
+		}
+	}
+	checkLogging(errs, c.LogLevel, c.LogFormat)
+	if c.SelfMetrics < 0 {
+		errs.add("self_metrics_interval must not be negative")
+	}
+	if len(c.Buckets) > 0 {
+		if err := model.NewHistogram(c.Buckets).Validate(); err != nil {
+			errs.add("histogram_buckets: %v", err)
+		}
+	}
+	return errs.err()
+}
+
+// RestartRequired lists the settings that differ in next but cannot be
+// applied to a running server. The key, the keyring, the replay window, the
+// trusted subnets, the store interval and logging are reloaded in place.
+func (c *Server) RestartRequired(next *Server) []string {
+	var changed []string
+	check := func(name string, differs bool) {
+		if differs {
+			changed = append(changed, name)
+		}
+	}
+	check("address", c.Address != next.Address)
+	check("store_file", c.StoreFile != next.StoreFile)
+	check("restore", c.Restore != next.Restore)
+	check("database_dsn", c.DatabaseDsn != next.DatabaseDsn)
+	check("seed_file", c.SeedFile != next.SeedFile)
+	check("database_notify", c.DBNotify != next.DBNotify)
+	check("cache_ttl", c.CacheTTL != next.CacheTTL)
+	check("cache_size", c.CacheSize != next.CacheSize)
+	check("write_behind_interval", c.WriteBehind != next.WriteBehind)
+	check("write_behind_batch", c.WriteBatch != next.WriteBatch)
+	check("write_behind_buffer", c.WriteBuffer != next.WriteBuffer)
+	check("type_conflicts", c.TypeConflicts != next.TypeConflicts)
+	check("alert_rules", c.AlertRules != next.AlertRules)
+	check("alert_interval", c.AlertInterval != next.AlertInterval)
+	check("crypto_key", c.CryptoKey != next.CryptoKey)
+	check("tls_cert", c.TLSCert != next.TLSCert)
+	check("tls_key", c.TLSKey != next.TLSKey)
+	check("tls_client_ca", c.TLSClientCA != next.TLSClientCA)
+	check("statsd_address", c.StatsdAddress != next.StatsdAddress)
+	check("statsd_flush_interval", c.StatsdFlush != next.StatsdFlush)
+	check("histogram_buckets", !reflect.DeepEqual(c.Buckets, next.Buckets))
+	check("self_metrics_interval", c.SelfMetrics != next.SelfMetrics)
+	check("config_watch_interval", c.ConfigWatch != next.ConfigWatch)
+	check("replay_window", (c.ReplayWindow > 0) != (next.ReplayWindow > 0))
+	return changed
+}
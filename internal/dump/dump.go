@@ -0,0 +1,223 @@
+// Package dump encodes whole metric stores as NDJSON or CSV for moving them
+// between backends.
+//
+// NDJSON has one metric per line in the JSON format of the API. CSV has the
+// columns id, type and value, where the value of a histogram is its JSON.
+package dump
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+const (
+	FormatNDJSON = "ndjson"
+	FormatCSV    = "csv"
+)
+
+var csvHeader = []string{"id", "type", "value"}
+
+// ContentType returns the media type of the format.
+func ContentType(format string) string {
+	if format == FormatCSV {
+		return "text/csv"
+	}
+	return "application/x-ndjson"
+}
+
+// FormatOf returns the format of a media type, or "" when it is neither.
+func FormatOf(contentType string) string {
+	switch contentType {
+	case "application/x-ndjson", "application/ndjson":
+		return FormatNDJSON
+	case "text/csv":
+		return FormatCSV
+	}
+	return ""
+}
+
+// Metrics lists the metrics of the store sorted by type and name.
+func Metrics(storage model.Storage) []model.Metrics {
+	metrics := make([]model.Metrics, 0, len(storage.Gauges)+len(storage.Counters)+len(storage.Histograms))
+	for name, value := range storage.Gauges {
+		v := float64(value)
+		metrics = append(metrics, model.Metrics{ID: name, MType: model.GaugeType, Value: &v})
+	}
+	for name, value := range storage.Counters {
+		v := int64(value)
+		metrics = append(metrics, model.Metrics{ID: name, MType: model.CounterType, Delta: &v})
+	}
+	for name, value := range storage.Histograms {
+		v := value.Copy()
+		metrics = append(metrics, model.Metrics{ID: name, MType: model.HistogramType, Histogram: &v})
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].MType != metrics[j].MType {
+			return metrics[i].MType < metrics[j].MType
+		}
+		return metrics[i].ID < metrics[j].ID
+	})
+	return metrics
+}
+
+// Storage collects the metrics into a store. A later metric with the same
+// type and name replaces an earlier one. Metrics without the value of their
+// type are an error.
+func Storage(metrics []model.Metrics) (model.Storage, error) {
+	storage := *model.NewStorage()
+	for _, metric := range metrics {
+		switch strings.ToLower(metric.MType) {
+		case model.GaugeType:
+			if metric.Value == nil {
+				return storage, fmt.Errorf("gauge %s has no value", metric.ID)
+			}
+			storage.SaveGauge(metric.ID, model.Gauge(*metric.Value))
+		case model.CounterType:
+			if metric.Delta == nil {
+				return storage, fmt.Errorf("counter %s has no delta", metric.ID)
+			}
+			storage.SaveCounter(metric.ID, model.Counter(*metric.Delta))
+		case model.HistogramType:
+			if metric.Histogram == nil {
+				return storage, fmt.Errorf("histogram %s has no histogram", metric.ID)
+			}
+			storage.SaveHistogram(metric.ID, *metric.Histogram)
+		default:
+			return storage, fmt.Errorf("%s has unknown type %q", metric.ID, metric.MType)
+		}
+	}
+	return storage, nil
+}
+
+// Write encodes the metrics in the format.
+func Write(w io.Writer, format string, metrics []model.Metrics) error {
+	switch format {
+	case FormatNDJSON:
+		encoder := json.NewEncoder(w)
+		for _, metric := range metrics {
+			if err := encoder.Encode(metric); err != nil {
+				return err
+			}
+		}
+		return nil
+	case FormatCSV:
+		cw := csv.NewWriter(w)
+		if err := cw.Write(csvHeader); err != nil {
+			return err
+		}
+		for _, metric := range metrics {
+			value, err := csvValue(metric)
+			if err != nil {
+				return err
+			}
+			if errWrite := cw.Write([]string{metric.ID, metric.MType, value}); errWrite != nil {
+				return errWrite
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	default:
+		return fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func csvValue(metric model.Metrics) (string, error) {
+	switch {
+	case metric.Value != nil:
+		return strconv.FormatFloat(*metric.Value, 'g', -1, 64), nil
+	case metric.Delta != nil:
+		return strconv.FormatInt(*metric.Delta, 10), nil
+	case metric.Histogram != nil:
+		data, err := json.Marshal(metric.Histogram)
+		return string(data), err
+	}
+	return "", nil
+}
+
+// Read decodes metrics written by Write. Errors name the line they were
+// found on.
+func Read(r io.Reader, format string) ([]model.Metrics, error) {
+	switch format {
+	case FormatNDJSON:
+		return readNDJSON(r)
+	case FormatCSV:
+		return readCSV(r)
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+func readNDJSON(r io.Reader) ([]model.Metrics, error) {
+	var metrics []model.Metrics
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		var metric model.Metrics
+		if err := json.Unmarshal([]byte(text), &metric); err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics, scanner.Err()
+}
+
+func readCSV(r io.Reader) ([]model.Metrics, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var metrics []model.Metrics
+	for i, record := range records {
+		if i == 0 && strings.EqualFold(record[0], csvHeader[0]) {
+			continue
+		}
+		if len(record) != len(csvHeader) {
+			return nil, fmt.Errorf("line %d: want %d columns, got %d", i+1, len(csvHeader), len(record))
+		}
+		metric, errParse := parseCSV(record[0], record[1], record[2])
+		if errParse != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, errParse)
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics, nil
+}
+
+func parseCSV(id string, metricType string, value string) (model.Metrics, error) {
+	metric := model.Metrics{ID: id, MType: strings.ToLower(metricType)}
+	switch metric.MType {
+	case model.GaugeType:
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return metric, err
+		}
+		metric.Value = &v
+	case model.CounterType:
+		v, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return metric, err
+		}
+		metric.Delta = &v
+	case model.HistogramType:
+		var h model.Histogram
+		if err := json.Unmarshal([]byte(value), &h); err != nil {
+			return metric, err
+		}
+		metric.Histogram = &h
+	default:
+		return metric, fmt.Errorf("unknown type %q", metricType)
+	}
+	return metric, nil
+}
@@ -0,0 +1,89 @@
+package dump
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+func testStorage() model.Storage {
+	return model.Storage{
+		Gauges:     map[string]model.Gauge{"Alloc": 1.5, "Mem": 72},
+		Counters:   map[string]model.Counter{"PollCount": 5},
+		Histograms: map[string]model.Histogram{"GCPause": {Bounds: []float64{1}, Counts: []int64{1, 2}, Count: 3, Sum: 4.5}},
+		Metadata:   map[string]model.Metadata{},
+	}
+}
+
+func TestWriteRead(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		want   string
+	}{
+		{
+			name:   "NDJSON",
+			format: FormatNDJSON,
+			want: `{"id":"PollCount","type":"counter","delta":5}
+{"id":"Alloc","type":"gauge","value":1.5}
+{"id":"Mem","type":"gauge","value":72}
+{"id":"GCPause","type":"histogram","histogram":{"bounds":[1],"counts":[1,2],"count":3,"sum":4.5}}
+`,
+		},
+		{
+			name:   "CSV",
+			format: FormatCSV,
+			want: `id,type,value
+PollCount,counter,5
+Alloc,gauge,1.5
+Mem,gauge,72
+GCPause,histogram,"{""bounds"":[1],""counts"":[1,2],""count"":3,""sum"":4.5}"
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			assert.NoError(t, Write(&out, tt.format, Metrics(testStorage())))
+			assert.Equal(t, tt.want, out.String())
+
+			metrics, err := Read(&out, tt.format)
+			assert.NoError(t, err)
+			storage, err := Storage(metrics)
+			assert.NoError(t, err)
+			assert.Equal(t, testStorage(), storage)
+		})
+	}
+}
+
+func TestRead_errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		input  string
+		want   string
+	}{
+		{name: "Broken JSON line", format: FormatNDJSON, input: "{\"id\":\"a\",\"type\":\"gauge\",\"value\":1}\n{", want: "line 2"},
+		{name: "Missing CSV column", format: FormatCSV, input: "id,type,value\nAlloc,gauge\n", want: "wrong number of fields"},
+		{name: "Invalid counter", format: FormatCSV, input: "PollCount,counter,1.5\n", want: "line 1"},
+		{name: "Unknown type", format: FormatCSV, input: "Requests,summary,1\n", want: "unknown type"},
+		{name: "Unknown format", format: "xml", input: "", want: "unknown format"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Read(strings.NewReader(tt.input), tt.format)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tt.want)
+			}
+		})
+	}
+}
+
+func TestStorage_missingValue(t *testing.T) {
+	_, err := Storage([]model.Metrics{{ID: "Alloc", MType: model.GaugeType}})
+	assert.Error(t, err)
+}
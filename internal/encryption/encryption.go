@@ -0,0 +1,167 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Header names the scheme the request body was encrypted with.
+const Header = "X-Encryption"
+
+const (
+	// SchemeRSA encrypts the body directly with RSA-OAEP, which only fits
+	// payloads smaller than the key size.
+	SchemeRSA = "rsa-oaep"
+	// SchemeHybrid encrypts the body with a random AES-256-GCM key that is
+	// itself encrypted with RSA-OAEP. The body is laid out as
+	// [2 byte key length][encrypted key][nonce][ciphertext].
+	SchemeHybrid = "rsa-aes-gcm"
+)
+
+const aesKeySize = 32
+
+var ErrMalformed = errors.New("malformed encrypted body")
+
+func LoadPublicKey(fileName string) (*rsa.PublicKey, error) {
+	block, err := readPEM(fileName)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, errParse := x509.ParsePKIXPublicKey(block.Bytes)
+		if errParse != nil {
+			return nil, errParse
+		}
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("public key is not an RSA key")
+		}
+		return rsaKey, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
+
+func LoadPrivateKey(fileName string) (*rsa.PrivateKey, error) {
+	block, err := readPEM(fileName)
+	if err != nil {
+		return nil, err
+	}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, errParse := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if errParse != nil {
+			return nil, errParse
+		}
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("private key is not an RSA key")
+		}
+		return rsaKey, nil
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+}
+
+func readPEM(fileName string) (*pem.Block, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data in %s", fileName)
+	}
+	return block, nil
+}
+
+// maxRSASize is the largest plaintext RSA-OAEP with SHA-256 can encrypt.
+func maxRSASize(key *rsa.PublicKey) int {
+	return key.Size() - 2*sha256.Size - 2
+}
+
+// Encrypt picks plain RSA-OAEP for small bodies and the hybrid scheme for
+// anything that does not fit into a single RSA block.
+func Encrypt(key *rsa.PublicKey, data []byte) (string, []byte, error) {
+	if len(data) <= maxRSASize(key) {
+		out, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, data, nil)
+		return SchemeRSA, out, err
+	}
+
+	aesKey := make([]byte, aesKeySize)
+	if _, err := rand.Read(aesKey); err != nil {
+		return "", nil, err
+	}
+	encryptedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, key, aesKey, nil)
+	if err != nil {
+		return "", nil, err
+	}
+	gcm, err := newGCM(aesKey)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+
+	out := make([]byte, 2, 2+len(encryptedKey)+len(nonce)+len(data)+gcm.Overhead())
+	binary.BigEndian.PutUint16(out, uint16(len(encryptedKey)))
+	out = append(out, encryptedKey...)
+	out = append(out, nonce...)
+	out = gcm.Seal(out, nonce, data, nil)
+	return SchemeHybrid, out, nil
+}
+
+func Decrypt(key *rsa.PrivateKey, scheme string, data []byte) ([]byte, error) {
+	switch scheme {
+	case SchemeRSA:
+		return rsa.DecryptOAEP(sha256.New(), rand.Reader, key, data, nil)
+	case SchemeHybrid:
+		if len(data) < 2 {
+			return nil, ErrMalformed
+		}
+		keyLen := int(binary.BigEndian.Uint16(data))
+		data = data[2:]
+		if len(data) < keyLen {
+			return nil, ErrMalformed
+		}
+		aesKey, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, key, data[:keyLen], nil)
+		if err != nil {
+			return nil, err
+		}
+		data = data[keyLen:]
+		gcm, err := newGCM(aesKey)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < gcm.NonceSize() {
+			return nil, ErrMalformed
+		}
+		return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	default:
+		return nil, fmt.Errorf("unsupported encryption scheme %q", scheme)
+	}
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,101 @@
+package encryption
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writePEM(t *testing.T, fileName string, blockType string, data []byte) {
+	err := os.WriteFile(fileName, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		data       []byte
+		wantScheme string
+	}{
+		{
+			name:       "Encrypt small body",
+			data:       []byte(`{"id":"Alloc","type":"gauge","value":1}`),
+			wantScheme: SchemeRSA,
+		},
+		{
+			name:       "Encrypt large batch",
+			data:       bytes.Repeat([]byte(`{"id":"Alloc","type":"gauge","value":1},`), 1000),
+			wantScheme: SchemeHybrid,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheme, encrypted, err := Encrypt(&key.PublicKey, tt.data)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.wantScheme, scheme)
+			assert.NotEqual(t, tt.data, encrypted)
+
+			decrypted, err := Decrypt(key, scheme, encrypted)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.data, decrypted)
+
+			encrypted[len(encrypted)-1] ^= 0xff
+			_, err = Decrypt(key, scheme, encrypted)
+			assert.Error(t, err)
+		})
+	}
+
+	_, err = Decrypt(key, SchemeHybrid, []byte{0xff, 0xff, 1})
+	assert.Equal(t, ErrMalformed, err)
+	_, err = Decrypt(key, "rot13", []byte("data"))
+	assert.Error(t, err)
+}
+
+func TestLoadKeys(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkix, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, filepath.Join(dir, "pkcs1.pem"), "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key))
+	writePEM(t, filepath.Join(dir, "pkcs8.pem"), "PRIVATE KEY", pkcs8)
+	writePEM(t, filepath.Join(dir, "pkcs1.pub"), "RSA PUBLIC KEY", x509.MarshalPKCS1PublicKey(&key.PublicKey))
+	writePEM(t, filepath.Join(dir, "pkix.pub"), "PUBLIC KEY", pkix)
+	writePEM(t, filepath.Join(dir, "cert.pem"), "CERTIFICATE", []byte("junk"))
+
+	for _, name := range []string{"pkcs1.pem", "pkcs8.pem"} {
+		got, err := LoadPrivateKey(filepath.Join(dir, name))
+		assert.NoError(t, err, name)
+		assert.True(t, key.Equal(got), name)
+	}
+	for _, name := range []string{"pkcs1.pub", "pkix.pub"} {
+		got, err := LoadPublicKey(filepath.Join(dir, name))
+		assert.NoError(t, err, name)
+		assert.True(t, key.PublicKey.Equal(got), name)
+	}
+	_, err = LoadPrivateKey(filepath.Join(dir, "cert.pem"))
+	assert.Error(t, err)
+	_, err = LoadPublicKey(filepath.Join(dir, "missing.pub"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,117 @@
+// Package health runs named checks of the server components and reports
+// their results as JSON for liveness and readiness probes.
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const (
+	StatusOK   = "ok"
+	StatusFail = "fail"
+)
+
+// DefaultTimeout bounds every check, so that a hung dependency fails its own
+// check instead of the whole probe.
+const DefaultTimeout = 2 * time.Second
+
+type Result struct {
+	Status     string                 `json:"status"`
+	Error      string                 `json:"error,omitempty"`
+	Details    map[string]interface{} `json:"details,omitempty"`
+	DurationMs float64                `json:"duration_ms"`
+}
+
+type CheckFunc func(ctx context.Context) Result
+
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// OK returns a passing result with optional details.
+func OK(details map[string]interface{}) Result {
+	return Result{Status: StatusOK, Details: details}
+}
+
+// Fail returns a failing result for err with optional details.
+func Fail(err error, details map[string]interface{}) Result {
+	return Result{Status: StatusFail, Error: err.Error(), Details: details}
+}
+
+// FromError passes when err is nil.
+func FromError(err error) Result {
+	if err != nil {
+		return Fail(err, nil)
+	}
+	return OK(nil)
+}
+
+type Registry struct {
+	mu      sync.Mutex
+	checks  map[string]CheckFunc
+	timeout time.Duration
+}
+
+func NewRegistry() *Registry {
+	return &Registry{
+		checks:  make(map[string]CheckFunc),
+		timeout: DefaultTimeout,
+	}
+}
+
+// Add registers the check, replacing an earlier check with the same name.
+func (r *Registry) Add(name string, check CheckFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks[name] = check
+}
+
+// Run runs every check concurrently. The report fails when any check fails.
+func (r *Registry) Run(ctx context.Context) Report {
+	r.mu.Lock()
+	checks := make(map[string]CheckFunc, len(r.checks))
+	for name, check := range r.checks {
+		checks[name] = check
+	}
+	r.mu.Unlock()
+
+	report := Report{Status: StatusOK, Checks: make(map[string]Result, len(checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check CheckFunc) {
+			defer wg.Done()
+			result := r.run(ctx, check)
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[name] = result
+			if result.Status != StatusOK {
+				report.Status = StatusFail
+			}
+		}(name, check)
+	}
+	wg.Wait()
+	return report
+}
+
+func (r *Registry) run(ctx context.Context, check CheckFunc) Result {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	start := time.Now()
+	done := make(chan Result, 1)
+	go func() {
+		done <- check(ctx)
+	}()
+	var result Result
+	select {
+	case result = <-done:
+	case <-ctx.Done():
+		result = Fail(ctx.Err(), nil)
+	}
+	result.DurationMs = float64(time.Since(start).Microseconds()) / 1000
+	return result
+}
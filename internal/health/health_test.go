@@ -0,0 +1,70 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry_Run(t *testing.T) {
+	tests := []struct {
+		name       string
+		checks     map[string]CheckFunc
+		wantStatus string
+		wantChecks map[string]string
+	}{
+		{
+			name:       "No checks",
+			wantStatus: StatusOK,
+			wantChecks: map[string]string{},
+		},
+		{
+			name: "All passing",
+			checks: map[string]CheckFunc{
+				"storage":  func(ctx context.Context) Result { return OK(nil) },
+				"snapshot": func(ctx context.Context) Result { return OK(map[string]interface{}{"age_seconds": 1}) },
+			},
+			wantStatus: StatusOK,
+			wantChecks: map[string]string{"storage": StatusOK, "snapshot": StatusOK},
+		},
+		{
+			name: "One failing",
+			checks: map[string]CheckFunc{
+				"storage":  func(ctx context.Context) Result { return FromError(errors.New("connection refused")) },
+				"snapshot": func(ctx context.Context) Result { return OK(nil) },
+			},
+			wantStatus: StatusFail,
+			wantChecks: map[string]string{"storage": StatusFail, "snapshot": StatusOK},
+		},
+		{
+			name: "Hung check times out",
+			checks: map[string]CheckFunc{
+				"storage": func(ctx context.Context) Result {
+					time.Sleep(time.Second)
+					return OK(nil)
+				},
+			},
+			wantStatus: StatusFail,
+			wantChecks: map[string]string{"storage": StatusFail},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRegistry()
+			r.timeout = 50 * time.Millisecond
+			for name, check := range tt.checks {
+				r.Add(name, check)
+			}
+			report := r.Run(context.Background())
+			assert.Equal(t, tt.wantStatus, report.Status)
+			statuses := make(map[string]string)
+			for name, result := range report.Checks {
+				statuses[name] = result.Status
+			}
+			assert.Equal(t, tt.wantChecks, statuses)
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package keyring
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+var (
+	ErrUnknownKey = errors.New("unknown key id")
+	ErrRevokedKey = errors.New("revoked key id")
+	ErrExpiredKey = errors.New("expired key id")
+)
+
+// Key is a signing secret of a single agent. Several keys of the same agent
+// may be active at once while it is being rotated to a new one.
+type Key struct {
+	ID        string     `json:"id"`
+	Secret    string     `json:"secret"`
+	Revoked   bool       `json:"revoked,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+type Keyring struct {
+	keys map[string]Key
+	now  func() time.Time
+}
+
+func New(keys []Key) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]Key, len(keys)), now: time.Now}
+	for _, key := range keys {
+		if key.ID == "" {
+			return nil, errors.New("keyring: key id is empty")
+		}
+		if key.Secret == "" {
+			return nil, fmt.Errorf("keyring: key %q has an empty secret", key.ID)
+		}
+		if _, ok := k.keys[key.ID]; ok {
+			return nil, fmt.Errorf("keyring: duplicate key id %q", key.ID)
+		}
+		k.keys[key.ID] = key
+	}
+	return k, nil
+}
+
+// Load reads a keyring file of the form {"keys": [{"id": "...", "secret": "..."}]}.
+func Load(fileName string) (*Keyring, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var content struct {
+		Keys []Key `json:"keys"`
+	}
+	errDecode := json.NewDecoder(file).Decode(&content)
+	if errDecode != nil {
+		return nil, fmt.Errorf("keyring: %w", errDecode)
+	}
+	return New(content.Keys)
+}
+
+func (k *Keyring) Lookup(id string) (string, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return "", ErrUnknownKey
+	}
+	if key.Revoked {
+		return "", ErrRevokedKey
+	}
+	if key.ExpiresAt != nil && !k.now().Before(*key.ExpiresAt) {
+		return "", ErrExpiredKey
+	}
+	return key.Secret, nil
+}
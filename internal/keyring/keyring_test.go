@@ -0,0 +1,90 @@
+package keyring
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoad(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{
+			name:    "Load keyring",
+			content: `{"keys": [{"id": "agent-1", "secret": "old", "revoked": true}, {"id": "agent-1-v2", "secret": "new"}]}`,
+			wantErr: false,
+		},
+		{
+			name:    "Load keyring with duplicate ids",
+			content: `{"keys": [{"id": "agent-1", "secret": "a"}, {"id": "agent-1", "secret": "b"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "Load keyring with empty secret",
+			content: `{"keys": [{"id": "agent-1"}]}`,
+			wantErr: true,
+		},
+		{
+			name:    "Load broken file",
+			content: `{"keys": [`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fileName := filepath.Join(t.TempDir(), "keyring.json")
+			err := os.WriteFile(fileName, []byte(tt.content), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, errLoad := Load(fileName)
+			if tt.wantErr {
+				assert.Error(t, errLoad)
+			} else {
+				assert.NoError(t, errLoad)
+			}
+		})
+	}
+}
+
+func TestKeyring_Lookup(t *testing.T) {
+	now := time.Date(2023, 1, 10, 0, 0, 0, 0, time.UTC)
+	expired := now.Add(-time.Hour)
+	valid := now.Add(time.Hour)
+	k, err := New([]Key{
+		{ID: "current", Secret: "s1"},
+		{ID: "next", Secret: "s2", ExpiresAt: &valid},
+		{ID: "previous", Secret: "s3", ExpiresAt: &expired},
+		{ID: "stolen", Secret: "s4", Revoked: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k.now = func() time.Time { return now }
+
+	tests := []struct {
+		name    string
+		id      string
+		want    string
+		wantErr error
+	}{
+		{name: "Lookup active key", id: "current", want: "s1"},
+		{name: "Lookup key not yet expired", id: "next", want: "s2"},
+		{name: "Lookup expired key", id: "previous", wantErr: ErrExpiredKey},
+		{name: "Lookup revoked key", id: "stolen", wantErr: ErrRevokedKey},
+		{name: "Lookup unknown key", id: "other", wantErr: ErrUnknownKey},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := k.Lookup(tt.id)
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
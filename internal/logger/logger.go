@@ -0,0 +1,136 @@
+// Package logger provides leveled structured loggers for the components of
+// the server and the agent.
+//
+// Every component gets its own logger from For, so that its level can be set
+// apart from the others with a level spec like "info,api=debug,storage=warn":
+// the first entry without a name is the default level, the named entries
+// override it for a single component.
+package logger
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+type settings struct {
+	format     string
+	level      logrus.Level
+	components map[string]logrus.Level
+	output     io.Writer
+}
+
+var (
+	mu      sync.Mutex
+	loggers = make(map[string]*logrus.Logger)
+	current = settings{
+		format: FormatJSON,
+		level:  logrus.InfoLevel,
+		output: os.Stderr,
+	}
+)
+
+// For returns the logger of the component. Its entries carry the component
+// name in the "component" field.
+func For(component string) *logrus.Entry {
+	mu.Lock()
+	defer mu.Unlock()
+	l, ok := loggers[component]
+	if !ok {
+		l = logrus.New()
+		current.apply(component, l)
+		loggers[component] = l
+	}
+	return l.WithField("component", component)
+}
+
+// Configure changes the format and the levels of every logger, including the
+// ones already returned by For.
+func Configure(format string, levelSpec string) error {
+	next := settings{
+		format: format,
+		output: current.output,
+	}
+	if next.format == "" {
+		next.format = FormatJSON
+	}
+	if next.format != FormatJSON && next.format != FormatText {
+		return fmt.Errorf("unknown log format %q, use %s or %s", format, FormatJSON, FormatText)
+	}
+	var err error
+	next.level, next.components, err = ParseLevels(levelSpec)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	current = next
+	for component, l := range loggers {
+		current.apply(component, l)
+	}
+	return nil
+}
+
+// SetOutput redirects every logger, mostly for tests.
+func SetOutput(output io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	current.output = output
+	for component, l := range loggers {
+		current.apply(component, l)
+	}
+}
+
+// ParseLevels parses a level spec like "info,api=debug". An empty spec
+// means info for every component.
+func ParseLevels(spec string) (logrus.Level, map[string]logrus.Level, error) {
+	level := logrus.InfoLevel
+	components := make(map[string]logrus.Level)
+	for _, field := range strings.Split(spec, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		name, value := "", field
+		if i := strings.Index(field, "="); i >= 0 {
+			name, value = strings.TrimSpace(field[:i]), strings.TrimSpace(field[i+1:])
+			if name == "" {
+				return 0, nil, fmt.Errorf("log level %q has no component name", field)
+			}
+		}
+		parsed, err := logrus.ParseLevel(value)
+		if err != nil {
+			return 0, nil, err
+		}
+		if name == "" {
+			level = parsed
+		} else {
+			components[name] = parsed
+		}
+	}
+	return level, components, nil
+}
+
+func (s settings) apply(component string, l *logrus.Logger) {
+	l.SetOutput(s.output)
+	if s.format == FormatText {
+		l.SetFormatter(&logrus.TextFormatter{FullTimestamp: true})
+	} else {
+		l.SetFormatter(&logrus.JSONFormatter{})
+	}
+	level, ok := s.components[component]
+	if !ok {
+		level = s.level
+	}
+	l.SetLevel(level)
+}
@@ -0,0 +1,73 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseLevels(t *testing.T) {
+	tests := []struct {
+		name       string
+		spec       string
+		level      logrus.Level
+		components map[string]logrus.Level
+		wantErr    bool
+	}{
+		{
+			name:       "Empty",
+			level:      logrus.InfoLevel,
+			components: map[string]logrus.Level{},
+		},
+		{
+			name:       "Default and components",
+			spec:       "warn, api=debug,storage=error",
+			level:      logrus.WarnLevel,
+			components: map[string]logrus.Level{"api": logrus.DebugLevel, "storage": logrus.ErrorLevel},
+		},
+		{
+			name:    "Unknown level",
+			spec:    "api=loud",
+			wantErr: true,
+		},
+		{
+			name:    "Missing component",
+			spec:    "=debug",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			level, components, err := ParseLevels(tt.spec)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.level, level)
+			assert.Equal(t, tt.components, components)
+		})
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	api := For("test-api")
+	storage := For("test-storage")
+
+	assert.NoError(t, Configure(FormatJSON, "warn,test-api=debug"))
+	api.Debug("visible")
+	storage.Info("hidden")
+
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "visible", entry["msg"])
+	assert.Equal(t, "test-api", entry["component"])
+	assert.Equal(t, "debug", entry["level"])
+
+	assert.Error(t, Configure("xml", "info"))
+}
@@ -0,0 +1,98 @@
+package replay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	TimestampHeader = "X-Timestamp"
+	NonceHeader     = "X-Nonce"
+	HashHeader      = "HashSHA256"
+)
+
+var (
+	ErrStaleRequest  = errors.New("request timestamp is outside of the acceptance window")
+	ErrReplayedNonce = errors.New("request nonce was already used")
+	ErrEmptyNonce    = errors.New("request nonce is empty")
+)
+
+// Sign returns the HashSHA256 value of a request: HMAC-SHA256 over the
+// timestamp, the nonce, the request path and the uncompressed body.
+func Sign(key string, timestamp string, nonce string, path string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write([]byte(timestamp + "\n" + nonce + "\n" + path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func Verify(key string, timestamp string, nonce string, path string, body []byte, sign string) bool {
+	expected, err := hex.DecodeString(Sign(key, timestamp, nonce, path, body))
+	if err != nil {
+		return false
+	}
+	got, err := hex.DecodeString(sign)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(expected, got)
+}
+
+// Guard accepts a nonce once within the acceptance window around the current
+// time. Nonces are forgotten once their timestamp leaves the window, after
+// which the timestamp check alone rejects them.
+type Guard struct {
+	window    time.Duration
+	now       func() time.Time
+	mu        sync.Mutex
+	nonces    map[string]time.Time
+	lastPrune time.Time
+}
+
+func NewGuard(window time.Duration) *Guard {
+	return &Guard{
+		window: window,
+		now:    time.Now,
+		nonces: make(map[string]time.Time),
+	}
+}
+
+func (g *Guard) Check(timestamp time.Time, nonce string) error {
+	if nonce == "" {
+		return ErrEmptyNonce
+	}
+	now := g.now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if timestamp.Before(now.Add(-g.window)) || timestamp.After(now.Add(g.window)) {
+		return ErrStaleRequest
+	}
+	if now.Sub(g.lastPrune) > g.window {
+		g.prune(now)
+	}
+	if _, ok := g.nonces[nonce]; ok {
+		return ErrReplayedNonce
+	}
+	g.nonces[nonce] = timestamp.Add(g.window)
+	return nil
+}
+
+// SetWindow changes the acceptance window while keeping the nonces seen so far.
+func (g *Guard) SetWindow(window time.Duration) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.window = window
+}
+
+func (g *Guard) prune(now time.Time) {
+	for nonce, expires := range g.nonces {
+		if expires.Before(now) {
+			delete(g.nonces, nonce)
+		}
+	}
+	g.lastPrune = now
+}
@@ -0,0 +1,44 @@
+package replay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGuard_Check(t *testing.T) {
+	now := time.Date(2023, 1, 10, 12, 0, 0, 0, time.UTC)
+	g := NewGuard(time.Minute)
+	g.now = func() time.Time { return now }
+
+	assert.NoError(t, g.Check(now, "a"))
+	assert.Equal(t, ErrReplayedNonce, g.Check(now, "a"))
+	assert.NoError(t, g.Check(now.Add(-59*time.Second), "b"))
+	assert.NoError(t, g.Check(now.Add(59*time.Second), "c"))
+	assert.Equal(t, ErrStaleRequest, g.Check(now.Add(-2*time.Minute), "d"))
+	assert.Equal(t, ErrStaleRequest, g.Check(now.Add(2*time.Minute), "e"))
+	assert.Equal(t, ErrEmptyNonce, g.Check(now, ""))
+
+	now = now.Add(3 * time.Minute)
+	assert.NoError(t, g.Check(now, "f"))
+	assert.Len(t, g.nonces, 1)
+	assert.Equal(t, ErrStaleRequest, g.Check(now.Add(-3*time.Minute), "a"))
+
+	g.SetWindow(5 * time.Minute)
+	assert.NoError(t, g.Check(now.Add(-4*time.Minute), "g"))
+	assert.Equal(t, ErrReplayedNonce, g.Check(now, "f"))
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`[{"id":"Alloc","type":"gauge","value":1}]`)
+	sign := Sign("key", "1673352000", "nonce", "/updates/", body)
+
+	assert.True(t, Verify("key", "1673352000", "nonce", "/updates/", body, sign))
+	assert.False(t, Verify("other", "1673352000", "nonce", "/updates/", body, sign))
+	assert.False(t, Verify("key", "1673352001", "nonce", "/updates/", body, sign))
+	assert.False(t, Verify("key", "1673352000", "nonce2", "/updates/", body, sign))
+	assert.False(t, Verify("key", "1673352000", "nonce", "/update/", body, sign))
+	assert.False(t, Verify("key", "1673352000", "nonce", "/updates/", []byte("[]"), sign))
+	assert.False(t, Verify("key", "1673352000", "nonce", "/updates/", body, "zz"))
+}
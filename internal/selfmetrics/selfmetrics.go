@@ -0,0 +1,163 @@
+// Package selfmetrics collects metrics about the collector itself and
+// publishes them into the collector like any other metric, so they can be
+// read through the usual endpoints and scraped by Prometheus.
+//
+// Counters and histograms are published as deltas of the last interval,
+// gauges with their current value. Gauges that are cheaper to read on demand,
+// like the database pool stats, are registered as functions.
+package selfmetrics
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/NikWaltz/metrics-collector/internal/logger"
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+// Prefix starts the name of every metric about the collector.
+const Prefix = "collector."
+
+// LatencyBuckets are the bounds in seconds of the latency histograms.
+var LatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+var log = logger.For("selfmetrics")
+
+type Collector interface {
+	Update(ctx context.Context, metricType string, name string, value string) error
+	UpdateHistogram(ctx context.Context, name string, histogram model.Histogram) error
+}
+
+type registry struct {
+	mu         sync.Mutex
+	counters   map[string]int64
+	gauges     map[string]float64
+	histograms map[string]*model.Histogram
+	gaugeFuncs map[string]func() float64
+}
+
+var std = newRegistry()
+
+func newRegistry() *registry {
+	return &registry{
+		counters:   make(map[string]int64),
+		gauges:     make(map[string]float64),
+		histograms: make(map[string]*model.Histogram),
+		gaugeFuncs: make(map[string]func() float64),
+	}
+}
+
+// Add increases the counter by delta.
+func Add(name string, delta int64) {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	std.counters[Prefix+name] += delta
+}
+
+// Set changes the value of the gauge.
+func Set(name string, value float64) {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	std.gauges[Prefix+name] = value
+}
+
+// ObserveDuration adds the time passed since start in seconds to the latency
+// histogram.
+func ObserveDuration(name string, start time.Time) {
+	Observe(name, time.Since(start).Seconds(), LatencyBuckets)
+}
+
+// Observe adds the value to the histogram, creating it with the bounds on the
+// first observation.
+func Observe(name string, value float64, bounds []float64) {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	h, ok := std.histograms[Prefix+name]
+	if !ok {
+		created := model.NewHistogram(bounds)
+		h = &created
+		std.histograms[Prefix+name] = h
+	}
+	h.Observe(value)
+}
+
+// RegisterGauge reads the gauge with f on every publish.
+func RegisterGauge(name string, f func() float64) {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	std.gaugeFuncs[Prefix+name] = f
+}
+
+type snapshot struct {
+	counters   map[string]int64
+	gauges     map[string]float64
+	histograms map[string]*model.Histogram
+}
+
+// take returns what has to be published and starts the next interval.
+func (r *registry) take() snapshot {
+	r.mu.Lock()
+	s := snapshot{
+		counters:   r.counters,
+		gauges:     make(map[string]float64, len(r.gauges)+len(r.gaugeFuncs)),
+		histograms: r.histograms,
+	}
+	for name, value := range r.gauges {
+		s.gauges[name] = value
+	}
+	funcs := make(map[string]func() float64, len(r.gaugeFuncs))
+	for name, f := range r.gaugeFuncs {
+		funcs[name] = f
+	}
+	r.counters = make(map[string]int64)
+	r.histograms = make(map[string]*model.Histogram)
+	r.mu.Unlock()
+
+	for name, f := range funcs {
+		s.gauges[name] = f()
+	}
+	return s
+}
+
+func (r *registry) publish(ctx context.Context, collector Collector) {
+	s := r.take()
+	for name, value := range s.counters {
+		if value != 0 {
+			report(name, collector.Update(ctx, model.CounterType, name, strconv.FormatInt(value, 10)))
+		}
+	}
+	for name, value := range s.gauges {
+		report(name, collector.Update(ctx, model.GaugeType, name, strconv.FormatFloat(value, 'f', -1, 64)))
+	}
+	for name, h := range s.histograms {
+		report(name, collector.UpdateHistogram(ctx, name, *h))
+	}
+}
+
+func report(name string, err error) {
+	if err != nil {
+		log.WithError(err).WithField("metric", name).Error("unable to publish metric")
+	}
+}
+
+// Publish writes the metrics collected since the previous call to the
+// collector.
+func Publish(ctx context.Context, collector Collector) {
+	std.publish(ctx, collector)
+}
+
+// Run publishes the metrics every interval until done is closed.
+func Run(collector Collector, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			Publish(context.Background(), collector)
+		case <-done:
+			return
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package selfmetrics
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+type mockCollector struct {
+	updates    map[string]string
+	histograms map[string]model.Histogram
+}
+
+func newMockCollector() *mockCollector {
+	return &mockCollector{
+		updates:    make(map[string]string),
+		histograms: make(map[string]model.Histogram),
+	}
+}
+
+func (c *mockCollector) Update(ctx context.Context, metricType string, name string, value string) error {
+	c.updates[metricType+":"+name] = value
+	return nil
+}
+
+func (c *mockCollector) UpdateHistogram(ctx context.Context, name string, histogram model.Histogram) error {
+	c.histograms[name] = histogram
+	return nil
+}
+
+func TestPublish(t *testing.T) {
+	std = newRegistry()
+	Add("updates", 2)
+	Add("updates", 3)
+	Set("queue", 1.5)
+	Observe("latency", 0.2, []float64{0.1, 1})
+	pool := 4.0
+	RegisterGauge("db.pool.idle_conns", func() float64 { return pool })
+
+	first := newMockCollector()
+	Publish(context.Background(), first)
+	assert.Equal(t, map[string]string{
+		"counter:collector.updates":          "5",
+		"gauge:collector.queue":              "1.5",
+		"gauge:collector.db.pool.idle_conns": "4",
+	}, first.updates)
+	assert.Equal(t, []int64{0, 1, 0}, first.histograms["collector.latency"].Counts)
+
+	pool = 2
+	second := newMockCollector()
+	Publish(context.Background(), second)
+	assert.Equal(t, map[string]string{
+		"gauge:collector.queue":              "1.5",
+		"gauge:collector.db.pool.idle_conns": "2",
+	}, second.updates, "counters and histograms are published as deltas")
+	assert.Empty(t, second.histograms)
+}
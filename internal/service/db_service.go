@@ -2,42 +2,75 @@ package service
 
 import (
 	"context"
-	"log"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
 	"strings"
+	"time"
 
-	"github.com/golang-migrate/migrate/v4"
-	_ "github.com/golang-migrate/migrate/v4/database/postgres"
-	_ "github.com/golang-migrate/migrate/v4/source/file"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 
+	"github.com/NikWaltz/metrics-collector/internal/health"
+	"github.com/NikWaltz/metrics-collector/internal/selfmetrics"
 	"github.com/NikWaltz/metrics-collector/model"
 )
 
+// dbService keeps all metrics in Postgres and nothing in memory, so any
+// number of servers can share one database.
 type dbService struct {
-	storage model.Storage
-	pool    *pgxpool.Pool
+	pool      *pgxpool.Pool
+	notify    bool
+	conflicts ConflictPolicy
 }
 
-func NewDBService(storage *model.Storage, dsn string) *dbService {
-	m, err := migrate.New("file://migrations", dsn)
-	if err != nil {
-		log.Println(err)
-	}
-	errMigrate := m.Steps(2)
-	if errMigrate != nil {
-		log.Println(errMigrate)
+func NewDBService(dsn string) *dbService {
+	if err := migrateDB(dsn); err != nil {
+		log.WithError(err).Error("unable to migrate database")
 	}
 	pool, errPool := pgxpool.New(context.Background(), dsn)
 	if errPool != nil {
-		log.Println(errPool)
+		log.WithError(errPool).Error("unable to connect to database")
 	}
-	return &dbService{storage: *storage, pool: pool}
+	if pool != nil {
+		registerPoolStats(pool)
+	}
+	return &dbService{pool: pool, conflicts: ConflictAllow}
+}
+
+// SetNotify makes every write send a notification of the changed metrics,
+// see Listen. All servers sharing the database have to enable it.
+func (s *dbService) SetNotify(enabled bool) {
+	s.notify = enabled
+}
+
+// SetConflictPolicy sets what a write does to a metric with values of
+// another type.
+func (s *dbService) SetConflictPolicy(policy ConflictPolicy) {
+	s.conflicts = policy
+}
+
+func registerPoolStats(pool *pgxpool.Pool) {
+	selfmetrics.RegisterGauge("db.pool.total_conns", func() float64 { return float64(pool.Stat().TotalConns()) })
+	selfmetrics.RegisterGauge("db.pool.idle_conns", func() float64 { return float64(pool.Stat().IdleConns()) })
+	selfmetrics.RegisterGauge("db.pool.acquired_conns", func() float64 { return float64(pool.Stat().AcquiredConns()) })
+	selfmetrics.RegisterGauge("db.pool.max_conns", func() float64 { return float64(pool.Stat().MaxConns()) })
+	selfmetrics.RegisterGauge("db.pool.acquire_count", func() float64 { return float64(pool.Stat().AcquireCount()) })
+	selfmetrics.RegisterGauge("db.pool.acquire_seconds", func() float64 { return pool.Stat().AcquireDuration().Seconds() })
 }
 
 func (s *dbService) Ping(ctx context.Context) error {
+	if s.pool == nil {
+		return errNoPool
+	}
 	conn, err := s.pool.Acquire(ctx)
 	if err != nil {
-		log.Printf("Unable to acquire a database connection: %v\n", err)
+		log.WithError(err).Error("unable to acquire a database connection")
+		return err
 	}
 	defer conn.Release()
 	return conn.Ping(ctx)
@@ -46,14 +79,17 @@ func (s *dbService) Ping(ctx context.Context) error {
 func (s *dbService) GetGauge(ctx context.Context, id string) (model.Gauge, error) {
 	conn, err := s.pool.Acquire(ctx)
 	if err != nil {
-		log.Printf("Unable to acquire a database connection: %v\n", err)
+		log.WithError(err).Error("unable to acquire a database connection")
 		return 0, err
 	}
 	defer conn.Release()
 	var value model.Gauge
 	errRow := conn.QueryRow(ctx, `SELECT value FROM gauges WHERE id=$1;`, id).Scan(&value)
+	if errors.Is(errRow, pgx.ErrNoRows) {
+		return 0, ErrNotFound
+	}
 	if errRow != nil {
-		log.Println(errRow)
+		log.WithError(errRow).Error("query failed")
 		return 0, errRow
 	}
 	return value, nil
@@ -62,52 +98,674 @@ func (s *dbService) GetGauge(ctx context.Context, id string) (model.Gauge, error
 func (s *dbService) GetCounter(ctx context.Context, id string) (model.Counter, error) {
 	conn, err := s.pool.Acquire(ctx)
 	if err != nil {
-		log.Printf("Unable to acquire a database connection: %v\n", err)
+		log.WithError(err).Error("unable to acquire a database connection")
 		return 0, err
 	}
 	defer conn.Release()
 	var value model.Counter
 	errRow := conn.QueryRow(ctx, `SELECT value FROM counters WHERE id=$1;`, id).Scan(&value)
+	if errors.Is(errRow, pgx.ErrNoRows) {
+		return 0, ErrNotFound
+	}
 	if errRow != nil {
-		log.Println(errRow)
+		log.WithError(errRow).Error("query failed")
 		return 0, errRow
 	}
 	return value, nil
 }
 
+func (s *dbService) GetHistogram(ctx context.Context, id string) (model.Histogram, error) {
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		log.WithError(err).Error("unable to acquire a database connection")
+		return model.Histogram{}, err
+	}
+	defer conn.Release()
+	var value model.Histogram
+	errRow := conn.QueryRow(ctx, `SELECT bounds, counts, count, sum FROM histograms WHERE id=$1;`, id).
+		Scan(&value.Bounds, &value.Counts, &value.Count, &value.Sum)
+	if errors.Is(errRow, pgx.ErrNoRows) {
+		return model.Histogram{}, ErrNotFound
+	}
+	if errRow != nil {
+		log.WithError(errRow).Error("query failed")
+		return model.Histogram{}, errRow
+	}
+	return value, nil
+}
+
 func (s *dbService) GetStorage(ctx context.Context) model.Storage {
-	return s.storage
+	storage, err := s.Export(ctx)
+	if err != nil {
+		log.WithError(err).Error("unable to read metrics")
+	}
+	return storage
 }
 
 func (s *dbService) Update(ctx context.Context, metricType string, metricName string, metricValue string) error {
-	conn, err := s.pool.Acquire(ctx)
+	switch strings.ToLower(metricType) {
+	case model.GaugeType:
+		if _, errParse := strconv.ParseFloat(metricValue, 64); errParse != nil {
+			return invalidValue(errParse)
+		}
+		return s.write(ctx, model.GaugeType, metricName,
+			`INSERT INTO gauges(id, value, source) VALUES($1,$2,$3)
+			ON CONFLICT (id) DO UPDATE SET value=EXCLUDED.value, source=EXCLUDED.source, updated_at=now()`,
+			metricValue)
+	case model.CounterType:
+		if _, errParse := strconv.ParseInt(metricValue, 10, 64); errParse != nil {
+			return invalidValue(errParse)
+		}
+		return s.write(ctx, model.CounterType, metricName,
+			`INSERT INTO counters(id, value, source) VALUES($1,$2,$3)
+			ON CONFLICT (id) DO UPDATE SET value=EXCLUDED.value + counters.value, source=EXCLUDED.source, updated_at=now()`,
+			metricValue)
+	case model.HistogramType:
+		value, errParse := strconv.ParseFloat(metricValue, 64)
+		if errParse != nil {
+			return invalidValue(errParse)
+		}
+		return s.updateHistogram(ctx, metricName, func(histogram *model.Histogram) error {
+			if len(histogram.Counts) == 0 {
+				*histogram = model.NewHistogram(model.DefaultBuckets)
+			}
+			histogram.Observe(value)
+			return nil
+		})
+	default:
+		return &TypeError{}
+	}
+}
+
+// AddGauge changes a gauge by delta in one upsert, for relative updates. A
+// gauge that was never written starts at 0.
+func (s *dbService) AddGauge(ctx context.Context, metricName string, delta model.Gauge) error {
+	return s.write(ctx, model.GaugeType, metricName,
+		`INSERT INTO gauges(id, value, source) VALUES($1,$2,$3)
+		ON CONFLICT (id) DO UPDATE SET value=EXCLUDED.value + gauges.value, source=EXCLUDED.source, updated_at=now()`,
+		strconv.FormatFloat(float64(delta), 'f', -1, 64))
+}
+
+// write runs the upsert of a gauge or counter inside a transaction, after
+// checkTypes.
+func (s *dbService) write(ctx context.Context, metricType string, metricName string, query string, metricValue string) error {
+	tx, err := s.pool.Begin(ctx)
 	if err != nil {
-		log.Printf("Unable to acquire a database connection: %v\n", err)
+		log.WithError(err).Error("unable to begin a transaction")
 		return err
 	}
-	defer conn.Release()
-	switch strings.ToLower(metricType) {
-	case model.GaugeType:
-		_, errExec := conn.Query(ctx,
-			`INSERT INTO gauges(id, value) VALUES($1,$2) ON CONFLICT (id) DO UPDATE SET value=$2`, metricName, metricValue)
-		if errExec != nil {
-			log.Println(errExec)
-			return errExec
+	defer tx.Rollback(ctx)
+	if err := s.checkTypes(ctx, tx, []string{metricName}, metricType); err != nil {
+		return err
+	}
+	if _, errExec := tx.Exec(ctx, query, metricName, metricValue, sourceArg(ctx)); errExec != nil {
+		log.WithError(errExec).Error("query failed")
+		return errExec
+	}
+	s.notifyChanged(ctx, tx, Change{Type: metricType, ID: metricName})
+	return tx.Commit(ctx)
+}
+
+func (s *dbService) UpdateHistogram(ctx context.Context, metricName string, value model.Histogram) error {
+	if err := value.Validate(); err != nil {
+		return invalidValue(err)
+	}
+	return s.updateHistogram(ctx, metricName, func(histogram *model.Histogram) error {
+		if len(histogram.Counts) == 0 {
+			*histogram = value.Copy()
+			return nil
+		}
+		if err := histogram.Merge(value); err != nil {
+			return invalidValue(err)
 		}
 		return nil
-	case model.CounterType:
-		_, errExec := conn.Exec(ctx,
-			`INSERT INTO counters(id, value) VALUES($1,$2) ON CONFLICT (id) DO UPDATE SET value=EXCLUDED.value + counters.value`, metricName, metricValue)
+	})
+}
+
+// updateHistogram applies a change to the stored histogram inside a transaction.
+// A placeholder row with empty counts is inserted first so that concurrent
+// first writes of the same histogram serialize on the row lock.
+func (s *dbService) updateHistogram(ctx context.Context, metricName string, apply func(*model.Histogram) error) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		log.WithError(err).Error("unable to begin a transaction")
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if err := s.checkTypes(ctx, tx, []string{metricName}, model.HistogramType); err != nil {
+		return err
+	}
+	_, errExec := tx.Exec(ctx,
+		`INSERT INTO histograms(id, bounds, counts, count, sum) VALUES($1, '{}', '{}', 0, 0) ON CONFLICT (id) DO NOTHING`, metricName)
+	if errExec != nil {
+		log.WithError(errExec).Error("query failed")
+		return errExec
+	}
+	var histogram model.Histogram
+	errRow := tx.QueryRow(ctx, `SELECT bounds, counts, count, sum FROM histograms WHERE id=$1 FOR UPDATE;`, metricName).
+		Scan(&histogram.Bounds, &histogram.Counts, &histogram.Count, &histogram.Sum)
+	if errRow != nil && !errors.Is(errRow, pgx.ErrNoRows) {
+		log.WithError(errRow).Error("query failed")
+		return errRow
+	}
+	if err := apply(&histogram); err != nil {
+		return err
+	}
+	_, errExec = tx.Exec(ctx,
+		`UPDATE histograms SET bounds=$2, counts=$3, count=$4, sum=$5, source=$6, updated_at=now() WHERE id=$1`,
+		metricName, histogram.Bounds, histogram.Counts, histogram.Count, histogram.Sum, sourceArg(ctx))
+	if errExec != nil {
+		log.WithError(errExec).Error("query failed")
+		return errExec
+	}
+	s.notifyChanged(ctx, tx, Change{Type: model.HistogramType, ID: metricName})
+	return tx.Commit(ctx)
+}
+
+// Export reads all metrics from the tables.
+func (s *dbService) Export(ctx context.Context) (model.Storage, error) {
+	storage := *model.NewStorage()
+	tx, err := s.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		log.WithError(err).Error("unable to begin a transaction")
+		return storage, err
+	}
+	defer tx.Rollback(ctx)
+	rows, _ := tx.Query(ctx, `SELECT id, value FROM gauges;`)
+	var id string
+	var gauge model.Gauge
+	_, err = pgx.ForEachRow(rows, []interface{}{&id, &gauge}, func() error {
+		storage.SaveGauge(id, gauge)
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Error("query failed")
+		return storage, err
+	}
+	rows, _ = tx.Query(ctx, `SELECT id, value FROM counters;`)
+	var counter model.Counter
+	_, err = pgx.ForEachRow(rows, []interface{}{&id, &counter}, func() error {
+		storage.SaveCounter(id, counter)
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Error("query failed")
+		return storage, err
+	}
+	rows, _ = tx.Query(ctx, `SELECT id, bounds, counts, count, sum FROM histograms WHERE cardinality(counts) > 0;`)
+	var histogram model.Histogram
+	_, err = pgx.ForEachRow(rows, []interface{}{&id, &histogram.Bounds, &histogram.Counts, &histogram.Count, &histogram.Sum}, func() error {
+		storage.SaveHistogram(id, histogram.Copy())
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Error("query failed")
+		return storage, err
+	}
+	rows, _ = tx.Query(ctx, `SELECT id, type, unit, description, owner FROM metadata;`)
+	var metadata model.Metadata
+	_, err = pgx.ForEachRow(rows, []interface{}{&metadata.ID, &metadata.Type, &metadata.Unit, &metadata.Description, &metadata.Owner}, func() error {
+		storage.SaveMetadata(metadata.ID, metadata)
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Error("query failed")
+		return storage, err
+	}
+	return storage, tx.Commit(ctx)
+}
+
+// Import writes all metrics of the store in one transaction.
+func (s *dbService) Import(ctx context.Context, storage model.Storage, mode ImportMode) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		log.WithError(err).Error("unable to begin a transaction")
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if err := s.importTx(ctx, tx, storage, mode); err != nil {
+		return err
+	}
+	s.notifyChanged(ctx, tx, Change{})
+	return tx.Commit(ctx)
+}
+
+// importTx writes the metrics and metadata of the store inside tx.
+func (s *dbService) importTx(ctx context.Context, tx pgx.Tx, storage model.Storage, mode ImportMode) error {
+	for name, value := range storage.Histograms {
+		if err := value.Validate(); err != nil {
+			return invalidValue(fmt.Errorf("%s: %w", name, err))
+		}
+	}
+	if s.conflicts != ConflictAllow {
+		if err := mixedTypes(storage); err != nil {
+			return err
+		}
+	}
+	for name, value := range storage.Metadata {
+		value.ID = name
+		if err := setMetadata(ctx, tx, value); err != nil {
+			return err
+		}
+	}
+	gauges := make([]string, 0, len(storage.Gauges))
+	for name := range storage.Gauges {
+		gauges = append(gauges, name)
+	}
+	counters := make([]string, 0, len(storage.Counters))
+	for name := range storage.Counters {
+		counters = append(counters, name)
+	}
+	histograms := make([]string, 0, len(storage.Histograms))
+	for name := range storage.Histograms {
+		histograms = append(histograms, name)
+	}
+	if err := s.checkTypes(ctx, tx, gauges, model.GaugeType); err != nil {
+		return err
+	}
+	if err := s.checkTypes(ctx, tx, counters, model.CounterType); err != nil {
+		return err
+	}
+	if err := s.checkTypes(ctx, tx, histograms, model.HistogramType); err != nil {
+		return err
+	}
+	batch := &pgx.Batch{}
+	for name, value := range storage.Gauges {
+		batch.Queue(`INSERT INTO gauges(id, value, source) VALUES($1,$2,$3)
+			ON CONFLICT (id) DO UPDATE SET value=EXCLUDED.value, source=EXCLUDED.source, updated_at=now()`, name, value, metricSourceArg(ctx, model.GaugeType, name))
+	}
+	counterQuery := `INSERT INTO counters(id, value, source) VALUES($1,$2,$3)
+		ON CONFLICT (id) DO UPDATE SET value=EXCLUDED.value, source=EXCLUDED.source, updated_at=now()`
+	if mode == ImportAdd {
+		counterQuery = `INSERT INTO counters(id, value, source) VALUES($1,$2,$3)
+		ON CONFLICT (id) DO UPDATE SET value=EXCLUDED.value + counters.value, source=EXCLUDED.source, updated_at=now()`
+	}
+	for name, value := range storage.Counters {
+		batch.Queue(counterQuery, name, value, metricSourceArg(ctx, model.CounterType, name))
+	}
+	if errBatch := tx.SendBatch(ctx, batch).Close(); errBatch != nil {
+		log.WithError(errBatch).Error("query failed")
+		return errBatch
+	}
+	for name, value := range storage.Histograms {
+		if mode == ImportAdd {
+			var stored model.Histogram
+			errRow := tx.QueryRow(ctx, `SELECT bounds, counts, count, sum FROM histograms WHERE id=$1 FOR UPDATE;`, name).
+				Scan(&stored.Bounds, &stored.Counts, &stored.Count, &stored.Sum)
+			if errRow != nil && !errors.Is(errRow, pgx.ErrNoRows) {
+				log.WithError(errRow).Error("query failed")
+				return errRow
+			}
+			if len(stored.Counts) > 0 {
+				if errMerge := stored.Merge(value); errMerge != nil {
+					return invalidValue(fmt.Errorf("%s: %w", name, errMerge))
+				}
+				value = stored
+			}
+		}
+		_, errExec := tx.Exec(ctx,
+			`INSERT INTO histograms(id, bounds, counts, count, sum, source) VALUES($1,$2,$3,$4,$5,$6)
+			ON CONFLICT (id) DO UPDATE SET bounds=EXCLUDED.bounds, counts=EXCLUDED.counts, count=EXCLUDED.count, sum=EXCLUDED.sum,
+			source=EXCLUDED.source, updated_at=now()`,
+			name, value.Bounds, value.Counts, value.Count, value.Sum, metricSourceArg(ctx, model.HistogramType, name))
 		if errExec != nil {
-			log.Println(errExec)
+			log.WithError(errExec).Error("query failed")
 			return errExec
 		}
+	}
+	return nil
+}
+
+// valueTables holds the table of each type and the condition for a row
+// holding a value: histogram rows with empty counts are placeholders, see
+// updateHistogram.
+var valueTables = []struct {
+	metricType string
+	table      string
+	filter     string
+}{
+	{metricType: model.GaugeType, table: "gauges", filter: "true"},
+	{metricType: model.CounterType, table: "counters", filter: "true"},
+	{metricType: model.HistogramType, table: "histograms", filter: "cardinality(counts) > 0"},
+}
+
+// checkTypes prepares a write of the metrics as metricType like
+// service.checkType: it fails with the first of them whose metadata has
+// another type, or that has values of another type when conflicts are
+// rejected. When conflicts migrate, it deletes the values of the other types.
+func (s *dbService) checkTypes(ctx context.Context, tx pgx.Tx, names []string, metricType string) error {
+	if len(names) == 0 {
 		return nil
-	default:
-		return &TypeError{}
+	}
+	var id string
+	err := tx.QueryRow(ctx, `SELECT id FROM metadata WHERE id = ANY($1) AND type NOT IN ('', $2) ORDER BY id LIMIT 1;`,
+		names, metricType).Scan(&id)
+	if err == nil {
+		return &ConflictError{ID: id, Type: metricType}
+	}
+	if !errors.Is(err, pgx.ErrNoRows) {
+		log.WithError(err).Error("query failed")
+		return err
+	}
+	for _, other := range valueTables {
+		if other.metricType == metricType {
+			continue
+		}
+		switch s.conflicts {
+		case ConflictReject:
+			err := tx.QueryRow(ctx,
+				fmt.Sprintf(`SELECT id FROM %s WHERE id = ANY($1) AND %s ORDER BY id LIMIT 1;`, other.table, other.filter),
+				names).Scan(&id)
+			if err == nil {
+				return &ConflictError{ID: id, Type: metricType}
+			}
+			if !errors.Is(err, pgx.ErrNoRows) {
+				log.WithError(err).Error("query failed")
+				return err
+			}
+		case ConflictMigrate:
+			rows, _ := tx.Query(ctx, fmt.Sprintf(`DELETE FROM %s WHERE id = ANY($1) RETURNING id;`, other.table), names)
+			var deleted []string
+			_, err := pgx.ForEachRow(rows, []interface{}{&id}, func() error {
+				deleted = append(deleted, id)
+				return nil
+			})
+			if err != nil {
+				log.WithError(err).Error("query failed")
+				return err
+			}
+			for _, name := range deleted {
+				s.notifyChanged(ctx, tx, Change{Type: other.metricType, ID: name})
+			}
+		}
+	}
+	return nil
+}
+
+// setMetadata merges the non-empty fields of the metadata into the stored
+// ones. A type is only set when the metric has no other type yet, neither
+// in its metadata nor in its values.
+func setMetadata(ctx context.Context, db execer, metadata model.Metadata) error {
+	if err := checkMetadata(&metadata); err != nil {
+		return err
+	}
+	tag, err := db.Exec(ctx,
+		`INSERT INTO metadata(id, type, unit, description, owner) SELECT $1::text, $2::text, $3::text, $4::text, $5::text
+		WHERE $2 = '' OR (
+			NOT EXISTS (SELECT 1 FROM gauges WHERE id=$1 AND $2 <> 'gauge') AND
+			NOT EXISTS (SELECT 1 FROM counters WHERE id=$1 AND $2 <> 'counter') AND
+			NOT EXISTS (SELECT 1 FROM histograms WHERE id=$1 AND cardinality(counts) > 0 AND $2 <> 'histogram'))
+		ON CONFLICT (id) DO UPDATE SET type=COALESCE(NULLIF(EXCLUDED.type, ''), metadata.type),
+			unit=COALESCE(NULLIF(EXCLUDED.unit, ''), metadata.unit),
+			description=COALESCE(NULLIF(EXCLUDED.description, ''), metadata.description),
+			owner=COALESCE(NULLIF(EXCLUDED.owner, ''), metadata.owner), updated_at=now()
+		WHERE EXCLUDED.type IN ('', metadata.type) OR metadata.type = ''`,
+		metadata.ID, metadata.Type, metadata.Unit, metadata.Description, metadata.Owner)
+	if err != nil {
+		log.WithError(err).Error("query failed")
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return &ConflictError{ID: metadata.ID, Type: metadata.Type}
+	}
+	return nil
+}
+
+func (s *dbService) SetMetadata(ctx context.Context, metadata model.Metadata) error {
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		log.WithError(err).Error("unable to acquire a database connection")
+		return err
+	}
+	defer conn.Release()
+	return setMetadata(ctx, conn, metadata)
+}
+
+func (s *dbService) GetMetadata(ctx context.Context, name string) (model.Metadata, error) {
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		log.WithError(err).Error("unable to acquire a database connection")
+		return model.Metadata{}, err
+	}
+	defer conn.Release()
+	metadata := model.Metadata{ID: name}
+	errRow := conn.QueryRow(ctx, `SELECT type, unit, description, owner FROM metadata WHERE id=$1;`, name).
+		Scan(&metadata.Type, &metadata.Unit, &metadata.Description, &metadata.Owner)
+	if errors.Is(errRow, pgx.ErrNoRows) {
+		return model.Metadata{}, ErrNotFound
+	}
+	if errRow != nil {
+		log.WithError(errRow).Error("query failed")
+		return model.Metadata{}, errRow
+	}
+	return metadata, nil
+}
+
+// ListMetadata returns the metadata of all metrics ordered by name.
+func (s *dbService) ListMetadata(ctx context.Context) ([]model.Metadata, error) {
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		log.WithError(err).Error("unable to acquire a database connection")
+		return nil, err
+	}
+	defer conn.Release()
+	rows, _ := conn.Query(ctx, `SELECT id, type, unit, description, owner FROM metadata ORDER BY id;`)
+	list := []model.Metadata{}
+	var metadata model.Metadata
+	_, err = pgx.ForEachRow(rows, []interface{}{&metadata.ID, &metadata.Type, &metadata.Unit, &metadata.Description, &metadata.Owner}, func() error {
+		list = append(list, metadata)
+		return nil
+	})
+	if err != nil {
+		log.WithError(err).Error("query failed")
+		return nil, err
+	}
+	return list, nil
+}
+
+// Seed imports a store file of the file service into the database and
+// reports whether it did. It runs once per database: the seed is recorded in
+// the same transaction and later calls leave the database alone, so restarts
+// never add the counters of the file twice. Counters and histograms already
+// in the database are added to.
+func (s *dbService) Seed(ctx context.Context, fileName string) (bool, error) {
+	if s.pool == nil {
+		return false, errNoPool
+	}
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		log.WithError(err).Error("unable to begin a transaction")
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+	// Replicas starting together wait here for the first one to seed.
+	if _, errLock := tx.Exec(ctx, `LOCK TABLE seeds IN EXCLUSIVE MODE;`); errLock != nil {
+		log.WithError(errLock).Error("query failed")
+		return false, errLock
+	}
+	var seeded bool
+	if errRow := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM seeds);`).Scan(&seeded); errRow != nil {
+		log.WithError(errRow).Error("query failed")
+		return false, errRow
+	}
+	if seeded {
+		return false, nil
+	}
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return false, err
+	}
+	storage, err := decodeSnapshot(fileName, data)
+	if err != nil {
+		return false, err
+	}
+	if errImport := s.importTx(ctx, tx, storage, ImportAdd); errImport != nil {
+		return false, errImport
+	}
+	s.notifyChanged(ctx, tx, Change{})
+	checksum := sha256.Sum256(data)
+	metrics := len(storage.Gauges) + len(storage.Counters) + len(storage.Histograms)
+	_, errExec := tx.Exec(ctx, `INSERT INTO seeds(source, checksum, metrics) VALUES($1,$2,$3);`,
+		fileName, hex.EncodeToString(checksum[:]), metrics)
+	if errExec != nil {
+		log.WithError(errExec).Error("query failed")
+		return false, errExec
+	}
+	if errCommit := tx.Commit(ctx); errCommit != nil {
+		return false, errCommit
+	}
+	log.WithField("file", fileName).WithField("metrics", metrics).Info("database seeded from store file")
+	return true, nil
+}
+
+// Dump writes all metrics of the database as a store file of the file
+// service.
+func (s *dbService) Dump(ctx context.Context, fileName string) error {
+	if s.pool == nil {
+		return errNoPool
+	}
+	storage, err := s.Export(ctx)
+	if err != nil {
+		return err
+	}
+	return WriteSnapshot(fileName, storage)
+}
+
+const (
+	// notifyChannel carries the changes of metrics as "type/id", or an
+	// empty payload when any metric may have changed.
+	notifyChannel = "metrics_changed"
+	// listenRetryDelay is the pause before listening again after the
+	// connection was lost.
+	listenRetryDelay = time.Second
+)
+
+// Change is a change of metrics announced through the database. An empty
+// Type means that any metric may have changed.
+type Change struct {
+	Type string
+	ID   string
+}
+
+func (c Change) payload() string {
+	if c.Type == "" {
+		return ""
+	}
+	return c.Type + "/" + c.ID
+}
+
+func parseChange(payload string) Change {
+	parts := strings.SplitN(payload, "/", 2)
+	if len(parts) != 2 {
+		return Change{}
+	}
+	return Change{Type: parts[0], ID: parts[1]}
+}
+
+type execer interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (pgconn.CommandTag, error)
+}
+
+// notifyChanged announces a change when notifications are enabled. Inside a
+// transaction the notification is only delivered when it commits.
+func (s *dbService) notifyChanged(ctx context.Context, db execer, change Change) {
+	if !s.notify {
+		return
+	}
+	if _, err := db.Exec(ctx, `SELECT pg_notify($1, $2);`, notifyChannel, change.payload()); err != nil {
+		log.WithError(err).Warn("unable to notify about a change")
+	}
+}
+
+// Listen calls onChange for every change announced by the servers sharing
+// the database until ctx is done. It holds a connection of the pool. After
+// the connection is lost it listens again and announces a change of all
+// metrics, since the changes in between are unknown.
+func (s *dbService) Listen(ctx context.Context, onChange func(Change)) error {
+	if s.pool == nil {
+		return errNoPool
+	}
+	for {
+		err := s.listen(ctx, onChange)
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.WithError(err).Warn("lost database notifications, listening again")
+		onChange(Change{})
+		select {
+		case <-time.After(listenRetryDelay):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (s *dbService) listen(ctx context.Context, onChange func(Change)) error {
+	conn, err := s.pool.Acquire(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// A connection that is still open goes back to the pool and must
+		// not receive notifications there.
+		conn.Exec(context.Background(), `UNLISTEN *;`)
+		conn.Release()
+	}()
+	if _, errExec := conn.Exec(ctx, `LISTEN `+notifyChannel+`;`); errExec != nil {
+		return errExec
+	}
+	for {
+		notification, errWait := conn.Conn().WaitForNotification(ctx)
+		if errWait != nil {
+			return errWait
+		}
+		onChange(parseChange(notification.Payload))
 	}
 }
 
 func (s *dbService) Close() {
-	s.pool.Close()
+	if s.pool != nil {
+		s.pool.Close()
+	}
+}
+
+var errNoPool = errors.New("database is not connected")
+
+// MigrationCheck reports the schema version applied by the migrations and
+// fails while the last migration is left dirty.
+func (s *dbService) MigrationCheck(ctx context.Context) health.Result {
+	if s.pool == nil {
+		return health.Fail(errNoPool, nil)
+	}
+	var version int64
+	var dirty bool
+	err := s.pool.QueryRow(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1;`).Scan(&version, &dirty)
+	if err != nil {
+		return health.Fail(err, nil)
+	}
+	details := map[string]interface{}{"version": version, "dirty": dirty}
+	if dirty {
+		return health.Fail(errors.New("last migration failed, the schema is dirty"), details)
+	}
+	return health.OK(details)
+}
+
+// ReplicationCheck reports whether the database is a standby and, if so, how
+// far its WAL replay is behind the primary.
+func (s *dbService) ReplicationCheck(ctx context.Context) health.Result {
+	if s.pool == nil {
+		return health.Fail(errNoPool, nil)
+	}
+	var inRecovery bool
+	var lag *float64
+	err := s.pool.QueryRow(ctx, `SELECT pg_is_in_recovery(),
+		EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp())::double precision;`).Scan(&inRecovery, &lag)
+	if err != nil {
+		return health.Fail(err, nil)
+	}
+	details := map[string]interface{}{"in_recovery": inRecovery}
+	if inRecovery && lag != nil {
+		details["wal_lag_seconds"] = *lag
+	}
+	return health.OK(details)
 }
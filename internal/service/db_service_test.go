@@ -0,0 +1,70 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NikWaltz/metrics-collector/migrations"
+)
+
+func TestChange_payload(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  Change
+		payload string
+	}{
+		{name: "Metric", change: Change{Type: "counter", ID: "PollCount"}, payload: "counter/PollCount"},
+		{name: "All metrics", change: Change{}, payload: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.payload, tt.change.payload())
+			assert.Equal(t, tt.change, parseChange(tt.payload))
+		})
+	}
+	assert.Equal(t, Change{}, parseChange("garbage"))
+}
+
+func TestMigrate_unknownCommand(t *testing.T) {
+	_, _, err := Migrate("postgres://localhost/metrics", "sideways")
+	assert.EqualError(t, err, `unknown migrate command "sideways"`)
+}
+
+func TestMigrations(t *testing.T) {
+	entries, err := migrations.FS.ReadDir(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every version has both directions.
+	directions := make(map[string]int)
+	for _, entry := range entries {
+		name := entry.Name()
+		version := name[:strings.Index(name, "_")]
+		if strings.HasSuffix(name, ".up.sql") || strings.HasSuffix(name, ".down.sql") {
+			directions[version]++
+		}
+	}
+	assert.NotEmpty(t, directions)
+	for version, count := range directions {
+		assert.Equal(t, 2, count, version)
+	}
+}
+
+func Test_sourceArg(t *testing.T) {
+	assert.Nil(t, sourceArg(context.Background()))
+	assert.Nil(t, sourceArg(WithSource(context.Background(), "")))
+	assert.Equal(t, "agent-1", sourceArg(WithSource(context.Background(), "agent-1")))
+}
+
+func Test_metricSourceArg(t *testing.T) {
+	ctx := WithSources(WithSource(context.Background(), "agent-1"), map[Change]string{
+		{Type: "gauge", ID: "Alloc"}: "agent-2",
+		{Type: "counter", ID: "Mem"}: "",
+	})
+	assert.Equal(t, "agent-2", metricSourceArg(ctx, "gauge", "Alloc"))
+	assert.Nil(t, metricSourceArg(ctx, "counter", "Mem"))
+	assert.Equal(t, "agent-1", metricSourceArg(ctx, "counter", "Alloc"), "other metrics fall back to WithSource")
+}
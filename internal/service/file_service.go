@@ -1,27 +1,51 @@
 package service
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
+	"github.com/NikWaltz/metrics-collector/internal/health"
+	"github.com/NikWaltz/metrics-collector/internal/selfmetrics"
 	"github.com/NikWaltz/metrics-collector/model"
 )
 
+// Snapshotter is the storage a file service saves and restores.
+type Snapshotter interface {
+	Export(ctx context.Context) (model.Storage, error)
+	Restore(ctx context.Context, storage model.Storage)
+}
+
 type fileService struct {
-	storage       *model.Storage
+	store         Snapshotter
 	fileName      string
 	storeInterval time.Duration
 	restore       bool
+	intervals     chan time.Duration
+
+	mu        sync.Mutex
+	started   time.Time
+	lastSaved time.Time
+	lastErr   error
 }
 
-func NewFileService(storage *model.Storage, fileName string, storeInterval time.Duration, restore bool) *fileService {
+// NewFileService saves the store to the file every storeInterval. With
+// restore, the store is first loaded from the file.
+func NewFileService(store Snapshotter, fileName string, storeInterval time.Duration, restore bool) *fileService {
 	fileService := &fileService{
-		storage:       storage,
+		store:         store,
 		fileName:      fileName,
 		storeInterval: storeInterval,
 		restore:       restore,
+		intervals:     make(chan time.Duration, 1),
+		started:       time.Now(),
 	}
 	if restore {
 		fileService.readFromFile()
@@ -30,32 +54,122 @@ func NewFileService(storage *model.Storage, fileName string, storeInterval time.
 }
 
 func (p *fileService) saveToFile() {
-	file, err := os.OpenFile(p.fileName, os.O_RDWR|os.O_CREATE, 0777)
+	defer selfmetrics.ObserveDuration("snapshot.duration", time.Now())
+	storage, err := p.store.Export(context.Background())
+	if err == nil {
+		err = WriteSnapshot(p.fileName, storage)
+	}
 	if err != nil {
-		log.Fatal(err)
+		log.WithError(err).WithField("file", p.fileName).Error("unable to save metrics to file")
 	}
-	defer file.Close()
-	errEncode := json.NewEncoder(file).Encode(p.storage)
-	if errEncode != nil {
-		log.Println(err)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastErr = err
+	if err == nil {
+		p.lastSaved = time.Now()
 	}
 }
 
 func (p *fileService) readFromFile() {
-	file, err := os.OpenFile(p.fileName, os.O_RDWR|os.O_CREATE, 0777)
-	if err != nil {
-		log.Fatal(err)
+	storage, err := ReadSnapshot(p.fileName)
+	if errors.Is(err, os.ErrNotExist) {
+		return
 	}
-	defer file.Close()
-	errDecode := json.NewDecoder(file).Decode(p.storage)
-	if errDecode != nil {
-		log.Println(err)
+	if err != nil {
+		log.WithError(err).Warn("unable to restore metrics from file")
+		return
 	}
+	p.store.Restore(context.Background(), storage)
 }
 
 func (p *fileService) Run() {
-	ticker := time.NewTicker(p.storeInterval)
-	for range ticker.C {
-		p.saveToFile()
+	p.mu.Lock()
+	interval := p.storeInterval
+	p.mu.Unlock()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			p.saveToFile()
+		case interval := <-p.intervals:
+			ticker.Reset(interval)
+			p.mu.Lock()
+			p.storeInterval = interval
+			p.mu.Unlock()
+		}
+	}
+}
+
+// SetStoreInterval changes the interval of a running file service. Only the
+// latest interval is kept when it is called faster than Run picks it up.
+func (p *fileService) SetStoreInterval(interval time.Duration) {
+	select {
+	case <-p.intervals:
+	default:
+	}
+	p.intervals <- interval
+}
+
+// SnapshotCheck fails when no snapshot has been saved for two store
+// intervals, counting from the start before the first one.
+func (p *fileService) SnapshotCheck(ctx context.Context) health.Result {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	details := map[string]interface{}{
+		"file":             p.fileName,
+		"interval_seconds": p.storeInterval.Seconds(),
+	}
+	since := p.started
+	if !p.lastSaved.IsZero() {
+		since = p.lastSaved
+		details["last_snapshot"] = p.lastSaved.UTC().Format(time.RFC3339)
+		details["age_seconds"] = time.Since(p.lastSaved).Seconds()
+	}
+	if p.lastErr != nil {
+		return health.Fail(p.lastErr, details)
+	}
+	if time.Since(since) > 2*p.storeInterval {
+		return health.Fail(errors.New("snapshot is overdue"), details)
+	}
+	return health.OK(details)
+}
+
+// ReadSnapshot reads a store file written by the file service.
+func ReadSnapshot(fileName string) (model.Storage, error) {
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		return *model.NewStorage(), err
+	}
+	return decodeSnapshot(fileName, data)
+}
+
+// decodeSnapshot decodes the first JSON value of a store file. An empty file
+// is an empty store, and the bytes after the value are ignored, as older
+// servers rewrote the file in place and left the tail of a larger snapshot.
+func decodeSnapshot(fileName string, data []byte) (model.Storage, error) {
+	storage := model.NewStorage()
+	errDecode := json.NewDecoder(bytes.NewReader(data)).Decode(storage)
+	if errDecode != nil && !errors.Is(errDecode, io.EOF) {
+		return *storage, fmt.Errorf("unable to decode %s: %w", fileName, errDecode)
+	}
+	return *storage, nil
+}
+
+// WriteSnapshot writes the storage as a store file of the file service. The
+// file is replaced at once, so a server restoring from it never reads a part.
+func WriteSnapshot(fileName string, storage model.Storage) error {
+	file, err := os.CreateTemp(filepath.Dir(fileName), filepath.Base(fileName)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if errEncode := json.NewEncoder(file).Encode(storage); errEncode != nil {
+		file.Close()
+		return errEncode
+	}
+	if errClose := file.Close(); errClose != nil {
+		return errClose
 	}
+	return os.Rename(file.Name(), fileName)
 }
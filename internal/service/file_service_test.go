@@ -1,9 +1,11 @@
 package service
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -37,7 +39,8 @@ func Test_fileService_saveToFile(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			p := NewFileService(tt.fields.storage, tt.fields.fileName, tt.fields.storeInterval, tt.fields.restore)
+			s := NewService(tt.fields.storage)
+			p := NewFileService(s, tt.fields.fileName, tt.fields.storeInterval, tt.fields.restore)
 			file, err := os.OpenFile(p.fileName, os.O_RDWR|os.O_CREATE, 0777)
 			if err != nil {
 				fmt.Println(err)
@@ -53,9 +56,9 @@ func Test_fileService_saveToFile(t *testing.T) {
 			p.readFromFile()
 			defer file.Close()
 			defer os.Remove(tt.fields.fileName)
-			alloc, _ := tt.fields.storage.GetGauge("Alloc")
-			mem, _ := tt.fields.storage.GetGauge("Mem")
-			pollCount, _ := tt.fields.storage.GetCounter("PollCount")
+			alloc, _ := s.GetGauge(context.Background(), "Alloc")
+			mem, _ := s.GetGauge(context.Background(), "Mem")
+			pollCount, _ := s.GetCounter(context.Background(), "PollCount")
 			assert.Equalf(t, model.Gauge(53.23), alloc, "Wrong Alloc value")
 			assert.Equalf(t, model.Gauge(45.2), mem, "Wrong Mem value")
 			assert.Equalf(t, model.Counter(10), pollCount, "Wrong PollCount value")
@@ -91,7 +94,7 @@ func Test_fileService_readFromFile(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			p := NewFileService(tt.fields.storage, tt.fields.fileName, tt.fields.storeInterval, tt.fields.restore)
+			p := NewFileService(NewService(tt.fields.storage), tt.fields.fileName, tt.fields.storeInterval, tt.fields.restore)
 			p.saveToFile()
 			file, err := os.OpenFile(p.fileName, os.O_RDWR, 0777)
 			if err != nil {
@@ -113,3 +116,92 @@ func Test_fileService_readFromFile(t *testing.T) {
 		})
 	}
 }
+
+func Test_fileService_SetStoreInterval(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+	storage := model.NewStorage()
+	storage.SaveGauge("Alloc", 1.5)
+	p := NewFileService(NewService(storage), fileName, time.Hour, false)
+	go p.Run()
+
+	p.SetStoreInterval(10 * time.Millisecond)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(fileName)
+		return err == nil
+	}, time.Second, 5*time.Millisecond)
+
+	// Park the ticker so that no save runs after the directory is removed.
+	p.SetStoreInterval(time.Hour)
+	assert.Eventually(t, func() bool {
+		return len(p.intervals) == 0
+	}, time.Second, 5*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+}
+
+func Test_fileService_SnapshotCheck(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+	p := NewFileService(NewService(model.NewStorage()), fileName, time.Minute, false)
+	assert.Equal(t, "ok", p.SnapshotCheck(context.Background()).Status, "first snapshot is not due yet")
+
+	p.started = time.Now().Add(-3 * time.Minute)
+	assert.Equal(t, "fail", p.SnapshotCheck(context.Background()).Status, "first snapshot is overdue")
+
+	p.saveToFile()
+	result := p.SnapshotCheck(context.Background())
+	assert.Equal(t, "ok", result.Status)
+	assert.Contains(t, result.Details, "last_snapshot")
+}
+
+func TestWriteReadSnapshot(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+	storage := model.Storage{
+		Gauges:     map[string]model.Gauge{"Alloc": 53.23},
+		Counters:   map[string]model.Counter{"PollCount": 10},
+		Histograms: map[string]model.Histogram{"GCPause": {Bounds: []float64{1}, Counts: []int64{1, 2}, Count: 3, Sum: 4.5}},
+	}
+	assert.NoError(t, WriteSnapshot(fileName, storage))
+	got, err := ReadSnapshot(fileName)
+	assert.NoError(t, err)
+	assert.Equal(t, storage, got)
+
+	// A snapshot of an older server has no histograms.
+	assert.NoError(t, os.WriteFile(fileName, []byte(`{"Gauges":{},"Counters":{"PollCount":1}}`), 0600))
+	got, err = ReadSnapshot(fileName)
+	assert.NoError(t, err)
+	assert.Equal(t, model.Counter(1), got.Counters["PollCount"])
+	assert.NotNil(t, got.Histograms)
+
+	assert.NoError(t, os.WriteFile(fileName, []byte(`{"Gauges":`), 0600))
+	_, err = ReadSnapshot(fileName)
+	assert.Error(t, err)
+}
+
+func Test_fileService_shrunkSnapshot(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "metrics.json")
+	s := NewService(model.NewStorage())
+	ctx := context.Background()
+	for _, name := range []string{"Alloc", "HeapAlloc", "HeapInuse", "StackInuse"} {
+		assert.NoError(t, s.Update(ctx, model.GaugeType, name, "123456.789"))
+	}
+	p := NewFileService(s, fileName, time.Minute, false)
+	p.saveToFile()
+
+	p.store = NewService(&model.Storage{Gauges: map[string]model.Gauge{"Alloc": 1}})
+	p.saveToFile()
+	got, err := ReadSnapshot(fileName)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]model.Gauge{"Alloc": 1}, got.Gauges)
+
+	// A file rewritten in place by an older server keeps the tail of the
+	// larger snapshot.
+	assert.NoError(t, os.WriteFile(fileName, []byte(`{"Gauges":{"Alloc":1}}`+"\n"+`:123.4},"Counters":{}}`), 0600))
+	got, err = ReadSnapshot(fileName)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]model.Gauge{"Alloc": 1}, got.Gauges)
+
+	restored := NewService(model.NewStorage())
+	NewFileService(restored, fileName, time.Minute, true)
+	alloc, err := restored.GetGauge(ctx, "Alloc")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Gauge(1), alloc)
+}
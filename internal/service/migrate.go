@@ -0,0 +1,73 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/golang-migrate/migrate/v4"
+	_ "github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source/iofs"
+
+	"github.com/NikWaltz/metrics-collector/migrations"
+)
+
+// migrationLockTimeout bounds the wait of a replica for another one that
+// migrates the database. The default of the migrate package is 15 seconds.
+const migrationLockTimeout = 5 * time.Minute
+
+// Commands of Migrate.
+const (
+	MigrateUp      = "up"
+	MigrateDown    = "down"
+	MigrateVersion = "version"
+)
+
+func openMigrations(dsn string) (*migrate.Migrate, error) {
+	source, err := iofs.New(migrations.FS, ".")
+	if err != nil {
+		return nil, err
+	}
+	m, err := migrate.NewWithSourceInstance("iofs", source, dsn)
+	if err != nil {
+		return nil, err
+	}
+	m.LockTimeout = migrationLockTimeout
+	return m, nil
+}
+
+// migrateDB applies the pending migrations. Replicas starting together wait
+// on an advisory lock of the database while one of them migrates, and find
+// nothing left to do afterwards.
+func migrateDB(dsn string) error {
+	_, _, err := Migrate(dsn, MigrateUp)
+	return err
+}
+
+// Migrate runs a command on the schema of the database and returns its
+// version afterwards, 0 for an empty database. Up applies the pending
+// migrations, down reverts the last one and version changes nothing.
+func Migrate(dsn string, command string) (uint, bool, error) {
+	if command != MigrateUp && command != MigrateDown && command != MigrateVersion {
+		return 0, false, fmt.Errorf("unknown migrate command %q", command)
+	}
+	m, err := openMigrations(dsn)
+	if err != nil {
+		return 0, false, err
+	}
+	defer m.Close()
+	switch command {
+	case MigrateUp:
+		err = m.Up()
+	case MigrateDown:
+		err = m.Steps(-1)
+	}
+	if err != nil && !errors.Is(err, migrate.ErrNoChange) {
+		return 0, false, err
+	}
+	version, dirty, err := m.Version()
+	if errors.Is(err, migrate.ErrNilVersion) {
+		return 0, false, nil
+	}
+	return version, dirty, err
+}
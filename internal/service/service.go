@@ -3,18 +3,99 @@ package service
 import (
 	"context"
 	"errors"
+	"fmt"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
+	"github.com/NikWaltz/metrics-collector/internal/logger"
 	"github.com/NikWaltz/metrics-collector/model"
 )
 
+var log = logger.For("storage")
+
+// service keeps all metrics in memory. The storage is guarded by mu, as
+// updates arrive concurrently from the api and the statsd listener.
 type service struct {
-	storage model.Storage
+	mu        sync.RWMutex
+	storage   model.Storage
+	conflicts ConflictPolicy
 }
 
 func NewService(storage *model.Storage) *service {
-	return &service{storage: *storage}
+	return &service{storage: *storage, conflicts: ConflictAllow}
+}
+
+// SetConflictPolicy sets what a write does to a metric with values of
+// another type.
+func (s *service) SetConflictPolicy(policy ConflictPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conflicts = policy
+}
+
+var (
+	// ErrNotFound is returned for reads of metrics that were never written.
+	ErrNotFound = errors.New("metric not exist")
+	// ErrInvalidValue wraps the errors caused by the value of an update, as
+	// opposed to failures of the storage.
+	ErrInvalidValue = errors.New("invalid metric value")
+)
+
+func invalidValue(err error) error {
+	return fmt.Errorf("%w: %v", ErrInvalidValue, err)
+}
+
+// ImportMode tells how imported counters and histograms combine with the
+// stored ones. Imported gauges always replace the stored values.
+type ImportMode string
+
+const (
+	// ImportReplace overwrites the stored counters and histograms.
+	ImportReplace ImportMode = "replace"
+	// ImportAdd adds imported counters to the stored ones and merges
+	// histograms.
+	ImportAdd ImportMode = "add"
+)
+
+// ParseImportMode parses a mode, defaulting to ImportReplace.
+func ParseImportMode(mode string) (ImportMode, error) {
+	switch ImportMode(mode) {
+	case "", ImportReplace:
+		return ImportReplace, nil
+	case ImportAdd:
+		return ImportAdd, nil
+	}
+	return "", fmt.Errorf("%w: unknown import mode %q", ErrInvalidValue, mode)
+}
+
+// ConflictPolicy tells what a write does to a metric that has values of
+// another type under the same name. A type registered in the metadata of a
+// metric is enforced under every policy.
+type ConflictPolicy string
+
+const (
+	// ConflictAllow keeps a value of every type.
+	ConflictAllow ConflictPolicy = "allow"
+	// ConflictReject rejects the write with a ConflictError.
+	ConflictReject ConflictPolicy = "reject"
+	// ConflictMigrate deletes the values of the other types, so the metric
+	// takes the type of the last write.
+	ConflictMigrate ConflictPolicy = "migrate"
+)
+
+// ParseConflictPolicy parses a policy, defaulting to ConflictAllow.
+func ParseConflictPolicy(policy string) (ConflictPolicy, error) {
+	switch ConflictPolicy(policy) {
+	case "", ConflictAllow:
+		return ConflictAllow, nil
+	case ConflictReject:
+		return ConflictReject, nil
+	case ConflictMigrate:
+		return ConflictMigrate, nil
+	}
+	return "", fmt.Errorf("%w: unknown conflict policy %q", ErrInvalidValue, policy)
 }
 
 type TypeError struct {
@@ -24,32 +105,177 @@ func (e *TypeError) Error() string {
 	return "wrong metric type"
 }
 
+// ConflictError rejects a write of a metric as another type than the one in
+// its metadata.
+type ConflictError struct {
+	ID   string
+	Type string
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s cannot be written as a %s", e.ID, e.Type)
+}
+
+func knownType(metricType string) bool {
+	switch metricType {
+	case model.GaugeType, model.CounterType, model.HistogramType:
+		return true
+	}
+	return false
+}
+
+// checkMetadata lowercases the type of the metadata and fails for an
+// unknown one.
+func checkMetadata(metadata *model.Metadata) error {
+	metadata.Type = strings.ToLower(metadata.Type)
+	if metadata.Type != "" && !knownType(metadata.Type) {
+		return &TypeError{}
+	}
+	return nil
+}
+
+// mixedTypes fails with a metric that the store has in more than one type.
+func mixedTypes(storage model.Storage) error {
+	for name := range storage.Counters {
+		if _, ok := storage.Gauges[name]; ok {
+			return &ConflictError{ID: name, Type: model.CounterType}
+		}
+	}
+	for name := range storage.Histograms {
+		_, gauge := storage.Gauges[name]
+		_, counter := storage.Counters[name]
+		if gauge || counter {
+			return &ConflictError{ID: name, Type: model.HistogramType}
+		}
+	}
+	return nil
+}
+
+// otherTypes returns the types other than metricType that the metric has
+// values of.
+func (s *service) otherTypes(name string, metricType string) []string {
+	var types []string
+	if _, ok := s.storage.GetGauge(name); ok && metricType != model.GaugeType {
+		types = append(types, model.GaugeType)
+	}
+	if _, ok := s.storage.GetCounter(name); ok && metricType != model.CounterType {
+		types = append(types, model.CounterType)
+	}
+	if _, ok := s.storage.GetHistogram(name); ok && metricType != model.HistogramType {
+		types = append(types, model.HistogramType)
+	}
+	return types
+}
+
+// conflict fails when the metric cannot be written as metricType: its
+// metadata has another type, or conflicts are rejected and it has values of
+// another type.
+func (s *service) conflict(name string, metricType string, metadata model.Metadata) error {
+	if metadata.Type != "" && metadata.Type != metricType {
+		return &ConflictError{ID: name, Type: metricType}
+	}
+	if s.conflicts == ConflictReject && len(s.otherTypes(name, metricType)) > 0 {
+		return &ConflictError{ID: name, Type: metricType}
+	}
+	return nil
+}
+
+// migrate deletes the values of the other types of the metric when
+// conflicts migrate.
+func (s *service) migrate(name string, metricType string) {
+	if s.conflicts != ConflictMigrate {
+		return
+	}
+	for _, other := range s.otherTypes(name, metricType) {
+		s.storage.Delete(other, name)
+	}
+}
+
+// checkType prepares a write of the metric as metricType, see conflict and
+// migrate.
+func (s *service) checkType(name string, metricType string) error {
+	metadata, _ := s.storage.GetMetadata(name)
+	if err := s.conflict(name, metricType, metadata); err != nil {
+		return err
+	}
+	s.migrate(name, metricType)
+	return nil
+}
+
 func (s *service) GetGauge(ctx context.Context, name string) (model.Gauge, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	if value, ok := s.storage.GetGauge(name); ok {
 		return value, nil
 	} else {
-		return 0, errors.New("metric not exist")
+		return 0, ErrNotFound
 	}
 
 }
 
 func (s *service) GetCounter(ctx context.Context, name string) (model.Counter, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	if value, ok := s.storage.GetCounter(name); ok {
 		return value, nil
 	} else {
-		return 0, errors.New("metric not exist")
+		return 0, ErrNotFound
+	}
+}
+
+func (s *service) GetHistogram(ctx context.Context, name string) (model.Histogram, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if value, ok := s.storage.GetHistogram(name); ok {
+		return value.Copy(), nil
+	} else {
+		return model.Histogram{}, ErrNotFound
 	}
 }
 
+// GetStorage returns a copy of all metrics, see Export.
 func (s *service) GetStorage(ctx context.Context) model.Storage {
-	return s.storage
+	storage, _ := s.Export(ctx)
+	return storage
+}
+
+// Export returns a copy of all metrics.
+func (s *service) Export(ctx context.Context) (model.Storage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	storage := *model.NewStorage()
+	for name, value := range s.storage.Gauges {
+		storage.SaveGauge(name, value)
+	}
+	for name, value := range s.storage.Counters {
+		storage.SaveCounter(name, value)
+	}
+	for name, value := range s.storage.Histograms {
+		storage.SaveHistogram(name, value.Copy())
+	}
+	for name, value := range s.storage.Metadata {
+		storage.SaveMetadata(name, value)
+	}
+	return storage, nil
+}
+
+// Restore replaces all metrics, e.g. with a snapshot read at the start.
+func (s *service) Restore(ctx context.Context, storage model.Storage) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.storage = storage
 }
 
 func (s *service) Update(ctx context.Context, metricType string, metricName string, metricValue string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	switch strings.ToLower(metricType) {
 	case model.GaugeType:
 		value, err := strconv.ParseFloat(metricValue, 64)
 		if err != nil {
+			return invalidValue(err)
+		}
+		if err := s.checkType(metricName, model.GaugeType); err != nil {
 			return err
 		}
 		s.storage.SaveGauge(metricName, model.Gauge(value))
@@ -57,17 +283,207 @@ func (s *service) Update(ctx context.Context, metricType string, metricName stri
 	case model.CounterType:
 		value, err := strconv.ParseInt(metricValue, 10, 64)
 		if err != nil {
+			return invalidValue(err)
+		}
+		if err := s.checkType(metricName, model.CounterType); err != nil {
 			return err
 		}
 		newValue, _ := s.storage.GetCounter(metricName)
 		newValue += model.Counter(value)
 		s.storage.SaveCounter(metricName, newValue)
 		return nil
+	case model.HistogramType:
+		value, err := strconv.ParseFloat(metricValue, 64)
+		if err != nil {
+			return invalidValue(err)
+		}
+		if err := s.checkType(metricName, model.HistogramType); err != nil {
+			return err
+		}
+		histogram, ok := s.storage.GetHistogram(metricName)
+		if !ok {
+			histogram = model.NewHistogram(model.DefaultBuckets)
+		}
+		histogram.Observe(value)
+		s.storage.SaveHistogram(metricName, histogram)
+		return nil
 	default:
 		return &TypeError{}
 	}
 }
 
+func (s *service) UpdateHistogram(ctx context.Context, metricName string, value model.Histogram) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := value.Validate(); err != nil {
+		return invalidValue(err)
+	}
+	if err := s.checkType(metricName, model.HistogramType); err != nil {
+		return err
+	}
+	histogram, ok := s.storage.GetHistogram(metricName)
+	if !ok {
+		s.storage.SaveHistogram(metricName, value.Copy())
+		return nil
+	}
+	if err := histogram.Merge(value); err != nil {
+		return invalidValue(err)
+	}
+	s.storage.SaveHistogram(metricName, histogram)
+	return nil
+}
+
+// AddGauge changes a gauge by delta in one step, for relative updates. A
+// gauge that was never written starts at 0.
+func (s *service) AddGauge(ctx context.Context, metricName string, delta model.Gauge) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkType(metricName, model.GaugeType); err != nil {
+		return err
+	}
+	value, _ := s.storage.GetGauge(metricName)
+	s.storage.SaveGauge(metricName, value+delta)
+	return nil
+}
+
+// Import writes all metrics and metadata of the store. Nothing is written
+// when a histogram is invalid or cannot be merged, or when a metric
+// conflicts with the type in its metadata.
+func (s *service) Import(ctx context.Context, storage model.Storage, mode ImportMode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	metadata := make(map[string]model.Metadata, len(storage.Metadata))
+	for name, value := range storage.Metadata {
+		stored, _ := s.storage.GetMetadata(name)
+		merged, err := s.mergeMetadata(name, stored, value)
+		if err != nil {
+			return err
+		}
+		metadata[name] = merged
+	}
+	if s.conflicts != ConflictAllow {
+		if err := mixedTypes(storage); err != nil {
+			return err
+		}
+	}
+	check := func(name string, metricType string) error {
+		value, ok := metadata[name]
+		if !ok {
+			value, _ = s.storage.GetMetadata(name)
+		}
+		return s.conflict(name, metricType, value)
+	}
+	for name := range storage.Gauges {
+		if err := check(name, model.GaugeType); err != nil {
+			return err
+		}
+	}
+	for name := range storage.Counters {
+		if err := check(name, model.CounterType); err != nil {
+			return err
+		}
+	}
+	for name := range storage.Histograms {
+		if err := check(name, model.HistogramType); err != nil {
+			return err
+		}
+	}
+	histograms := make(map[string]model.Histogram, len(storage.Histograms))
+	for name, value := range storage.Histograms {
+		if err := value.Validate(); err != nil {
+			return invalidValue(fmt.Errorf("%s: %w", name, err))
+		}
+		stored, ok := s.storage.GetHistogram(name)
+		if mode == ImportReplace || !ok {
+			histograms[name] = value.Copy()
+			continue
+		}
+		merged := stored.Copy()
+		if err := merged.Merge(value); err != nil {
+			return invalidValue(fmt.Errorf("%s: %w", name, err))
+		}
+		histograms[name] = merged
+	}
+	for name, value := range storage.Gauges {
+		s.migrate(name, model.GaugeType)
+		s.storage.SaveGauge(name, value)
+	}
+	for name, value := range storage.Counters {
+		s.migrate(name, model.CounterType)
+		if mode == ImportAdd {
+			stored, _ := s.storage.GetCounter(name)
+			value += stored
+		}
+		s.storage.SaveCounter(name, value)
+	}
+	for name, value := range histograms {
+		s.migrate(name, model.HistogramType)
+		s.storage.SaveHistogram(name, value)
+	}
+	for name, value := range metadata {
+		s.storage.SaveMetadata(name, value)
+	}
+	return nil
+}
+
+// SetMetadata registers the metadata of a metric. Empty fields keep the
+// registered values. A type can only be registered when the metric has no
+// other type yet, neither in its metadata nor in its values.
+func (s *service) SetMetadata(ctx context.Context, metadata model.Metadata) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, _ := s.storage.GetMetadata(metadata.ID)
+	merged, err := s.mergeMetadata(metadata.ID, stored, metadata)
+	if err != nil {
+		return err
+	}
+	s.storage.SaveMetadata(metadata.ID, merged)
+	return nil
+}
+
+// mergeMetadata merges an update into the stored metadata of a metric.
+func (s *service) mergeMetadata(name string, stored model.Metadata, update model.Metadata) (model.Metadata, error) {
+	stored.ID, update.ID = name, name
+	if err := checkMetadata(&update); err != nil {
+		return model.Metadata{}, err
+	}
+	if update.Type == "" {
+		return stored.Merge(update), nil
+	}
+	if stored.Type != "" && stored.Type != update.Type {
+		return model.Metadata{}, &ConflictError{ID: name, Type: update.Type}
+	}
+	_, gauge := s.storage.GetGauge(name)
+	_, counter := s.storage.GetCounter(name)
+	_, histogram := s.storage.GetHistogram(name)
+	if gauge && update.Type != model.GaugeType || counter && update.Type != model.CounterType ||
+		histogram && update.Type != model.HistogramType {
+		return model.Metadata{}, &ConflictError{ID: name, Type: update.Type}
+	}
+	return stored.Merge(update), nil
+}
+
+func (s *service) GetMetadata(ctx context.Context, name string) (model.Metadata, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if value, ok := s.storage.GetMetadata(name); ok {
+		return value, nil
+	}
+	return model.Metadata{}, ErrNotFound
+}
+
+// ListMetadata returns the metadata of all metrics ordered by name.
+func (s *service) ListMetadata(ctx context.Context) ([]model.Metadata, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]model.Metadata, 0, len(s.storage.Metadata))
+	for _, value := range s.storage.Metadata {
+		list = append(list, value)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
 func (s *service) Ping(ctx context.Context) error {
 	return nil
 }
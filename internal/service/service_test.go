@@ -3,6 +3,7 @@ package service
 import (
 	"context"
 	"errors"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -69,7 +70,7 @@ func TestUpdate(t *testing.T) {
 			name:   "Update non-existence metric",
 			fields: fields{storage: *model.NewStorage()},
 			args: args{
-				metricType:  "histogram",
+				metricType:  "summary",
 				metricName:  "Total",
 				metricValue: "63.243",
 			},
@@ -191,3 +192,308 @@ func TestGetGauge(t *testing.T) {
 		})
 	}
 }
+
+func TestUpdateHistogram(t *testing.T) {
+	storage := *model.NewStorage()
+	s := &service{storage: storage}
+
+	assert.NoError(t, s.Update(context.TODO(), model.HistogramType, "Latency", "0.3"))
+	assert.NoError(t, s.Update(context.TODO(), model.HistogramType, "Latency", "20"))
+	assert.Error(t, s.Update(context.TODO(), model.HistogramType, "Latency", "fast"))
+
+	delta := model.NewHistogram(model.DefaultBuckets)
+	delta.Observe(0.004)
+	assert.NoError(t, s.UpdateHistogram(context.TODO(), "Latency", delta))
+
+	got, err := s.GetHistogram(context.TODO(), "Latency")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), got.Count)
+	assert.InDelta(t, 20.304, got.Sum, 1e-9)
+	assert.Equal(t, int64(1), got.Counts[0])
+	assert.Equal(t, int64(1), got.Counts[6])
+	assert.Equal(t, int64(1), got.Counts[len(got.Counts)-1])
+
+	assert.Error(t, s.UpdateHistogram(context.TODO(), "Latency", model.NewHistogram([]float64{1, 2})))
+	assert.Error(t, s.UpdateHistogram(context.TODO(), "Broken", model.Histogram{Bounds: []float64{2, 1}, Counts: []int64{0, 0, 0}}))
+	assert.Error(t, s.UpdateHistogram(context.TODO(), "Broken", model.Histogram{Bounds: []float64{1}, Counts: []int64{1, 1}, Count: 5}))
+
+	_, err = s.GetHistogram(context.TODO(), "Broken")
+	assert.Error(t, err)
+}
+
+func TestAddGauge(t *testing.T) {
+	s := NewService(model.NewStorage())
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, s.AddGauge(context.TODO(), "Temperature", 0.5))
+		}()
+	}
+	wg.Wait()
+	got, err := s.GetGauge(context.TODO(), "Temperature")
+	assert.NoError(t, err)
+	assert.Equal(t, model.Gauge(25), got, "concurrent changes are not lost")
+
+	assert.NoError(t, s.SetMetadata(context.TODO(), model.Metadata{ID: "Requests", Type: model.CounterType}))
+	var conflict *ConflictError
+	assert.ErrorAs(t, s.AddGauge(context.TODO(), "Requests", 1), &conflict)
+}
+
+func TestImport(t *testing.T) {
+	imported := model.Storage{
+		Gauges:     map[string]model.Gauge{"Alloc": 2},
+		Counters:   map[string]model.Counter{"PollCount": 5},
+		Histograms: map[string]model.Histogram{"GCPause": {Bounds: []float64{1}, Counts: []int64{1, 0}, Count: 1, Sum: 0.5}},
+	}
+	tests := []struct {
+		name          string
+		mode          ImportMode
+		imported      model.Storage
+		wantCounter   model.Counter
+		wantHistogram int64
+		wantErr       error
+	}{
+		{name: "Replace", mode: ImportReplace, imported: imported, wantCounter: 5, wantHistogram: 1},
+		{name: "Add", mode: ImportAdd, imported: imported, wantCounter: 8, wantHistogram: 3},
+		{
+			name: "Histogram with other bounds",
+			mode: ImportAdd,
+			imported: model.Storage{
+				Counters:   map[string]model.Counter{"PollCount": 5},
+				Histograms: map[string]model.Histogram{"GCPause": {Bounds: []float64{2}, Counts: []int64{1, 0}, Count: 1, Sum: 0.5}},
+			},
+			wantCounter:   3,
+			wantHistogram: 2,
+			wantErr:       ErrInvalidValue,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewService(model.NewStorage())
+			s.storage.SaveGauge("Alloc", 1)
+			s.storage.SaveCounter("PollCount", 3)
+			s.storage.SaveHistogram("GCPause", model.Histogram{Bounds: []float64{1}, Counts: []int64{2, 0}, Count: 2, Sum: 1})
+
+			err := s.Import(context.Background(), tt.imported, tt.mode)
+			assert.ErrorIs(t, err, tt.wantErr)
+			counter, _ := s.GetCounter(context.Background(), "PollCount")
+			assert.Equal(t, tt.wantCounter, counter)
+			histogram, _ := s.GetHistogram(context.Background(), "GCPause")
+			assert.Equal(t, tt.wantHistogram, histogram.Count)
+
+			exported, errExport := s.Export(context.Background())
+			assert.NoError(t, errExport)
+			assert.Equal(t, counter, exported.Counters["PollCount"])
+		})
+	}
+}
+
+func TestParseImportMode(t *testing.T) {
+	mode, err := ParseImportMode("")
+	assert.NoError(t, err)
+	assert.Equal(t, ImportReplace, mode)
+	mode, err = ParseImportMode("add")
+	assert.NoError(t, err)
+	assert.Equal(t, ImportAdd, mode)
+	_, err = ParseImportMode("merge")
+	assert.ErrorIs(t, err, ErrInvalidValue)
+}
+
+func TestSetMetadata(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata model.Metadata
+		want     model.Metadata
+		wantErr  error
+	}{
+		{
+			name:     "Merge",
+			metadata: model.Metadata{ID: "Alloc", Description: "Bytes of allocated heap objects."},
+			want:     model.Metadata{ID: "Alloc", Type: "gauge", Unit: "bytes", Description: "Bytes of allocated heap objects."},
+		},
+		{
+			name:     "Same type in any case",
+			metadata: model.Metadata{ID: "Alloc", Type: "Gauge", Owner: "runtime"},
+			want:     model.Metadata{ID: "Alloc", Type: "gauge", Unit: "bytes", Owner: "runtime"},
+		},
+		{
+			name:     "Type of the stored value",
+			metadata: model.Metadata{ID: "PollCount", Type: "counter"},
+			want:     model.Metadata{ID: "PollCount", Type: "counter"},
+		},
+		{name: "Other registered type", metadata: model.Metadata{ID: "Alloc", Type: "counter"}, wantErr: &ConflictError{}},
+		{name: "Other stored type", metadata: model.Metadata{ID: "PollCount", Type: "gauge"}, wantErr: &ConflictError{}},
+		{name: "Unknown type", metadata: model.Metadata{ID: "Requests", Type: "summary"}, wantErr: &TypeError{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewService(model.NewStorage())
+			s.storage.SaveMetadata("Alloc", model.Metadata{ID: "Alloc", Type: "gauge", Unit: "bytes"})
+			s.storage.SaveCounter("PollCount", 3)
+
+			err := s.SetMetadata(context.Background(), tt.metadata)
+			if tt.wantErr != nil {
+				assert.IsType(t, tt.wantErr, err)
+				return
+			}
+			assert.NoError(t, err)
+			got, err := s.GetMetadata(context.Background(), tt.metadata.ID)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestService_registeredType(t *testing.T) {
+	ctx := context.Background()
+	s := NewService(model.NewStorage())
+	assert.NoError(t, s.SetMetadata(ctx, model.Metadata{ID: "Alloc", Type: "gauge"}))
+	assert.NoError(t, s.SetMetadata(ctx, model.Metadata{ID: "GCPause", Unit: "nanoseconds"}))
+
+	var conflict *ConflictError
+	assert.ErrorAs(t, s.Update(ctx, "Counter", "Alloc", "1"), &conflict)
+	assert.Equal(t, &ConflictError{ID: "Alloc", Type: "counter"}, conflict)
+	assert.ErrorAs(t, s.Update(ctx, "histogram", "Alloc", "1"), &conflict)
+	assert.ErrorAs(t, s.UpdateHistogram(ctx, "Alloc", model.NewHistogram([]float64{1})), &conflict)
+	assert.NoError(t, s.Update(ctx, "gauge", "Alloc", "1.5"))
+	// Metadata without a type allows any.
+	assert.NoError(t, s.Update(ctx, "histogram", "GCPause", "1"))
+
+	// Nothing of a conflicting import is written.
+	err := s.Import(ctx, model.Storage{
+		Gauges:   map[string]model.Gauge{"Mem": 1},
+		Counters: map[string]model.Counter{"Alloc": 1},
+	}, ImportAdd)
+	assert.ErrorAs(t, err, &conflict)
+	_, err = s.GetGauge(ctx, "Mem")
+	assert.ErrorIs(t, err, ErrNotFound)
+	err = s.Import(ctx, model.Storage{
+		Counters: map[string]model.Counter{"PollCount": 1},
+		Metadata: map[string]model.Metadata{"PollCount": {ID: "PollCount", Type: "gauge"}},
+	}, ImportAdd)
+	assert.ErrorAs(t, err, &conflict)
+	_, err = s.GetMetadata(ctx, "PollCount")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	assert.NoError(t, s.Import(ctx, model.Storage{
+		Counters: map[string]model.Counter{"PollCount": 1},
+		Metadata: map[string]model.Metadata{"PollCount": {Type: "counter", Unit: "polls"}},
+	}, ImportAdd))
+	list, err := s.ListMetadata(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []model.Metadata{
+		{ID: "Alloc", Type: "gauge"},
+		{ID: "GCPause", Unit: "nanoseconds"},
+		{ID: "PollCount", Type: "counter", Unit: "polls"},
+	}, list)
+	exported, err := s.Export(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, exported.Metadata, 3)
+}
+
+func TestService_conflictPolicy(t *testing.T) {
+	tests := []struct {
+		name        string
+		policy      ConflictPolicy
+		write       func(s *service) error
+		wantErr     bool
+		wantGauge   bool
+		wantCounter bool
+	}{
+		{
+			name:        "Allow keeps both types",
+			policy:      ConflictAllow,
+			write:       func(s *service) error { return s.Update(context.Background(), "counter", "Alloc", "1") },
+			wantGauge:   true,
+			wantCounter: true,
+		},
+		{
+			name:      "Reject",
+			policy:    ConflictReject,
+			write:     func(s *service) error { return s.Update(context.Background(), "counter", "Alloc", "1") },
+			wantErr:   true,
+			wantGauge: true,
+		},
+		{
+			name:        "Migrate",
+			policy:      ConflictMigrate,
+			write:       func(s *service) error { return s.Update(context.Background(), "counter", "Alloc", "1") },
+			wantCounter: true,
+		},
+		{
+			name:   "Migrate a histogram",
+			policy: ConflictMigrate,
+			write: func(s *service) error {
+				return s.UpdateHistogram(context.Background(), "Alloc", model.NewHistogram([]float64{1}))
+			},
+		},
+		{
+			name:      "Same type under reject",
+			policy:    ConflictReject,
+			write:     func(s *service) error { return s.Update(context.Background(), "gauge", "Alloc", "2") },
+			wantGauge: true,
+		},
+		{
+			name:   "Reject an import",
+			policy: ConflictReject,
+			write: func(s *service) error {
+				return s.Import(context.Background(), model.Storage{Counters: map[string]model.Counter{"Alloc": 1}}, ImportAdd)
+			},
+			wantErr:   true,
+			wantGauge: true,
+		},
+		{
+			name:   "Migrate an import",
+			policy: ConflictMigrate,
+			write: func(s *service) error {
+				return s.Import(context.Background(), model.Storage{Counters: map[string]model.Counter{"Alloc": 1}}, ImportAdd)
+			},
+			wantCounter: true,
+		},
+		{
+			name:   "Import of both types under migrate",
+			policy: ConflictMigrate,
+			write: func(s *service) error {
+				return s.Import(context.Background(), model.Storage{
+					Gauges:   map[string]model.Gauge{"Alloc": 1},
+					Counters: map[string]model.Counter{"Alloc": 1},
+				}, ImportAdd)
+			},
+			wantErr:   true,
+			wantGauge: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := NewService(model.NewStorage())
+			s.SetConflictPolicy(tt.policy)
+			s.storage.SaveGauge("Alloc", 1)
+
+			err := tt.write(s)
+			if tt.wantErr {
+				var conflict *ConflictError
+				assert.ErrorAs(t, err, &conflict)
+			} else {
+				assert.NoError(t, err)
+			}
+			_, errGauge := s.GetGauge(context.Background(), "Alloc")
+			assert.Equal(t, tt.wantGauge, errGauge == nil)
+			_, errCounter := s.GetCounter(context.Background(), "Alloc")
+			assert.Equal(t, tt.wantCounter, errCounter == nil)
+		})
+	}
+}
+
+func TestParseConflictPolicy(t *testing.T) {
+	policy, err := ParseConflictPolicy("")
+	assert.NoError(t, err)
+	assert.Equal(t, ConflictAllow, policy)
+	policy, err = ParseConflictPolicy("migrate")
+	assert.NoError(t, err)
+	assert.Equal(t, ConflictMigrate, policy)
+	_, err = ParseConflictPolicy("merge")
+	assert.ErrorIs(t, err, ErrInvalidValue)
+}
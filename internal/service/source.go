@@ -0,0 +1,54 @@
+package service
+
+import "context"
+
+type sourceKey struct{}
+
+type sourcesKey struct{}
+
+// WithSource names the agent that writes the metrics in ctx. Backends that
+// keep metadata record it with the written metrics.
+func WithSource(ctx context.Context, source string) context.Context {
+	return context.WithValue(ctx, sourceKey{}, source)
+}
+
+// WithSources names the agent of every metric of an import, for a batch that
+// collects the writes of several agents. The metrics that sources does not
+// name are written under the agent of WithSource.
+func WithSources(ctx context.Context, sources map[Change]string) context.Context {
+	return context.WithValue(ctx, sourcesKey{}, sources)
+}
+
+// SourceOf returns the agent named by WithSource, or "" when it is unknown.
+func SourceOf(ctx context.Context) string {
+	source, _ := ctx.Value(sourceKey{}).(string)
+	return source
+}
+
+// SourceFor returns the agent that writes the metric, see WithSources.
+func SourceFor(ctx context.Context, metricType string, name string) string {
+	sources, _ := ctx.Value(sourcesKey{}).(map[Change]string)
+	if source, ok := sources[Change{Type: metricType, ID: name}]; ok {
+		return source
+	}
+	return SourceOf(ctx)
+}
+
+// sourceArg is the source of ctx as a query argument, NULL when it is
+// unknown.
+func sourceArg(ctx context.Context) interface{} {
+	return nullable(SourceOf(ctx))
+}
+
+// metricSourceArg is the source of one metric of an import as a query
+// argument, see sourceArg.
+func metricSourceArg(ctx context.Context, metricType string, name string) interface{} {
+	return nullable(SourceFor(ctx, metricType, name))
+}
+
+func nullable(source string) interface{} {
+	if source != "" {
+		return source
+	}
+	return nil
+}
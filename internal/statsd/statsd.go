@@ -0,0 +1,251 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/NikWaltz/metrics-collector/internal/logger"
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+var log = logger.For("statsd")
+
+const maxPacketSize = 65535
+
+// Updater is the collector the listener flushes to. Relative changes of
+// gauges that were not set in the interval go to AddGauge, which applies
+// them to the stored value in one step.
+type Updater interface {
+	Update(context.Context, string, string, string) error
+	AddGauge(context.Context, string, model.Gauge) error
+}
+
+type sample struct {
+	name     string
+	kind     string
+	value    float64
+	rate     float64
+	relative bool
+}
+
+// timer aggregates the samples of a timer. count is scaled by the sample
+// rates; the mean is over the received samples.
+type timer struct {
+	count   float64
+	samples float64
+	sum     float64
+	min     float64
+	max     float64
+}
+
+type listener struct {
+	collector     Updater
+	addr          string
+	flushInterval time.Duration
+
+	mu       sync.Mutex
+	conn     net.PacketConn
+	counters map[string]float64
+	// gauges holds the gauges set in the interval, deltas the changes of
+	// the gauges that were not.
+	gauges map[string]float64
+	deltas map[string]float64
+	timers map[string]*timer
+	done   chan struct{}
+}
+
+func NewListener(collector Updater, addr string, flushInterval time.Duration) *listener {
+	return &listener{
+		collector:     collector,
+		addr:          addr,
+		flushInterval: flushInterval,
+		counters:      make(map[string]float64),
+		gauges:        make(map[string]float64),
+		deltas:        make(map[string]float64),
+		timers:        make(map[string]*timer),
+		done:          make(chan struct{}),
+	}
+}
+
+func parseLine(line string) (sample, error) {
+	var s sample
+	pipe := strings.Index(line, "|")
+	if pipe < 0 {
+		return s, fmt.Errorf("statsd: malformed line %q", line)
+	}
+	nameEnd := strings.LastIndex(line[:pipe], ":")
+	if nameEnd <= 0 {
+		return s, fmt.Errorf("statsd: malformed line %q", line)
+	}
+	s.name = line[:nameEnd]
+	parts := strings.Split(line[nameEnd+1:], "|")
+	if len(parts) < 2 {
+		return s, fmt.Errorf("statsd: malformed line %q", line)
+	}
+	rawValue := parts[0]
+	s.kind = parts[1]
+	s.rate = 1
+	for _, field := range parts[2:] {
+		if strings.HasPrefix(field, "@") {
+			rate, err := strconv.ParseFloat(field[1:], 64)
+			if err != nil || rate <= 0 || rate > 1 {
+				return s, fmt.Errorf("statsd: bad sample rate in %q", line)
+			}
+			s.rate = rate
+		}
+	}
+	switch s.kind {
+	case "c", "ms", "h":
+	case "g":
+		s.relative = strings.HasPrefix(rawValue, "+") || strings.HasPrefix(rawValue, "-")
+	default:
+		return s, fmt.Errorf("statsd: unsupported metric type %q", s.kind)
+	}
+	value, err := strconv.ParseFloat(rawValue, 64)
+	if err != nil {
+		return s, fmt.Errorf("statsd: bad value in %q", line)
+	}
+	s.value = value
+	return s, nil
+}
+
+func (l *listener) add(s sample) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch s.kind {
+	case "c":
+		l.counters[s.name] += s.value / s.rate
+	case "g":
+		_, set := l.gauges[s.name]
+		switch {
+		case !s.relative:
+			l.gauges[s.name] = s.value
+			delete(l.deltas, s.name)
+		case set:
+			l.gauges[s.name] += s.value
+		default:
+			l.deltas[s.name] += s.value
+		}
+	case "ms", "h":
+		t, ok := l.timers[s.name]
+		if !ok {
+			t = &timer{min: s.value, max: s.value}
+			l.timers[s.name] = t
+		}
+		t.count += 1 / s.rate
+		t.samples++
+		t.sum += s.value
+		t.min = math.Min(t.min, s.value)
+		t.max = math.Max(t.max, s.value)
+	}
+}
+
+func (l *listener) handlePacket(packet []byte) {
+	for _, line := range strings.Split(string(packet), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		s, err := parseLine(line)
+		if err != nil {
+			log.WithError(err).Debug("skipped statsd line")
+			continue
+		}
+		l.add(s)
+	}
+}
+
+func (l *listener) flush() {
+	l.mu.Lock()
+	counters := l.counters
+	timers := l.timers
+	gauges := l.gauges
+	deltas := l.deltas
+	l.counters = make(map[string]float64)
+	l.timers = make(map[string]*timer)
+	l.gauges = make(map[string]float64)
+	l.deltas = make(map[string]float64)
+	l.mu.Unlock()
+
+	ctx := context.Background()
+	for name, value := range counters {
+		l.update(ctx, model.CounterType, name, strconv.FormatInt(int64(math.Round(value)), 10))
+	}
+	for name, value := range gauges {
+		l.update(ctx, model.GaugeType, name, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	for name, delta := range deltas {
+		if err := l.collector.AddGauge(ctx, name, model.Gauge(delta)); err != nil {
+			log.WithError(err).WithField("metric", name).Error("unable to flush metric")
+		}
+	}
+	for name, t := range timers {
+		l.update(ctx, model.CounterType, name+".count", strconv.FormatInt(int64(math.Round(t.count)), 10))
+		l.update(ctx, model.GaugeType, name+".min", strconv.FormatFloat(t.min, 'f', -1, 64))
+		l.update(ctx, model.GaugeType, name+".max", strconv.FormatFloat(t.max, 'f', -1, 64))
+		l.update(ctx, model.GaugeType, name+".mean", strconv.FormatFloat(t.sum/t.samples, 'f', -1, 64))
+	}
+}
+
+func (l *listener) update(ctx context.Context, metricType string, name string, value string) {
+	err := l.collector.Update(ctx, metricType, name, value)
+	if err != nil {
+		log.WithError(err).WithField("metric", name).Error("unable to flush metric")
+	}
+}
+
+func (l *listener) flushTask() {
+	ticker := time.NewTicker(l.flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.flush()
+		case <-l.done:
+			return
+		}
+	}
+}
+
+func (l *listener) Run() error {
+	conn, err := net.ListenPacket("udp", l.addr)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.conn = conn
+	l.mu.Unlock()
+	log.WithField("address", conn.LocalAddr().String()).Info("statsd listener started")
+
+	go l.flushTask()
+	buf := make([]byte, maxPacketSize)
+	for {
+		n, _, errRead := conn.ReadFrom(buf)
+		if errRead != nil {
+			if errors.Is(errRead, net.ErrClosed) {
+				return nil
+			}
+			return errRead
+		}
+		l.handlePacket(buf[:n])
+	}
+}
+
+func (l *listener) Close() {
+	l.mu.Lock()
+	conn := l.conn
+	l.mu.Unlock()
+	if conn == nil {
+		return
+	}
+	close(l.done)
+	conn.Close()
+	l.flush()
+}
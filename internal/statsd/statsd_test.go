@@ -0,0 +1,165 @@
+package statsd
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/NikWaltz/metrics-collector/model"
+)
+
+type update struct {
+	metricType string
+	name       string
+	value      string
+}
+
+type mockUpdater struct {
+	mu      sync.Mutex
+	updates map[string]update
+	deltas  map[string]model.Gauge
+}
+
+func (u *mockUpdater) Update(ctx context.Context, metricType string, name string, value string) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.updates[name] = update{metricType: metricType, name: name, value: value}
+	return nil
+}
+
+func (u *mockUpdater) AddGauge(ctx context.Context, name string, delta model.Gauge) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.deltas[name] += delta
+	return nil
+}
+
+func (u *mockUpdater) get(name string) (update, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	value, ok := u.updates[name]
+	return value, ok
+}
+
+func Test_parseLine(t *testing.T) {
+	tests := []struct {
+		name    string
+		line    string
+		want    sample
+		wantErr bool
+	}{
+		{
+			name: "Parse counter",
+			line: "requests:1|c",
+			want: sample{name: "requests", kind: "c", value: 1, rate: 1},
+		},
+		{
+			name: "Parse counter with sample rate",
+			line: "requests:2|c|@0.5",
+			want: sample{name: "requests", kind: "c", value: 2, rate: 0.5},
+		},
+		{
+			name: "Parse gauge",
+			line: "temperature:3.2|g",
+			want: sample{name: "temperature", kind: "g", value: 3.2, rate: 1},
+		},
+		{
+			name: "Parse relative gauge",
+			line: "temperature:-1.5|g",
+			want: sample{name: "temperature", kind: "g", value: -1.5, rate: 1, relative: true},
+		},
+		{
+			name: "Parse timer with tags",
+			line: "latency:320|ms|#host:a",
+			want: sample{name: "latency", kind: "ms", value: 320, rate: 1},
+		},
+		{
+			name:    "Parse set",
+			line:    "users:42|s",
+			wantErr: true,
+		},
+		{
+			name:    "Parse bad value",
+			line:    "requests:one|c",
+			wantErr: true,
+		},
+		{
+			name:    "Parse bad sample rate",
+			line:    "requests:1|c|@2",
+			wantErr: true,
+		},
+		{
+			name:    "Parse line without type",
+			line:    "requests:1",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseLine(tt.line)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_listener_flush(t *testing.T) {
+	updater := &mockUpdater{updates: make(map[string]update), deltas: make(map[string]model.Gauge)}
+	l := NewListener(updater, "", time.Second)
+	l.handlePacket([]byte("requests:1|c\nrequests:1|c|@0.25\ntemperature:20|g\ntemperature:+2.5|g\nlatency:100|ms\nlatency:300|ms|@0.5\nbroken"))
+	l.flush()
+
+	assert.Equal(t, update{model.CounterType, "requests", "5"}, updater.updates["requests"])
+	assert.Equal(t, update{model.GaugeType, "temperature", "22.5"}, updater.updates["temperature"])
+	// The count is scaled by the sample rate, the mean is over the samples.
+	assert.Equal(t, update{model.CounterType, "latency.count", "3"}, updater.updates["latency.count"])
+	assert.Equal(t, update{model.GaugeType, "latency.min", "100"}, updater.updates["latency.min"])
+	assert.Equal(t, update{model.GaugeType, "latency.max", "300"}, updater.updates["latency.max"])
+	assert.Equal(t, update{model.GaugeType, "latency.mean", "200"}, updater.updates["latency.mean"])
+
+	// Relative changes of gauges that were not set in the interval apply to
+	// the stored values.
+	updater.updates = make(map[string]update)
+	l.handlePacket([]byte("temperature:-0.5|g\npressure:+3|g\npressure:+1|g\nhumidity:+1|g\nhumidity:40|g"))
+	l.flush()
+	assert.Equal(t, map[string]model.Gauge{"temperature": -0.5, "pressure": 4}, updater.deltas)
+	assert.Equal(t, map[string]update{"humidity": {model.GaugeType, "humidity", "40"}}, updater.updates)
+}
+
+func Test_listener_Run(t *testing.T) {
+	updater := &mockUpdater{updates: make(map[string]update), deltas: make(map[string]model.Gauge)}
+	l := NewListener(updater, "127.0.0.1:0", 10*time.Millisecond)
+	go func() {
+		assert.NoError(t, l.Run())
+	}()
+	assert.Eventually(t, func() bool {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		return l.conn != nil
+	}, time.Second, 5*time.Millisecond)
+
+	l.mu.Lock()
+	addr := l.conn.LocalAddr().String()
+	l.mu.Unlock()
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("hits:3|c"))
+	assert.NoError(t, err)
+
+	assert.Eventually(t, func() bool {
+		value, ok := updater.get("hits")
+		return ok && value.value == "3"
+	}, time.Second, 10*time.Millisecond)
+	l.Close()
+}
@@ -0,0 +1,150 @@
+package tlsconfig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type certificate struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// issue creates a certificate signed by parent, or a self-signed CA when
+// parent is nil, and writes it with its key to dir/name.crt and dir/name.key.
+func issue(t *testing.T, dir string, name string, parent *certificate, usage x509.ExtKeyUsage) *certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &certificate{cert: cert, key: key}
+}
+
+func TestServerAndClient(t *testing.T) {
+	dir := t.TempDir()
+	ca := issue(t, dir, "ca", nil, x509.ExtKeyUsageAny)
+	issue(t, dir, "server", ca, x509.ExtKeyUsageServerAuth)
+	issue(t, dir, "agent", ca, x509.ExtKeyUsageClientAuth)
+	issue(t, dir, "rogue-ca", nil, x509.ExtKeyUsageAny)
+	path := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+
+	tests := []struct {
+		name       string
+		clientCA   string
+		caFile     string
+		certFile   string
+		keyFile    string
+		wantErr    bool
+		wantStatus int
+	}{
+		{
+			name:       "TLS without client certificate",
+			caFile:     path("ca.crt"),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "mTLS with client certificate",
+			clientCA:   path("ca.crt"),
+			caFile:     path("ca.crt"),
+			certFile:   path("agent.crt"),
+			keyFile:    path("agent.key"),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:     "mTLS without client certificate",
+			clientCA: path("ca.crt"),
+			caFile:   path("ca.crt"),
+			wantErr:  true,
+		},
+		{
+			name:    "Untrusted server certificate",
+			caFile:  path("rogue-ca.crt"),
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			serverConfig, err := Server(path("server.crt"), path("server.key"), tt.clientCA)
+			if err != nil {
+				t.Fatal(err)
+			}
+			server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			server.TLS = serverConfig
+			server.StartTLS()
+			defer server.Close()
+
+			clientConfig, err := Client(tt.caFile, tt.certFile, tt.keyFile)
+			if err != nil {
+				t.Fatal(err)
+			}
+			client := &http.Client{Transport: &http.Transport{TLSClientConfig: clientConfig}}
+			response, err := client.Get(server.URL)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			defer response.Body.Close()
+			assert.Equal(t, tt.wantStatus, response.StatusCode)
+		})
+	}
+}
+
+func TestClient_partialCertificate(t *testing.T) {
+	_, err := Client("", "agent.crt", "")
+	assert.Error(t, err)
+}
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS histograms CASCADE;
\ No newline at end of file
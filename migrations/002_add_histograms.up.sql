@@ -0,0 +1,7 @@
+CREATE TABLE histograms (
+                       id TEXT PRIMARY KEY NOT NULL,
+                       bounds double precision[] NOT NULL,
+                       counts bigint[] NOT NULL,
+                       count bigint NOT NULL,
+                       sum double precision NOT NULL
+);
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS seeds CASCADE;
\ No newline at end of file
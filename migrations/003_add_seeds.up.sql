@@ -0,0 +1,6 @@
+CREATE TABLE seeds (
+                       source TEXT NOT NULL,
+                       checksum TEXT NOT NULL,
+                       metrics integer NOT NULL,
+                       seeded_at timestamptz NOT NULL DEFAULT now()
+);
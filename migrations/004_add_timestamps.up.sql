@@ -0,0 +1,6 @@
+ALTER TABLE gauges ADD COLUMN created_at timestamptz NOT NULL DEFAULT now(),
+                   ADD COLUMN updated_at timestamptz NOT NULL DEFAULT now();
+ALTER TABLE counters ADD COLUMN created_at timestamptz NOT NULL DEFAULT now(),
+                     ADD COLUMN updated_at timestamptz NOT NULL DEFAULT now();
+ALTER TABLE histograms ADD COLUMN created_at timestamptz NOT NULL DEFAULT now(),
+                       ADD COLUMN updated_at timestamptz NOT NULL DEFAULT now();
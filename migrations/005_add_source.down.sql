@@ -0,0 +1,3 @@
+ALTER TABLE gauges DROP COLUMN IF EXISTS source;
+ALTER TABLE counters DROP COLUMN IF EXISTS source;
+ALTER TABLE histograms DROP COLUMN IF EXISTS source;
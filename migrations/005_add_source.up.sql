@@ -0,0 +1,3 @@
+ALTER TABLE gauges ADD COLUMN source TEXT;
+ALTER TABLE counters ADD COLUMN source TEXT;
+ALTER TABLE histograms ADD COLUMN source TEXT;
@@ -0,0 +1,6 @@
+CREATE TABLE metadata (
+                       id TEXT PRIMARY KEY NOT NULL,
+                       unit TEXT NOT NULL DEFAULT '',
+                       description TEXT NOT NULL DEFAULT '',
+                       updated_at timestamptz NOT NULL DEFAULT now()
+);
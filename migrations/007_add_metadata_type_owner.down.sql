@@ -0,0 +1 @@
+ALTER TABLE metadata DROP COLUMN type, DROP COLUMN owner;
@@ -0,0 +1,2 @@
+ALTER TABLE metadata ADD COLUMN type TEXT NOT NULL DEFAULT '',
+                     ADD COLUMN owner TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,8 @@
+// Package migrations holds the schema of the Postgres backend. The files are
+// embedded, so the server migrates the database from any working directory.
+package migrations
+
+import "embed"
+
+//go:embed *.sql
+var FS embed.FS
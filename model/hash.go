@@ -0,0 +1,49 @@
+package model
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// HashData is the content of the metric that Hash signs, nil for a metric
+// without a value. Gauges and counters keep the text of the first version
+// of the scheme. Histograms list every number in its shortest exact form,
+// so that values that only differ past the sixth decimal sign differently.
+func (m *Metrics) HashData() []byte {
+	switch strings.ToLower(m.MType) {
+	case GaugeType:
+		if m.Value != nil {
+			return []byte(fmt.Sprintf("%s:gauge:%f", m.ID, *m.Value))
+		}
+	case CounterType:
+		if m.Delta != nil {
+			return []byte(fmt.Sprintf("%s:counter:%d", m.ID, *m.Delta))
+		}
+	case HistogramType:
+		if h := m.Histogram; h != nil {
+			counts := make([]string, len(h.Counts))
+			for i, count := range h.Counts {
+				counts[i] = strconv.FormatInt(count, 10)
+			}
+			return []byte(strings.Join([]string{m.ID, HistogramType, strconv.FormatInt(h.Count, 10),
+				formatFloat(h.Sum), formatFloats(h.Bounds), strings.Join(counts, ",")}, ":"))
+		}
+		if m.Value != nil {
+			return []byte(m.ID + ":" + HistogramType + ":" + formatFloat(*m.Value))
+		}
+	}
+	return nil
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func formatFloats(values []float64) string {
+	texts := make([]string, len(values))
+	for i, value := range values {
+		texts[i] = formatFloat(value)
+	}
+	return strings.Join(texts, ",")
+}
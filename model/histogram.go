@@ -0,0 +1,82 @@
+package model
+
+import (
+	"errors"
+	"sort"
+)
+
+// DefaultBuckets are the upper bounds used for a histogram that is created
+// by a single observation. The server may override them on startup.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram keeps per-bucket (non-cumulative) counts. Counts has one more
+// element than Bounds: the last bucket collects everything above the last bound.
+type Histogram struct {
+	Bounds []float64 `json:"bounds"`
+	Counts []int64   `json:"counts"`
+	Count  int64     `json:"count"`
+	Sum    float64   `json:"sum"`
+}
+
+func NewHistogram(bounds []float64) Histogram {
+	h := Histogram{
+		Bounds: make([]float64, len(bounds)),
+		Counts: make([]int64, len(bounds)+1),
+	}
+	copy(h.Bounds, bounds)
+	return h
+}
+
+func (h *Histogram) Observe(value float64) {
+	i := sort.SearchFloat64s(h.Bounds, value)
+	h.Counts[i]++
+	h.Count++
+	h.Sum += value
+}
+
+func (h Histogram) Validate() error {
+	if len(h.Counts) != len(h.Bounds)+1 {
+		return errors.New("histogram must have one more count than bounds")
+	}
+	for i := 1; i < len(h.Bounds); i++ {
+		if h.Bounds[i] <= h.Bounds[i-1] {
+			return errors.New("histogram bounds must be strictly increasing")
+		}
+	}
+	var total int64
+	for _, c := range h.Counts {
+		if c < 0 {
+			return errors.New("histogram counts must not be negative")
+		}
+		total += c
+	}
+	if total != h.Count {
+		return errors.New("histogram count does not match bucket counts")
+	}
+	return nil
+}
+
+func (h *Histogram) Merge(other Histogram) error {
+	if len(h.Bounds) != len(other.Bounds) {
+		return errors.New("histogram buckets mismatch")
+	}
+	for i := range h.Bounds {
+		if h.Bounds[i] != other.Bounds[i] {
+			return errors.New("histogram buckets mismatch")
+		}
+	}
+	for i := range h.Counts {
+		h.Counts[i] += other.Counts[i]
+	}
+	h.Count += other.Count
+	h.Sum += other.Sum
+	return nil
+}
+
+func (h Histogram) Copy() Histogram {
+	c := NewHistogram(h.Bounds)
+	copy(c.Counts, h.Counts)
+	c.Count = h.Count
+	c.Sum = h.Sum
+	return c
+}
@@ -0,0 +1,31 @@
+package model
+
+// Metadata describes a metric. A metric with a registered Type can only be
+// written as that type. Hash and KeyID sign an entry sent to the server and
+// are not stored.
+type Metadata struct {
+	ID          string `json:"id"`
+	Type        string `json:"type,omitempty"`
+	Unit        string `json:"unit,omitempty"`
+	Description string `json:"description,omitempty"`
+	Owner       string `json:"owner,omitempty"`
+	Hash        string `json:"hash,omitempty"`
+	KeyID       string `json:"key_id,omitempty"`
+}
+
+// Merge returns the metadata with the non-empty fields of update.
+func (m Metadata) Merge(update Metadata) Metadata {
+	if update.Type != "" {
+		m.Type = update.Type
+	}
+	if update.Unit != "" {
+		m.Unit = update.Unit
+	}
+	if update.Description != "" {
+		m.Description = update.Description
+	}
+	if update.Owner != "" {
+		m.Owner = update.Owner
+	}
+	return m
+}
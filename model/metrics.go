@@ -5,49 +5,60 @@ type Counter int64
 
 const GaugeType = "gauge"
 const CounterType = "counter"
+const HistogramType = "histogram"
 
+// MetricsList holds the runtime metrics of an agent. The unit and help tags
+// are registered as the metadata of the metrics.
 type MetricsList struct {
-	Alloc         Gauge
-	BuckHashSys   Gauge
-	Frees         Gauge
-	GCCPUFraction Gauge
-	GCSys         Gauge
-	HeapAlloc     Gauge
-	HeapIdle      Gauge
-	HeapInuse     Gauge
-	HeapObjects   Gauge
-	HeapReleased  Gauge
-	HeapSys       Gauge
-	LastGC        Gauge
-	Lookups       Gauge
-	MCacheInuse   Gauge
-	MCacheSys     Gauge
-	MSpanInuse    Gauge
-	MSpanSys      Gauge
-	Mallocs       Gauge
-	NextGC        Gauge
-	NumForcedGC   Gauge
-	NumGC         Gauge
-	OtherSys      Gauge
-	PauseTotalNs  Gauge
-	StackInuse    Gauge
-	StackSys      Gauge
-	Sys           Gauge
-	TotalAlloc    Gauge
-	RandomValue   Gauge
-	PollCount     Counter
+	Alloc         Gauge     `unit:"bytes" help:"Bytes of allocated heap objects."`
+	BuckHashSys   Gauge     `unit:"bytes" help:"Memory in profiling bucket hash tables."`
+	Frees         Gauge     `unit:"objects" help:"Cumulative count of heap objects freed."`
+	GCCPUFraction Gauge     `unit:"ratio" help:"Fraction of the available CPU time used by the GC since the program started."`
+	GCSys         Gauge     `unit:"bytes" help:"Memory in garbage collection metadata."`
+	HeapAlloc     Gauge     `unit:"bytes" help:"Bytes of allocated heap objects."`
+	HeapIdle      Gauge     `unit:"bytes" help:"Bytes in idle heap spans."`
+	HeapInuse     Gauge     `unit:"bytes" help:"Bytes in in-use heap spans."`
+	HeapObjects   Gauge     `unit:"objects" help:"Number of allocated heap objects."`
+	HeapReleased  Gauge     `unit:"bytes" help:"Physical memory returned to the OS."`
+	HeapSys       Gauge     `unit:"bytes" help:"Heap memory obtained from the OS."`
+	LastGC        Gauge     `unit:"nanoseconds" help:"Time the last garbage collection finished, since the Unix epoch."`
+	Lookups       Gauge     `unit:"lookups" help:"Number of pointer lookups performed by the runtime."`
+	MCacheInuse   Gauge     `unit:"bytes" help:"Bytes of allocated mcache structures."`
+	MCacheSys     Gauge     `unit:"bytes" help:"Memory obtained from the OS for mcache structures."`
+	MSpanInuse    Gauge     `unit:"bytes" help:"Bytes of allocated mspan structures."`
+	MSpanSys      Gauge     `unit:"bytes" help:"Memory obtained from the OS for mspan structures."`
+	Mallocs       Gauge     `unit:"objects" help:"Cumulative count of heap objects allocated."`
+	NextGC        Gauge     `unit:"bytes" help:"Target heap size of the next GC cycle."`
+	NumForcedGC   Gauge     `unit:"cycles" help:"Number of GC cycles forced by the application."`
+	NumGC         Gauge     `unit:"cycles" help:"Number of completed GC cycles."`
+	OtherSys      Gauge     `unit:"bytes" help:"Memory in miscellaneous off-heap runtime allocations."`
+	PauseTotalNs  Gauge     `unit:"nanoseconds" help:"Cumulative time of GC stop-the-world pauses."`
+	StackInuse    Gauge     `unit:"bytes" help:"Bytes in stack spans."`
+	StackSys      Gauge     `unit:"bytes" help:"Stack memory obtained from the OS."`
+	Sys           Gauge     `unit:"bytes" help:"Total memory obtained from the OS."`
+	TotalAlloc    Gauge     `unit:"bytes" help:"Cumulative bytes allocated for heap objects."`
+	RandomValue   Gauge     `help:"A random value in [0, 1)."`
+	PollCount     Counter   `unit:"polls" help:"Number of times the agent read the runtime metrics."`
+	GCPause       Histogram `unit:"nanoseconds" help:"Durations of GC stop-the-world pauses."`
 }
 
 type ExtraMetricsList struct {
-	TotalMemory     Gauge
-	FreeMemory      Gauge
-	CPUutilization1 Gauge
+	TotalMemory     Gauge `unit:"bytes" help:"Total physical memory."`
+	FreeMemory      Gauge `unit:"bytes" help:"Free physical memory."`
+	CPUutilization1 Gauge `unit:"percent" help:"Utilization of all CPUs."`
 }
 
 type Metrics struct {
-	ID    string   `json:"id"`
-	MType string   `json:"type"`
-	Delta *int64   `json:"delta,omitempty"`
-	Value *float64 `json:"value,omitempty"`
-	Hash  string   `json:"hash,omitempty"`
+	ID        string     `json:"id"`
+	MType     string     `json:"type"`
+	Delta     *int64     `json:"delta,omitempty"`
+	Value     *float64   `json:"value,omitempty"`
+	Histogram *Histogram `json:"histogram,omitempty"`
+	Hash      string     `json:"hash,omitempty"`
+	KeyID     string     `json:"key_id,omitempty"`
+	// Unit, Description and Owner register the metadata of the metric
+	// along with the value. They are not covered by Hash.
+	Unit        string `json:"unit,omitempty"`
+	Description string `json:"description,omitempty"`
+	Owner       string `json:"owner,omitempty"`
 }
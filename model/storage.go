@@ -1,8 +1,10 @@
 package model
 
 type Storage struct {
-	Gauges   map[string]Gauge
-	Counters map[string]Counter
+	Gauges     map[string]Gauge
+	Counters   map[string]Counter
+	Histograms map[string]Histogram
+	Metadata   map[string]Metadata
 }
 
 func (s *Storage) SaveGauge(name string, value Gauge) {
@@ -13,6 +15,13 @@ func (s *Storage) SaveCounter(name string, value Counter) {
 	s.Counters[name] = value
 }
 
+func (s *Storage) SaveHistogram(name string, value Histogram) {
+	if s.Histograms == nil {
+		s.Histograms = make(map[string]Histogram)
+	}
+	s.Histograms[name] = value
+}
+
 func (s *Storage) GetGauge(name string) (Gauge, bool) {
 	value, ok := s.Gauges[name]
 	return value, ok
@@ -23,6 +32,36 @@ func (s *Storage) GetCounter(name string) (Counter, bool) {
 	return value, ok
 }
 
+func (s *Storage) GetHistogram(name string) (Histogram, bool) {
+	value, ok := s.Histograms[name]
+	return value, ok
+}
+
+// Delete removes the value of a metric of the type.
+func (s *Storage) Delete(metricType string, name string) {
+	switch metricType {
+	case GaugeType:
+		delete(s.Gauges, name)
+	case CounterType:
+		delete(s.Counters, name)
+	case HistogramType:
+		delete(s.Histograms, name)
+	}
+}
+
+func (s *Storage) SaveMetadata(name string, value Metadata) {
+	if s.Metadata == nil {
+		s.Metadata = make(map[string]Metadata)
+	}
+	s.Metadata[name] = value
+}
+
+func (s *Storage) GetMetadata(name string) (Metadata, bool) {
+	value, ok := s.Metadata[name]
+	return value, ok
+}
+
 func NewStorage() *Storage {
-	return &Storage{Gauges: make(map[string]Gauge), Counters: make(map[string]Counter)}
+	return &Storage{Gauges: make(map[string]Gauge), Counters: make(map[string]Counter), Histograms: make(map[string]Histogram),
+		Metadata: make(map[string]Metadata)}
 }